@@ -2,11 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/silh/trakind/pkg/api"
 	"github.com/silh/trakind/pkg/bots"
 	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
 	"github.com/silh/trakind/pkg/loggers"
+	"github.com/silh/trakind/pkg/web"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,11 +32,33 @@ func main() {
 		log.Fatal("TELEGRAM_API_KEY env variable must be set")
 	}
 	setUpdateIntervalFromEnv()
+	setConversationTimeoutFromEnv()
 
-	bot, err := bots.New(apiKey)
+	if err := db.Open(storageConfigFromEnv()); err != nil {
+		log.Fatalw("Failed to open storage", "err", err)
+	}
+	defer db.Close()
+
+	bot, err := bots.New(apiKey, adminsFromEnv())
 	if err != nil {
 		log.Fatalw("Failed to create new bot API", "err", err)
 	}
+	if err := bot.SetChannels(channelsFromEnv()); err != nil {
+		log.Fatalw("Failed to set up channels", "err", err)
+	}
+	bot.SetEventWebhooks(eventWebhooksFromEnv())
+	var emailNotifier *bots.EmailNotifier
+	if emailConfig, ok := emailConfigFromEnv(); ok {
+		emailNotifier, err = bots.NewEmailNotifier(emailConfig)
+		if err != nil {
+			log.Fatalw("Failed to set up email notifications", "err", err)
+		}
+		bot.EnableEmail(emailNotifier)
+	}
+	calendarConfig, calendarEnabled := calendarConfigFromEnv()
+	if calendarEnabled {
+		bot.EnableCalendar(calendarConfig)
+	}
 
 	ctx := context.Background()
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
@@ -53,11 +85,63 @@ func main() {
 		}
 	}
 	go reportNumberOfSubscriptions(ctx)
-	bot.Run() // blocks until done
+	go db.RunBackups(ctx, backupConfigFromEnv())
+	go bot.RunBroadcasts(ctx)
+	go bot.RunEventWebhooks(ctx)
+	if addr := os.Getenv("HTTP_LISTEN_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(api.Prefix, api.Handler())
+		mux.Handle("/metrics", web.Metrics())
+		mux.Handle(web.FeedsPath, web.Feeds(publicURLFromEnv()))
+		if calendarEnabled {
+			mux.Handle(bots.CalendarPath, web.Calendar(calendarConfig.Secret))
+		}
+		mux.Handle("/", web.Dashboard())
+		go serveHTTP(ctx, addr, mux)
+	}
+	if emailNotifier != nil {
+		go emailNotifier.Run(ctx)
+	}
+	var outboxDone sync.WaitGroup
+	outboxDone.Add(1)
+	go func() {
+		defer outboxDone.Done()
+		bot.RunOutbox(ctx)
+	}()
+	if webhook, ok := webhookConfigFromEnv(); ok {
+		if err := bot.RunWebhook(webhook); err != nil { // blocks until done
+			log.Errorw("Webhook mode failed", "err", err)
+			stop()
+		}
+	} else {
+		bot.Run() // blocks until done
+	}
 	wg.Wait()
+	outboxDone.Wait()
 	log.Info("Exiting")
 }
 
+// serveHTTP serves the HTTP API, metrics and the dashboard on HTTP_LISTEN_ADDR until ctx is done.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnw("Failed to shut down HTTP server", "err", err)
+		}
+	}()
+	log.Infow("Serving HTTP", "addr", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalw("HTTP server failed", "addr", addr, "err", err)
+	}
+}
+
 func setUpdateIntervalFromEnv() {
 	intervalFromEnv := os.Getenv("UPDATE_INTERVAL")
 	if intervalFromEnv != "" {
@@ -70,6 +154,220 @@ func setUpdateIntervalFromEnv() {
 	}
 }
 
+// setConversationTimeoutFromEnv sets how long the bot waits for an answer in the tracking wizard from
+// CONVERSATION_TIMEOUT.
+func setConversationTimeoutFromEnv() {
+	timeoutFromEnv := os.Getenv("CONVERSATION_TIMEOUT")
+	if timeoutFromEnv == "" {
+		return
+	}
+	duration, err := time.ParseDuration(timeoutFromEnv)
+	if err != nil || duration <= 0 {
+		log.Warnw("Could not parse positive duration from env CONVERSATION_TIMEOUT", "value", timeoutFromEnv, "err", err)
+		return
+	}
+	bots.ConversationTimeout = duration
+}
+
+// storageConfigFromEnv selects storage backend with STORAGE_BACKEND (nutsdb by default), its location with
+// STORAGE_PATH and directory for backups made before migrations with STORAGE_BACKUP_DIR.
+func storageConfigFromEnv() db.Config {
+	config := db.Config{
+		Backend:   os.Getenv("STORAGE_BACKEND"),
+		Path:      os.Getenv("STORAGE_PATH"),
+		BackupDir: os.Getenv("STORAGE_BACKUP_DIR"),
+	}
+	if config.Backend == "" {
+		config.Backend = db.BackendNuts
+	}
+	return config
+}
+
+// webhookConfigFromEnv returns webhook configuration if UPDATES_MODE is "webhook", long polling is used otherwise.
+// WEBHOOK_URL is the public address of the bot, the embedded server listens on WEBHOOK_LISTEN_ADDR (":8080" by
+// default) and serves HTTPS if WEBHOOK_CERT_FILE and WEBHOOK_KEY_FILE are set. Requests must carry WEBHOOK_SECRET,
+// a random one is generated on every start if it's empty.
+func webhookConfigFromEnv() (bots.WebhookConfig, bool) {
+	mode := os.Getenv("UPDATES_MODE")
+	switch mode {
+	case "", "polling":
+		return bots.WebhookConfig{}, false
+	case "webhook":
+	default:
+		log.Fatalw("Unknown UPDATES_MODE, must be polling or webhook", "mode", mode)
+	}
+	config := bots.WebhookConfig{
+		URL:         os.Getenv("WEBHOOK_URL"),
+		ListenAddr:  os.Getenv("WEBHOOK_LISTEN_ADDR"),
+		SecretToken: os.Getenv("WEBHOOK_SECRET"),
+		CertFile:    os.Getenv("WEBHOOK_CERT_FILE"),
+		KeyFile:     os.Getenv("WEBHOOK_KEY_FILE"),
+	}
+	if config.URL == "" {
+		log.Fatal("WEBHOOK_URL env variable must be set in webhook mode")
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = ":8080"
+	}
+	if config.SecretToken == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalw("Failed to generate webhook secret", "err", err)
+		}
+		config.SecretToken = hex.EncodeToString(secret)
+	}
+	return config, true
+}
+
+// adminsFromEnv reads comma separated chat IDs that can use admin commands from ADMIN_CHAT_IDS.
+func adminsFromEnv() []domain.ChatID {
+	var admins []domain.ChatID
+	for _, field := range strings.Split(os.Getenv("ADMIN_CHAT_IDS"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		chatID, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			log.Warnw("Could not parse chat ID from env ADMIN_CHAT_IDS", "value", field, "err", err)
+			continue
+		}
+		admins = append(admins, domain.ChatID(chatID))
+	}
+	return admins
+}
+
+// channelsFromEnv reads channels where new time windows are published from CHANNELS: comma separated
+// <channel>=<location code>[:<action code>[:<persons>]] entries, e.g. "@ind_amsterdam=AM,-1001234=DH:BIO:2".
+// Windows of all actions of the location for 1 person are published unless specified otherwise.
+func channelsFromEnv() []bots.Channel {
+	var channels []bots.Channel
+	for _, field := range strings.Split(os.Getenv("CHANNELS"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		chat, route, ok := strings.Cut(field, "=")
+		if !ok || chat == "" || route == "" {
+			log.Fatalw("Could not parse channel from env CHANNELS, expected <channel>=<location>", "value", field)
+		}
+		parts := strings.Split(route, ":")
+		channel := bots.Channel{Chat: chat, Location: parts[0], PeopleCount: 1}
+		if len(parts) > 1 {
+			channel.Action = parts[1]
+		}
+		if len(parts) > 2 {
+			peopleCount, err := strconv.Atoi(parts[2])
+			if err != nil || peopleCount < 1 || peopleCount > domain.MaxPeopleCount {
+				log.Fatalw("Could not parse number of people from env CHANNELS", "value", field, "err", err)
+			}
+			channel.PeopleCount = peopleCount
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// emailConfigFromEnv returns SMTP server for email notifications from SMTP_ADDR (host:port), SMTP_USERNAME,
+// SMTP_PASSWORD and SMTP_FROM. Email is disabled if SMTP_ADDR is empty.
+func emailConfigFromEnv() (bots.EmailConfig, bool) {
+	config := bots.EmailConfig{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	if config.Addr == "" {
+		return bots.EmailConfig{}, false
+	}
+	if config.From == "" {
+		log.Fatal("SMTP_FROM env variable must be set when SMTP_ADDR is")
+	}
+	return config, true
+}
+
+// calendarConfigFromEnv returns the configuration of iCalendar feeds from CALENDAR_SECRET, which signs feed URLs, and
+// PUBLIC_URL, the URL HTTP_LISTEN_ADDR is reachable at. Feeds are disabled if CALENDAR_SECRET is empty.
+func calendarConfigFromEnv() (bots.CalendarConfig, bool) {
+	config := bots.CalendarConfig{
+		BaseURL: publicURLFromEnv(),
+		Secret:  os.Getenv("CALENDAR_SECRET"),
+	}
+	if config.Secret == "" {
+		return bots.CalendarConfig{}, false
+	}
+	if os.Getenv("HTTP_LISTEN_ADDR") == "" {
+		log.Fatal("HTTP_LISTEN_ADDR env variable must be set when CALENDAR_SECRET is")
+	}
+	if config.BaseURL == "" {
+		log.Fatal("PUBLIC_URL env variable must be set when CALENDAR_SECRET is")
+	}
+	return config, true
+}
+
+// publicURLFromEnv returns PUBLIC_URL, the URL HTTP_LISTEN_ADDR is reachable at, or an empty string if it isn't set.
+func publicURLFromEnv() string {
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		return ""
+	}
+	parsed, err := url.Parse(publicURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		log.Fatalw("PUBLIC_URL env variable must be an http(s) URL", "value", publicURL)
+	}
+	return publicURL
+}
+
+// eventWebhooksFromEnv reads comma separated URLs that receive events about all new time windows from EVENT_WEBHOOKS.
+// Requests are signed with EVENT_WEBHOOK_SECRET.
+func eventWebhooksFromEnv() []bots.WebhookEndpoint {
+	secret := os.Getenv("EVENT_WEBHOOK_SECRET")
+	var endpoints []bots.WebhookEndpoint
+	for _, field := range strings.Split(os.Getenv("EVENT_WEBHOOKS"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(field); err != nil {
+			log.Fatalw("Could not parse URL from env EVENT_WEBHOOKS", "value", field, "err", err)
+		}
+		endpoints = append(endpoints, bots.WebhookEndpoint{URL: field, Secret: secret})
+	}
+	if len(endpoints) > 0 && secret == "" {
+		log.Fatal("EVENT_WEBHOOK_SECRET env variable must be set when EVENT_WEBHOOKS is")
+	}
+	return endpoints
+}
+
+// backupConfigFromEnv reads schedule of snapshots from BACKUP_INTERVAL (disabled if empty), their directory from
+// BACKUP_DIR and the number of kept snapshots from BACKUP_KEEP.
+func backupConfigFromEnv() db.BackupConfig {
+	config := db.BackupConfig{
+		Dir:  os.Getenv("BACKUP_DIR"),
+		Keep: 7,
+	}
+	if config.Dir == "" {
+		config.Dir = "./snapshots"
+	}
+	if intervalFromEnv := os.Getenv("BACKUP_INTERVAL"); intervalFromEnv != "" {
+		duration, err := time.ParseDuration(intervalFromEnv)
+		if err == nil {
+			config.Interval = duration
+		} else {
+			log.Warnw("Could not parse duration from env BACKUP_INTERVAL", "err", err)
+		}
+	}
+	if keepFromEnv := os.Getenv("BACKUP_KEEP"); keepFromEnv != "" {
+		keep, err := strconv.Atoi(keepFromEnv)
+		if err == nil {
+			config.Keep = keep
+		} else {
+			log.Warnw("Could not parse number from env BACKUP_KEEP", "err", err)
+		}
+	}
+	return config
+}
+
 // reportNumberOfSubscriptions periodically prints number of subscriptions per location. Has infinite cycle until passed
 // context is Done. Doesn't take into consideration the action type
 func reportNumberOfSubscriptions(ctx context.Context) {
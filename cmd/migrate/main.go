@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/loggers"
+)
+
+var log = loggers.Logger()
+
+// migrate copies all data from one storage backend to another, e.g.:
+//
+//	migrate -from nutsdb -from-path ./db -to sqlite -to-path ./trakind.sqlite
+//
+// The data is copied as a snapshot that is restored into the destination, previous data of the destination is moved
+// aside.
+//
+// With -schema it only upgrades the schema of the source storage, -dry-run reports pending schema migrations without
+// applying them:
+//
+//	migrate -schema -dry-run -from nutsdb -from-path ./db
+func main() {
+	var from, to db.Config
+	var schemaOnly, dryRun bool
+	flag.StringVar(&from.Backend, "from", db.BackendNuts, "source backend: nutsdb, sqlite or memory")
+	flag.StringVar(&from.Path, "from-path", "", "source path, backend default if empty")
+	flag.StringVar(&to.Backend, "to", db.BackendSQLite, "destination backend: nutsdb or sqlite")
+	flag.StringVar(&to.Path, "to-path", "", "destination path, backend default if empty")
+	flag.StringVar(&from.BackupDir, "backup-dir", db.DefaultBackupDir, "where to back up data before schema migrations")
+	flag.BoolVar(&schemaOnly, "schema", false, "only apply schema migrations to the source")
+	flag.BoolVar(&dryRun, "dry-run", false, "with -schema, only report pending schema migrations")
+	flag.Parse()
+	to.BackupDir = from.BackupDir
+	if dryRun && !schemaOnly {
+		log.Fatal("-dry-run only works with -schema, copying has no dry-run mode")
+	}
+
+	if from.Path == "" {
+		from.Path = db.DefaultPath(from.Backend)
+	}
+	if to.Path == "" {
+		to.Path = db.DefaultPath(to.Backend)
+	}
+	if schemaOnly {
+		migrateSchema(from, dryRun)
+		return
+	}
+	if from == to {
+		log.Fatalw("Source and destination are the same", "backend", from.Backend, "path", from.Path)
+	}
+
+	source, err := db.OpenStorage(from)
+	if err != nil {
+		log.Fatalw("Failed to open source", "backend", from.Backend, "path", from.Path, "err", err)
+	}
+	snapshot, err := db.TakeSnapshot(source)
+	source.Close()
+	if err != nil {
+		log.Fatalw("Failed to read source", "err", err)
+	}
+	previous, err := db.RestoreSnapshot(to, snapshot)
+	if err != nil {
+		log.Fatalw("Migration failed", "err", err)
+	}
+	log.Infow("Migration done", "copied", snapshot.Counts, "from", from, "to", to, "previous", previous)
+}
+
+// migrateSchema applies pending schema migrations, or only reports them in dry-run mode.
+func migrateSchema(cfg db.Config, dryRun bool) {
+	if dryRun {
+		reports, err := db.PlanMigrations(cfg)
+		if err != nil {
+			log.Fatalw("Failed to plan migrations", "err", err)
+		}
+		if len(reports) == 0 {
+			log.Info("Schema is up to date")
+		}
+		return
+	}
+	// opening the storage applies all pending migrations
+	storage, err := db.OpenStorage(cfg)
+	if err != nil {
+		log.Fatalw("Failed to migrate schema", "err", err)
+	}
+	storage.Close()
+	log.Info("Schema is up to date")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+var csvHeader = []string{
+	"id", "chat_id", "location", "action", "people_count", "track_before", "created_at", "updated_at",
+	"last_notified_at",
+}
+
+func writeSubscriptions(w io.Writer, format string, subscriptions []domain.Subscription) error {
+	switch format {
+	case formatTable:
+		return writeTable(w, subscriptions)
+	case formatJSON:
+		if subscriptions == nil {
+			subscriptions = []domain.Subscription{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(subscriptions)
+	case formatCSV:
+		return writeCSV(w, subscriptions)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func readSubscriptions(r io.Reader, format string) ([]domain.Subscription, error) {
+	switch format {
+	case formatJSON:
+		var subscriptions []domain.Subscription
+		err := json.NewDecoder(r).Decode(&subscriptions)
+		return subscriptions, err
+	case formatCSV:
+		return readCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func writeTable(w io.Writer, subscriptions []domain.Subscription) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCHAT\tLOCATION\tACTION\tPERSONS\tBEFORE\tCREATED\tLAST NOTIFIED")
+	for _, s := range subscriptions {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			s.ID,
+			s.ChatID,
+			s.Location,
+			s.Action,
+			s.PeopleCount,
+			formatDate(s.TrackBefore),
+			formatTime(s.CreatedAt),
+			formatTime(s.LastNotifiedAt),
+		)
+	}
+	fmt.Fprintf(tw, "\t\t\t\t\t\t\ttotal: %d\n", len(subscriptions))
+	return tw.Flush()
+}
+
+func writeCounts(w io.Writer, by string, counts map[string]int, total int) error {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tCOUNT\n", by)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%s\t%d\n", key, counts[key])
+	}
+	fmt.Fprintf(tw, "total\t%d\n", total)
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, subscriptions []domain.Subscription) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, s := range subscriptions {
+		err := cw.Write([]string{
+			string(s.ID),
+			strconv.FormatInt(int64(s.ChatID), 10),
+			s.Location,
+			s.Action,
+			strconv.Itoa(s.PeopleCount),
+			formatDate(s.TrackBefore),
+			formatCSVTime(s.CreatedAt),
+			formatCSVTime(s.UpdatedAt),
+			formatCSVTime(s.LastNotifiedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readCSV(r io.Reader) ([]domain.Subscription, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	subscriptions := make([]domain.Subscription, 0, len(records)-1)
+	for i, record := range records[1:] { // skip header
+		subscription, err := parseCSVRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func parseCSVRecord(record []string) (domain.Subscription, error) {
+	subscription := domain.Subscription{
+		ID:       domain.SubscriptionID(record[0]),
+		Location: record[2],
+		Action:   record[3],
+	}
+	chatID, err := strconv.ParseInt(record[1], 10, 64)
+	if err != nil {
+		return subscription, err
+	}
+	subscription.ChatID = domain.ChatID(chatID)
+	if subscription.PeopleCount, err = strconv.Atoi(record[4]); err != nil {
+		return subscription, err
+	}
+	if record[5] != "" {
+		if subscription.TrackBefore, err = domain.ParseWindowDate(record[5]); err != nil {
+			return subscription, err
+		}
+	}
+	for i, field := range []*time.Time{&subscription.CreatedAt, &subscription.UpdatedAt, &subscription.LastNotifiedAt} {
+		if record[6+i] == "" {
+			continue
+		}
+		if *field, err = time.Parse(time.RFC3339Nano, record[6+i]); err != nil {
+			return subscription, err
+		}
+	}
+	return subscription, nil
+}
+
+func formatDate(date domain.Date) string {
+	if (date == domain.Date{}) {
+		return ""
+	}
+	return date.String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatCSVTime keeps nanoseconds, so that an export and an import leave times as they were.
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/silh/trakind/pkg/loggers"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var log = loggers.Logger()
+
+const usage = `trakind-admin inspects and edits the subscriptions database while the bot is stopped.
+
+Usage:
+	trakind-admin <command> [flags]
+
+Commands:
+	list     print subscriptions matching filters
+	count    print number of subscriptions grouped by location, action, persons or chat
+	remove   delete subscriptions by ID or matching filters
+	move     change location or chat of subscriptions by ID or matching filters
+	export   write all subscriptions as JSON or CSV
+	import   read subscriptions as JSON or CSV, subscriptions with known IDs are overwritten
+	snapshot write a snapshot of the storage in the format of scheduled backups
+	restore  replace the storage with a verified snapshot, the current data is kept aside
+
+Run "trakind-admin <command> -h" to see flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	commands := map[string]func(args []string) error{
+		"list":     list,
+		"count":    count,
+		"remove":   remove,
+		"move":     move,
+		"export":   export,
+		"import":   importSubscriptions,
+		"snapshot": snapshot,
+		"restore":  restore,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		log.Fatalw("Command failed", "command", os.Args[1], "err", err)
+	}
+}
+
+// newFlagSet creates flags of a command with flags selecting the storage.
+func newFlagSet(name string) (*flag.FlagSet, *db.Config) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	var cfg db.Config
+	flags.StringVar(&cfg.Backend, "backend", db.BackendNuts, "storage backend: nutsdb or sqlite")
+	flags.StringVar(&cfg.Path, "path", "", "storage path, backend default if empty")
+	flags.StringVar(&cfg.BackupDir, "backup-dir", db.DefaultBackupDir, "where to back up data before migrations")
+	return flags, &cfg
+}
+
+// filter selects subscriptions, zero values match anything.
+type filter struct {
+	id       string
+	chatID   int64
+	location string
+	action   string
+	persons  int
+}
+
+func (f *filter) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.id, "id", "", "subscription ID")
+	flags.Int64Var(&f.chatID, "chat", 0, "chat ID")
+	flags.StringVar(&f.location, "location", "", "location code")
+	flags.StringVar(&f.action, "action", "", "action code")
+	flags.IntVar(&f.persons, "persons", 0, "number of people")
+}
+
+func (f *filter) empty() bool {
+	return *f == filter{}
+}
+
+func (f *filter) matches(subscription domain.Subscription) bool {
+	return (f.id == "" || string(subscription.ID) == f.id) &&
+		(f.chatID == 0 || int64(subscription.ChatID) == f.chatID) &&
+		(f.location == "" || subscription.Location == f.location) &&
+		(f.action == "" || subscription.Action == f.action) &&
+		(f.persons == 0 || subscription.PeopleCount == f.persons)
+}
+
+// find returns subscriptions matching the filter using the narrowest lookup available.
+func (f *filter) find(store db.SubscriptionStore) ([]domain.Subscription, error) {
+	var candidates []domain.Subscription
+	var err error
+	switch {
+	case f.id != "":
+		subscription, err := store.Get(domain.SubscriptionID(f.id))
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		candidates = []domain.Subscription{subscription}
+	case f.chatID != 0:
+		candidates, err = store.GetForChat(domain.ChatID(f.chatID))
+	case f.location != "":
+		candidates, err = store.GetForLocation(f.location)
+	default:
+		candidates, err = db.AllSubscriptions(store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []domain.Subscription
+	for _, subscription := range candidates {
+		if f.matches(subscription) {
+			result = append(result, subscription)
+		}
+	}
+	sortSubscriptions(result)
+	return result, nil
+}
+
+// withStorage opens the storage, runs fn and closes the storage.
+func withStorage(cfg *db.Config, fn func(storage *db.Storage) error) error {
+	if cfg.Backend == db.BackendMemory {
+		return errors.New("in-memory storage can't be inspected offline")
+	}
+	storage, err := db.OpenStorage(*cfg)
+	if err != nil {
+		return err
+	}
+	err = fn(storage)
+	if closeErr := storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countSubscriptions updates the number of subscriptions kept in user records of the chats.
+func countSubscriptions(storage *db.Storage, chats map[domain.ChatID]struct{}) error {
+	for chatID := range chats {
+		if err := db.CountSubscriptions(storage.Subscriptions, storage.Users, chatID); err != nil {
+			return fmt.Errorf("failed to count subscriptions of chat %d: %w", chatID, err)
+		}
+	}
+	return nil
+}
+
+func list(args []string) error {
+	flags, cfg := newFlagSet("list")
+	var f filter
+	f.register(flags)
+	format := flags.String("format", formatTable, "output format: table, json or csv")
+	flags.Parse(args)
+	return withStorage(cfg, func(storage *db.Storage) error {
+		subscriptions, err := f.find(storage.Subscriptions)
+		if err != nil {
+			return err
+		}
+		return writeSubscriptions(os.Stdout, *format, subscriptions)
+	})
+}
+
+func count(args []string) error {
+	flags, cfg := newFlagSet("count")
+	var f filter
+	f.register(flags)
+	by := flags.String("by", "location", "group by: location, action, persons or chat")
+	flags.Parse(args)
+	key, ok := map[string]func(domain.Subscription) string{
+		"location": func(s domain.Subscription) string { return s.Location },
+		"action":   func(s domain.Subscription) string { return s.Action },
+		"persons":  func(s domain.Subscription) string { return strconv.Itoa(s.PeopleCount) },
+		"chat":     func(s domain.Subscription) string { return strconv.FormatInt(int64(s.ChatID), 10) },
+	}[*by]
+	if !ok {
+		return fmt.Errorf("can't group by %q", *by)
+	}
+	return withStorage(cfg, func(storage *db.Storage) error {
+		subscriptions, err := f.find(storage.Subscriptions)
+		if err != nil {
+			return err
+		}
+		counts := map[string]int{}
+		for _, subscription := range subscriptions {
+			counts[key(subscription)]++
+		}
+		return writeCounts(os.Stdout, *by, counts, len(subscriptions))
+	})
+}
+
+func remove(args []string) error {
+	flags, cfg := newFlagSet("remove")
+	var f filter
+	f.register(flags)
+	flags.Parse(args)
+	if f.empty() {
+		return errors.New("at least one filter is required, refusing to remove everything")
+	}
+	return withStorage(cfg, func(storage *db.Storage) error {
+		subscriptions, err := f.find(storage.Subscriptions)
+		if err != nil {
+			return err
+		}
+		chats := map[domain.ChatID]struct{}{}
+		for _, subscription := range subscriptions {
+			if err := storage.Subscriptions.Remove(subscription.ID); err != nil {
+				return err
+			}
+			chats[subscription.ChatID] = struct{}{}
+		}
+		if err := countSubscriptions(storage, chats); err != nil {
+			return err
+		}
+		log.Infow("Removed subscriptions", "count", len(subscriptions))
+		return writeSubscriptions(os.Stdout, formatTable, subscriptions)
+	})
+}
+
+func move(args []string) error {
+	flags, cfg := newFlagSet("move")
+	var f filter
+	f.register(flags)
+	toLocation := flags.String("to-location", "", "new location code")
+	toChat := flags.Int64("to-chat", 0, "new chat ID")
+	flags.Parse(args)
+	if f.empty() {
+		return errors.New("at least one filter is required")
+	}
+	if *toLocation == "" && *toChat == 0 {
+		return errors.New("-to-location or -to-chat is required")
+	}
+	if _, ok := db.LocationForCode(*toLocation); *toLocation != "" && !ok {
+		return fmt.Errorf("unknown location %q", *toLocation)
+	}
+	return withStorage(cfg, func(storage *db.Storage) error {
+		subscriptions, err := f.find(storage.Subscriptions)
+		if err != nil {
+			return err
+		}
+		chats := map[domain.ChatID]struct{}{}
+		for i := range subscriptions {
+			chats[subscriptions[i].ChatID] = struct{}{}
+			if *toLocation != "" {
+				subscriptions[i].Location = *toLocation
+			}
+			if *toChat != 0 {
+				subscriptions[i].ChatID = domain.ChatID(*toChat)
+			}
+			if err := validateSubscription(subscriptions[i]); err != nil {
+				return fmt.Errorf("subscription %s can't be moved: %w", subscriptions[i].ID, err)
+			}
+		}
+		for i := range subscriptions {
+			if err := storage.Subscriptions.Update(subscriptions[i]); err != nil {
+				return err
+			}
+			chats[subscriptions[i].ChatID] = struct{}{}
+		}
+		if err := countSubscriptions(storage, chats); err != nil {
+			return err
+		}
+		log.Infow("Moved subscriptions", "count", len(subscriptions))
+		return writeSubscriptions(os.Stdout, formatTable, subscriptions)
+	})
+}
+
+func export(args []string) error {
+	flags, cfg := newFlagSet("export")
+	format := flags.String("format", formatJSON, "output format: json or csv")
+	out := flags.String("out", "", "output file, stdout if empty")
+	flags.Parse(args)
+	return withStorage(cfg, func(storage *db.Storage) error {
+		subscriptions, err := db.AllSubscriptions(storage.Subscriptions)
+		if err != nil {
+			return err
+		}
+		sortSubscriptions(subscriptions)
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			file, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		if err := writeSubscriptions(w, *format, subscriptions); err != nil {
+			return err
+		}
+		log.Infow("Exported subscriptions", "count", len(subscriptions))
+		return nil
+	})
+}
+
+func importSubscriptions(args []string) error {
+	flags, cfg := newFlagSet("import")
+	format := flags.String("format", formatJSON, "input format: json or csv")
+	in := flags.String("in", "", "input file, stdin if empty")
+	flags.Parse(args)
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	subscriptions, err := readSubscriptions(r, *format)
+	if err != nil {
+		return err
+	}
+	for i, subscription := range subscriptions {
+		if err := validateSubscription(subscription); err != nil {
+			return fmt.Errorf("subscription %d: %w", i+1, err)
+		}
+	}
+	return withStorage(cfg, func(storage *db.Storage) error {
+		chats := map[domain.ChatID]struct{}{}
+		for _, subscription := range subscriptions {
+			if subscription.ID != "" {
+				// an overwritten subscription may have belonged to another chat
+				previous, err := storage.Subscriptions.Get(subscription.ID)
+				if err == nil {
+					chats[previous.ChatID] = struct{}{}
+				} else if !errors.Is(err, db.ErrNotFound) {
+					return err
+				}
+			}
+			if _, err := storage.Subscriptions.Add(subscription); err != nil {
+				return err
+			}
+			chats[subscription.ChatID] = struct{}{}
+		}
+		if err := countSubscriptions(storage, chats); err != nil {
+			return err
+		}
+		log.Infow("Imported subscriptions", "count", len(subscriptions))
+		return nil
+	})
+}
+
+func snapshot(args []string) error {
+	flags, cfg := newFlagSet("snapshot")
+	out := flags.String("out", "", "output file, required")
+	flags.Parse(args)
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	return withStorage(cfg, func(storage *db.Storage) error {
+		snapshot, err := db.TakeSnapshot(storage)
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := db.WriteSnapshot(file, snapshot); err != nil {
+			return err
+		}
+		log.Infow("Snapshot written", "path", *out, "counts", snapshot.Counts)
+		return nil
+	})
+}
+
+func restore(args []string) error {
+	flags, cfg := newFlagSet("restore")
+	in := flags.String("in", "", "snapshot file, required")
+	check := flags.Bool("check", false, "only verify the snapshot, don't change the storage")
+	flags.Parse(args)
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	snapshot, err := db.ReadSnapshot(file)
+	if err != nil {
+		return fmt.Errorf("snapshot is broken: %w", err)
+	}
+	log.Infow("Snapshot verified", "path", *in, "created", snapshot.CreatedAt, "counts", snapshot.Counts)
+	if *check {
+		return nil
+	}
+	previous, err := db.RestoreSnapshot(*cfg, snapshot)
+	if err != nil {
+		return err
+	}
+	log.Infow("Snapshot restored", "counts", snapshot.Counts, "previous", previous)
+	return nil
+}
+
+// validateSubscription checks that fetchers poll the group of the subscription, i.e. the location is known and
+// offers the action, and the number of people is allowed.
+func validateSubscription(subscription domain.Subscription) error {
+	if subscription.ChatID == 0 {
+		return errors.New("chat is missing")
+	}
+	location, ok := db.LocationForCode(subscription.Location)
+	if !ok {
+		return fmt.Errorf("unknown location %q", subscription.Location)
+	}
+	action, ok := db.ActionForCode(subscription.Action)
+	if !ok {
+		return fmt.Errorf("unknown action %q", subscription.Action)
+	}
+	if _, offered := location.AvailableActions[action]; !offered {
+		return fmt.Errorf("location %s doesn't offer %s", location.Code, action.Code)
+	}
+	if subscription.PeopleCount < 1 || subscription.PeopleCount > domain.MaxPeopleCount {
+		return fmt.Errorf("persons must be from 1 to %d, got %d", domain.MaxPeopleCount, subscription.PeopleCount)
+	}
+	return nil
+}
+
+// sortSubscriptions orders subscriptions by location, action, persons, chat and creation time for stable output.
+func sortSubscriptions(subscriptions []domain.Subscription) {
+	sort.Slice(subscriptions, func(i, j int) bool {
+		a, b := subscriptions[i], subscriptions[j]
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		if a.PeopleCount != b.PeopleCount {
+			return a.PeopleCount < b.PeopleCount
+		}
+		if a.ChatID != b.ChatID {
+			return a.ChatID < b.ChatID
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
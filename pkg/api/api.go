@@ -0,0 +1,96 @@
+// Package api serves the HTTP JSON API that lets other tools manage subscriptions of a chat. Requests are
+// authenticated with tokens that chats get from the bot with /token.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/silh/trakind/pkg/loggers"
+	"net/http"
+	"strings"
+)
+
+var log = loggers.Logger()
+
+// Prefix is the path all API endpoints are under.
+const Prefix = "/api/v1/"
+
+// maxBodySize limits request bodies, the API never needs much.
+const maxBodySize = 64 << 10
+
+// Handler returns the handler of all API endpoints, it should be mounted at Prefix.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(Prefix+"locations", authenticated(listLocations))
+	mux.Handle(Prefix+"actions", authenticated(listActions))
+	mux.Handle(Prefix+"availability", authenticated(listAvailability))
+	mux.Handle(Prefix+"subscriptions", authenticated(subscriptions))
+	mux.Handle(Prefix+"subscriptions/", authenticated(subscription))
+	mux.HandleFunc(Prefix, func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	})
+	return mux
+}
+
+// authenticatedHandler handles a request of the chat the token of the request belongs to.
+type authenticatedHandler func(w http.ResponseWriter, r *http.Request, chatID domain.ChatID)
+
+// authenticated rejects requests without a valid bearer token.
+func authenticated(next authenticatedHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "bearer token is required, get one from the bot with /token")
+			return
+		}
+		stored, err := db.APITokens.Get(bots.HashAPIToken(token))
+		if errors.Is(err, db.ErrNotFound) {
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			writeError(w, http.StatusUnauthorized, "invalid or revoked token")
+			return
+		}
+		if err != nil {
+			log.Errorw("Failed to get API token", "err", err)
+			writeError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next(w, r, stored.ChatID)
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// allowMethods writes 405 and returns false if the method of the request is not one of the methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnw("Failed to write API response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type actionJSON struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+type locationJSON struct {
+	Code    string       `json:"code"`
+	Name    string       `json:"name"`
+	Actions []actionJSON `json:"actions"`
+}
+
+type availabilityJSON struct {
+	Location     string              `json:"location"`
+	LocationName string              `json:"locationName"`
+	Action       string              `json:"action"`
+	ActionName   string              `json:"actionName"`
+	Persons      int                 `json:"persons"`
+	CheckedAt    time.Time           `json:"checkedAt"`
+	Windows      []domain.TimeWindow `json:"windows"`
+}
+
+// listLocations returns all locations with the actions they offer.
+func listLocations(w http.ResponseWriter, r *http.Request, _ domain.ChatID) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	result := make([]locationJSON, 0, len(db.Locations))
+	for _, location := range db.Locations {
+		actions := []actionJSON{}
+		for _, action := range db.SortedActions() {
+			if _, ok := location.AvailableActions[action]; ok {
+				actions = append(actions, actionJSON{Code: action.Code, Name: action.Name})
+			}
+		}
+		result = append(result, locationJSON{Code: location.Code, Name: location.Name, Actions: actions})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// listActions returns all types of appointments.
+func listActions(w http.ResponseWriter, r *http.Request, _ domain.ChatID) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	result := []actionJSON{}
+	for _, action := range db.SortedActions() {
+		result = append(result, actionJSON{Code: action.Code, Name: action.Name})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// listAvailability returns windows found by the latest fetches, optionally filtered by location, action and
+// persons query parameters. Only locations that are polled, i.e. have subscribers or channels, are known.
+func listAvailability(w http.ResponseWriter, r *http.Request, _ domain.ChatID) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	var persons int
+	if value := query.Get("persons"); value != "" {
+		var err error
+		if persons, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, "persons must be a number")
+			return
+		}
+	}
+	result := []availabilityJSON{}
+	for _, availability := range bots.LatestAvailability() {
+		group := availability.Group
+		if location := query.Get("location"); location != "" && location != group.Location {
+			continue
+		}
+		if action := query.Get("action"); action != "" && action != group.Action {
+			continue
+		}
+		if persons != 0 && persons != group.PeopleCount {
+			continue
+		}
+		location, _ := db.LocationForCode(group.Location)
+		action, _ := db.ActionForCode(group.Action)
+		windows := availability.Windows
+		if windows == nil {
+			windows = []domain.TimeWindow{}
+		}
+		result = append(result, availabilityJSON{
+			Location:     group.Location,
+			LocationName: location.Name,
+			Action:       group.Action,
+			ActionName:   action.Name,
+			Persons:      group.PeopleCount,
+			CheckedAt:    availability.CheckedAt,
+			Windows:      windows,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// subscriptionRequest creates a subscription or replaces its parameters.
+type subscriptionRequest struct {
+	Location string `json:"location"`
+	Action   string `json:"action"`
+	Persons  int    `json:"persons"`
+	// TrackBefore is a date in YYYY-MM-DD format, windows of all dates are tracked if it's empty.
+	TrackBefore string `json:"trackBefore"`
+}
+
+type subscriptionJSON struct {
+	ID          domain.SubscriptionID `json:"id"`
+	Location    string                `json:"location"`
+	Action      string                `json:"action"`
+	Persons     int                   `json:"persons"`
+	TrackBefore string                `json:"trackBefore,omitempty"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	UpdatedAt   time.Time             `json:"updatedAt"`
+}
+
+func toJSON(subscription domain.Subscription) subscriptionJSON {
+	result := subscriptionJSON{
+		ID:        subscription.ID,
+		Location:  subscription.Location,
+		Action:    subscription.Action,
+		Persons:   subscription.PeopleCount,
+		CreatedAt: subscription.CreatedAt,
+		UpdatedAt: subscription.UpdatedAt,
+	}
+	if (subscription.TrackBefore != domain.Date{}) {
+		result.TrackBefore = subscription.TrackBefore.String()
+	}
+	return result
+}
+
+// subscriptions lists subscriptions of the chat or creates a new one.
+func subscriptions(w http.ResponseWriter, r *http.Request, chatID domain.ChatID) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		stored, err := db.Subscriptions.GetForChat(chatID)
+		if err != nil {
+			internalError(w, "Failed to get subscriptions", chatID, err)
+			return
+		}
+		result := make([]subscriptionJSON, 0, len(stored))
+		for _, subscription := range stored {
+			result = append(result, toJSON(subscription))
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	subscription, ok := decodeSubscription(w, r)
+	if !ok {
+		return
+	}
+	subscription.ChatID = chatID
+	subscription, err := db.Subscriptions.Add(subscription)
+	if err != nil {
+		internalError(w, "Failed to store subscription", chatID, err)
+		return
+	}
+	db.UpdateSubscriptionCount(chatID)
+	log.Infow("Subscription created over API", "chat", chatID, "subscription", subscription.ID)
+	writeJSON(w, http.StatusCreated, toJSON(subscription))
+}
+
+// subscription returns, replaces or deletes one subscription of the chat.
+func subscription(w http.ResponseWriter, r *http.Request, chatID domain.ChatID) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	id := domain.SubscriptionID(strings.TrimPrefix(r.URL.Path, Prefix+"subscriptions/"))
+	stored, err := db.Subscriptions.Get(id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && stored.ChatID != chatID) {
+		writeError(w, http.StatusNotFound, "no such subscription")
+		return
+	}
+	if err != nil {
+		internalError(w, "Failed to get subscription", chatID, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, toJSON(stored))
+	case http.MethodPut:
+		changed, ok := decodeSubscription(w, r)
+		if !ok {
+			return
+		}
+		stored.Location, stored.Action = changed.Location, changed.Action
+		stored.PeopleCount, stored.TrackBefore = changed.PeopleCount, changed.TrackBefore
+		if err := db.Subscriptions.Update(stored); err != nil {
+			internalError(w, "Failed to update subscription", chatID, err)
+			return
+		}
+		updated, err := db.Subscriptions.Get(id)
+		if err != nil {
+			internalError(w, "Failed to get subscription", chatID, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toJSON(updated))
+	case http.MethodDelete:
+		if err := db.Subscriptions.Remove(id); err != nil {
+			internalError(w, "Failed to delete subscription", chatID, err)
+			return
+		}
+		db.UpdateSubscriptionCount(chatID)
+		log.Infow("Subscription deleted over API", "chat", chatID, "subscription", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeSubscription reads and validates subscriptionRequest, writing 400 if it's invalid.
+func decodeSubscription(w http.ResponseWriter, r *http.Request) (domain.Subscription, bool) {
+	var request subscriptionRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return domain.Subscription{}, false
+	}
+	subscription, err := request.toSubscription()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return domain.Subscription{}, false
+	}
+	return subscription, true
+}
+
+func (r subscriptionRequest) toSubscription() (domain.Subscription, error) {
+	location, ok := db.LocationForCode(r.Location)
+	if !ok {
+		return domain.Subscription{}, fmt.Errorf("unknown location %q", r.Location)
+	}
+	action, ok := db.ActionForCode(r.Action)
+	if !ok {
+		return domain.Subscription{}, fmt.Errorf("unknown action %q", r.Action)
+	}
+	if _, offered := location.AvailableActions[action]; !offered {
+		return domain.Subscription{}, fmt.Errorf("location %s doesn't offer %s", location.Name, action.Name)
+	}
+	if r.Persons < 1 || r.Persons > domain.MaxPeopleCount {
+		return domain.Subscription{}, fmt.Errorf("persons must be from 1 to %d", domain.MaxPeopleCount)
+	}
+	subscription := domain.Subscription{Location: location.Code, Action: action.Code, PeopleCount: r.Persons}
+	if r.TrackBefore != "" {
+		date, err := domain.ParseWindowDate(r.TrackBefore)
+		if err != nil {
+			return domain.Subscription{}, fmt.Errorf("trackBefore must be a date in YYYY-MM-DD format")
+		}
+		subscription.TrackBefore = date
+	}
+	return subscription, nil
+}
+
+func internalError(w http.ResponseWriter, problem string, chatID domain.ChatID, err error) {
+	log.Errorw(problem, "chat", chatID, "err", err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
@@ -0,0 +1,303 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/silh/trakind/pkg/loggers"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminUsage = `Admin commands:
+/admin stats - subscriptions, active users and fetch health
+/admin chat <chat ID> - user record and subscriptions of a chat
+/admin remove <chat ID> - remove all subscriptions of a chat
+/admin pause <location code or name> - stop polling a location until resumed or restarted
+/admin resume <location code or name> - resume polling a location
+/admin loglevel <debug|info|warn|error> - change log level
+/admin broadcast all - send an announcement to all chats
+/admin broadcast location <location code or name> - send an announcement to chats subscribed to a location
+/admin broadcast action <action code or name> - send an announcement to chats subscribed to an action
+/admin broadcasts - progress of the latest broadcasts`
+
+// AdminCommandState handles operator commands. It's only available to chats configured as admins, everyone else
+// gets the same reply as for an unknown command.
+type AdminCommandState struct {
+}
+
+func (s AdminCommandState) String() string {
+	return "AdminCommandState"
+}
+
+func (s AdminCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	if !bot.IsAdmin(fsm.chatID) {
+		fsm.log.Warnw("Admin command from non-admin", "text", msg.Text)
+		reply := newMessage(
+			fsm.chatID,
+			fmt.Sprintf("No such command %q, please select one of the available commands", msg.Command()),
+		)
+		bot.SendAndForget(reply, fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		bot.SendAndForget(newMessage(fsm.chatID, adminUsage), fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	fsm.log.Infow("Admin command", "args", args)
+	if args[0] == "broadcast" {
+		audience, err := parseAudience(args[1:])
+		if err != nil {
+			bot.SendAndForget(newMessage(fsm.chatID, "Failed: "+err.Error()), fsm.log)
+			fsm.To(doneState, msg)
+			return
+		}
+		fsm.To(&BroadcastTextState{audience: audience}, msg)
+		return
+	}
+	var text string
+	var err error
+	switch args[0] {
+	case "stats":
+		text = adminStats(bot)
+	case "chat":
+		text, err = adminInspectChat(args[1:])
+	case "remove":
+		text, err = adminRemoveChat(args[1:])
+	case "pause":
+		text, err = adminSetPaused(args[1:], true)
+	case "resume":
+		text, err = adminSetPaused(args[1:], false)
+	case "loglevel":
+		text, err = adminSetLogLevel(args[1:])
+	case "broadcasts":
+		text, err = adminBroadcasts()
+	default:
+		text = adminUsage
+	}
+	if err != nil {
+		text = "Failed: " + err.Error()
+	}
+	bot.SendAndForget(newMessage(fsm.chatID, text), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s AdminCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+func adminStats(bot *Bot) string {
+	subscriptions := db.Subscriptions.All()
+	byLocation := map[string]int{}
+	byAction := map[string]int{}
+	byPersons := map[string]int{}
+	for _, subscription := range subscriptions {
+		byLocation[locationName(subscription.Location)]++
+		byAction[subscription.Action]++
+		byPersons[strconv.Itoa(subscription.PeopleCount)]++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Subscriptions: %d\n", len(subscriptions))
+	if users, err := db.Users.All(); err != nil {
+		fmt.Fprintf(&b, "Users: failed to load: %s\n", err)
+	} else {
+		counts := db.CountUsers(users, time.Now())
+		fmt.Fprintf(&b, "Users: %d, with subscriptions: %d, blocked: %d\n", counts.Total, counts.Subscribed, counts.Blocked)
+		fmt.Fprintf(&b, "Active users: %d today, %d this week, %d this month\n",
+			counts.ActiveDay, counts.ActiveWeek, counts.ActiveMonth)
+	}
+	writeCounts(&b, "By location", byLocation)
+	writeCounts(&b, "By action", byAction)
+	writeCounts(&b, "By persons", byPersons)
+	b.WriteString("\nFetch health:\n")
+	now := time.Now()
+	for _, location := range db.Locations {
+		health := polling.Health(location.Code)
+		fmt.Fprintf(&b, "%s: ", location.Name)
+		switch {
+		case health.Paused:
+			b.WriteString("paused")
+		case health.LastSuccess.IsZero() && health.LastFailure.IsZero():
+			b.WriteString("not fetched yet")
+		case health.LastSuccess.IsZero():
+			b.WriteString("never succeeded")
+		default:
+			fmt.Fprintf(&b, "ok %s ago", now.Sub(health.LastSuccess).Round(time.Second))
+		}
+		if health.ConsecutiveFailures > 0 {
+			fmt.Fprintf(&b, ", %d failures in a row, last: %s", health.ConsecutiveFailures, health.LastError)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\nQueued messages: %d\nLog level: %s", bot.outbox.Len(), loggers.Level())
+	return b.String()
+}
+
+func writeCounts(b *strings.Builder, title string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(b, "\n%s:\n", title)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s: %d\n", key, counts[key])
+	}
+}
+
+func adminInspectChat(args []string) (string, error) {
+	chatID, err := parseChatID(args)
+	if err != nil {
+		return "", err
+	}
+	subscriptions, err := db.Subscriptions.GetForChat(chatID)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	user, err := db.Users.Get(chatID)
+	switch {
+	case err == nil:
+		fmt.Fprintf(&b, "First seen %s, last active %s", user.FirstSeen.UTC().Format(time.RFC3339),
+			user.LastActive.UTC().Format(time.RFC3339))
+		if user.Language != "" {
+			fmt.Fprintf(&b, ", language %s", user.Language)
+		}
+		if user.Email != "" {
+			fmt.Fprintf(&b, ", email %s", user.Email)
+		}
+		if user.Blocked {
+			b.WriteString(", blocked the bot")
+		}
+		b.WriteString("\n")
+	case !errors.Is(err, db.ErrNotFound):
+		return "", err
+	}
+	if len(subscriptions) == 0 {
+		fmt.Fprintf(&b, "Chat %d has no subscriptions", chatID)
+		return b.String(), nil
+	}
+	fmt.Fprintf(&b, "Chat %d has %d subscriptions:\n", chatID, len(subscriptions))
+	for _, subscription := range subscriptions {
+		fmt.Fprintf(&b, "%s: %s, %s, %d persons", subscription.ID, locationName(subscription.Location),
+			subscription.Action, subscription.PeopleCount)
+		if (subscription.TrackBefore != domain.Date{}) {
+			fmt.Fprintf(&b, ", before %s", &subscription.TrackBefore)
+		}
+		if !subscription.LastNotifiedAt.IsZero() {
+			fmt.Fprintf(&b, ", notified %s", subscription.LastNotifiedAt.UTC().Format(time.RFC3339))
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+func adminRemoveChat(args []string) (string, error) {
+	chatID, err := parseChatID(args)
+	if err != nil {
+		return "", err
+	}
+	removed, err := db.Subscriptions.RemoveForChat(chatID)
+	if err != nil {
+		return "", err
+	}
+	db.UpdateSubscriptionCount(chatID)
+	log.Infow("Subscriptions removed by admin", "chat", chatID, "count", len(removed))
+	return fmt.Sprintf("Removed %d subscriptions of chat %d", len(removed), chatID), nil
+}
+
+func adminSetPaused(args []string, paused bool) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("location is required")
+	}
+	location, ok := db.LocationForCode(args[0])
+	if !ok {
+		location, ok = db.LocationForName(strings.Join(args, " "))
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown location %q", strings.Join(args, " "))
+	}
+	if paused {
+		polling.Pause(location.Code)
+		log.Infow("Polling paused", "location", location.Code)
+		// pauses aren't stored, say so, or a restart would silently resume polling
+		return fmt.Sprintf("Polling of %s is paused until /admin resume or the next restart of the bot",
+			location.Name), nil
+	}
+	polling.Resume(location.Code)
+	log.Infow("Polling resumed", "location", location.Code)
+	return fmt.Sprintf("Polling of %s is resumed", location.Name), nil
+}
+
+func adminSetLogLevel(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("log level is required")
+	}
+	if err := loggers.SetLevel(args[0]); err != nil {
+		return "", err
+	}
+	log.Infow("Log level changed", "level", loggers.Level())
+	return fmt.Sprintf("Log level is %s", loggers.Level()), nil
+}
+
+// adminBroadcasts describes progress of the latest broadcasts.
+func adminBroadcasts() (string, error) {
+	const shown = 5
+	broadcasts, err := db.Broadcasts.All()
+	if err != nil {
+		return "", err
+	}
+	if len(broadcasts) == 0 {
+		return "There were no broadcasts", nil
+	}
+	if len(broadcasts) > shown {
+		broadcasts = broadcasts[len(broadcasts)-shown:]
+	}
+	var b strings.Builder
+	for i := len(broadcasts) - 1; i >= 0; i-- {
+		broadcast := broadcasts[i]
+		fmt.Fprintf(&b, "%s from %s: %d/%d processed, %d failed",
+			broadcast.ID, broadcast.CreatedAt.UTC().Format(time.RFC3339), broadcast.Sent, len(broadcast.Recipients),
+			broadcast.Failed)
+		if broadcast.Finished() {
+			b.WriteString(", finished")
+		}
+		fmt.Fprintf(&b, "\n%q\n\n", truncate(broadcast.Text, 50))
+	}
+	return b.String(), nil
+}
+
+// truncate shortens text to at most limit runes.
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+func parseChatID(args []string) (domain.ChatID, error) {
+	if len(args) != 1 {
+		return 0, errors.New("chat ID is required")
+	}
+	chatID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chat ID %q", args[0])
+	}
+	return domain.ChatID(chatID), nil
+}
+
+// locationName returns name of the location with the code or the code itself if the location is unknown.
+func locationName(code string) string {
+	if location, ok := db.LocationForCode(code); ok {
+		return location.Name
+	}
+	return code
+}
@@ -0,0 +1,103 @@
+package bots
+
+import (
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+// polledWindows is what the previous poll of a group found.
+type polledWindows struct {
+	keys     map[string]struct{}
+	earliest time.Time
+}
+
+// slotAppearances stores what every poll found compared to the previous poll of the group: a new earliest date and
+// new windows. The first poll of a group after the start is only remembered, everything would look new otherwise.
+type slotAppearances struct {
+	mu        sync.Mutex
+	previous  map[db.SubscriptionGroup]polledWindows
+	lastPrune time.Time
+}
+
+// appearances is shared by all fetchers.
+var appearances = &slotAppearances{previous: map[db.SubscriptionGroup]polledWindows{}}
+
+func (a *slotAppearances) record(group db.SubscriptionGroup, windows []domain.TimeWindow, now time.Time) {
+	current := polledWindows{keys: make(map[string]struct{}, len(windows))}
+	for _, window := range windows {
+		current.keys[WindowKey(window)] = struct{}{}
+	}
+	if len(windows) > 0 {
+		current.earliest = time.Time(windows[0].Date) // windows are ordered by time
+	}
+	a.mu.Lock()
+	previous, polledBefore := a.previous[group]
+	a.previous[group] = current
+	prune := now.Sub(a.lastPrune) >= historyPruneInterval
+	if prune {
+		a.lastPrune = now
+	}
+	a.mu.Unlock()
+	if polledBefore {
+		for _, appearance := range newAppearances(group, previous, current, windows, now) {
+			if err := db.SlotAppearances.Add(appearance); err != nil {
+				log.Warnw("Failed to store slot appearance", "location", group.Location, "err", err)
+			}
+		}
+	}
+	if prune {
+		removed, err := db.SlotAppearances.RemoveBefore(now.Add(-HistoryRetention))
+		if err != nil {
+			log.Warnw("Failed to delete old slot appearances", "err", err)
+		} else if removed > 0 {
+			log.Debugw("Deleted old slot appearances", "count", removed)
+		}
+	}
+}
+
+// forget drops the previous poll of the group when it isn't polled anymore, so that the next poll is only remembered
+// and windows that opened in between aren't recorded as new.
+func (a *slotAppearances) forget(group db.SubscriptionGroup) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.previous, group)
+}
+
+func newAppearances(
+	group db.SubscriptionGroup,
+	previous, current polledWindows,
+	windows []domain.TimeWindow,
+	now time.Time,
+) []domain.SlotAppearance {
+	appearance := domain.SlotAppearance{
+		Location:    group.Location,
+		Action:      group.Action,
+		PeopleCount: group.PeopleCount,
+		FoundAt:     now,
+	}
+	var result []domain.SlotAppearance
+	if !current.earliest.IsZero() && (previous.earliest.IsZero() || current.earliest.Before(previous.earliest)) {
+		earliest := appearance
+		earliest.Kind = domain.EarliestDateAppeared
+		earliest.Date = domain.Date(current.earliest)
+		earliest.PreviousDate = domain.Date(previous.earliest)
+		result = append(result, earliest)
+	}
+	added := appearance
+	added.Kind = domain.WindowsAppeared
+	for _, window := range windows {
+		if _, ok := previous.keys[WindowKey(window)]; ok {
+			continue
+		}
+		if added.Windows == 0 {
+			added.Date = window.Date
+		}
+		added.Windows++
+	}
+	if added.Windows > 0 {
+		result = append(result, added)
+	}
+	return result
+}
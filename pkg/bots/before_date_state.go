@@ -9,9 +9,7 @@ import (
 )
 
 type BeforeDateState struct {
-	action      domain.Action
-	location    domain.Location
-	peopleCount int
+	trackAnswers
 }
 
 func (s *BeforeDateState) String() string {
@@ -24,7 +22,8 @@ func (s *BeforeDateState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
 		"Are you interested in time slots before certain date or all? "+
 			"Please reply with a date in format YYYY-MM-DD or a word \"all\".",
 	)
-	if _, err := bot.API.Send(toSend); err != nil {
+	toSend.ReplyMarkup = s.makeReplyKeyboard()
+	if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 		fsm.To(doneState, msg)
 	}
@@ -35,8 +34,13 @@ func (s *BeforeDateState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 		fsm.To(commandHandlingState, msg)
 		return nil
 	}
+	if msg.Text == backButton {
+		fsm.To(&HowManyPeopleState{s.trackAnswers}, msg)
+		return nil
+	}
 	subscription := domain.Subscription{
 		ChatID:      fsm.chatID,
+		Location:    s.location.Code,
 		PeopleCount: s.peopleCount,
 		Action:      s.action.Code,
 	}
@@ -52,7 +56,8 @@ func (s *BeforeDateState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 					msg.Text,
 				),
 			)
-			if _, err := bot.API.Send(toSend); err != nil {
+			toSend.ReplyMarkup = s.makeReplyKeyboard()
+			if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 				fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 				fsm.To(doneState, msg)
 			}
@@ -60,15 +65,16 @@ func (s *BeforeDateState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 		}
 	}
 	// Actually save subscription
-	if err := db.Subscriptions.AddToLocation(s.location.Code, subscription); err != nil {
+	if subscription, err = db.Subscriptions.Add(subscription); err != nil {
 		fsm.log.Warnw("Failed to store subscription", "subscription", subscription, "err", err)
 		toSend := newMessage(fsm.chatID, "Failed to create subscription. Please try again.")
-		if _, err = bot.API.Send(toSend); err != nil {
+		if _, err = bot.Send(fsm.personal(toSend)); err != nil {
 			fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 		}
 		fsm.To(doneState, msg)
 		return nil
 	}
+	db.UpdateSubscriptionCount(fsm.chatID)
 	s.sendSubscribedNotification(fsm, subscription, bot)
 	fsm.log.Infow("One more follower", "location", s.location.Code)
 	fsm.To(doneState, msg)
@@ -88,7 +94,11 @@ func (s *BeforeDateState) sendSubscribedNotification(fsm *FSM, subscription doma
 	}
 	sb.WriteRune('.')
 	toSend := newMessage(fsm.chatID, sb.String())
-	if _, err := bot.API.Send(toSend); err != nil {
+	if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 	}
 }
+
+func (s *BeforeDateState) makeReplyKeyboard() tg.ReplyKeyboardMarkup {
+	return withBackButton(tg.NewOneTimeReplyKeyboard(tg.NewKeyboardButtonRow(tg.NewKeyboardButton("all"))))
+}
@@ -1,87 +1,173 @@
 package bots
 
 import (
+	"context"
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/silh/trakind/pkg/domain"
 	"github.com/silh/trakind/pkg/loggers"
 	"go.uber.org/zap"
+	"sync"
 )
 
 var log = loggers.Logger()
 
-var chatFSMs = map[domain.ChatID]*FSM{}
-
-// SubscribersDB TODO not used, should be moved
-type SubscribersDB interface {
-	AddToLocation(location string, subscription domain.Subscription) error
-	RemoveFromLocation(location string, subscription domain.Subscription) error
-	GetForLocation(location string) ([]domain.Subscription, error)
-}
+// maxSendAttempts limits attempts to send a reply that Telegram asks to retry later.
+const maxSendAttempts = 3
 
 type Bot struct {
-	API *tg.BotAPI // FIXME should not expose that
+	API         *tg.BotAPI // FIXME should not expose that
+	admins      map[domain.ChatID]struct{}
+	broadcaster *Broadcaster
+	limiter     *rateLimiter
+	outbox      *Outbox
+	publisher   *publisher
+	notifiers   []Notifier
+	webhooks    *eventWebhooks
+	// email sends notifications and verification codes by email, nil if email isn't configured.
+	email *EmailNotifier
+	// calendar serves iCalendar feeds of subscriptions, nil if they aren't configured.
+	calendar *CalendarConfig
+
+	mu      sync.Mutex
+	stop    func()
+	stopped bool
 }
 
-func New(apiKey string) (*Bot, error) {
+// New creates a bot, chats from admins can use admin commands.
+func New(apiKey string, admins []domain.ChatID) (*Bot, error) {
 	api, err := tg.NewBotAPI(apiKey)
 	if err != nil {
 		return nil, err
 	}
-	return &Bot{
-		API: api,
-	}, nil
+	adminsSet := make(map[domain.ChatID]struct{}, len(admins))
+	for _, chatID := range admins {
+		adminsSet[chatID] = struct{}{}
+	}
+	bot := &Bot{
+		API:     api,
+		admins:  adminsSet,
+		limiter: newRateLimiter(),
+	}
+	bot.broadcaster = newBroadcaster(bot)
+	bot.outbox = newOutbox(bot)
+	bot.publisher = newPublisher(bot)
+	bot.notifiers = []Notifier{telegramNotifier{outbox: bot.outbox}}
+	bot.webhooks = newEventWebhooks(bot)
+	return bot, nil
 }
 
-// Run starts main loop receiving and processing updates. Exists only when the updates channel is closed.
+// IsAdmin returns true if the chat is allowed to use admin commands.
+func (b *Bot) IsAdmin(chatID domain.ChatID) bool {
+	_, ok := b.admins[chatID]
+	return ok
+}
+
+// Run starts main loop receiving updates with long polling and processing them. Exists only when Stop is called.
 func (b *Bot) Run() {
 	b.registerCommands()
+	// Telegram doesn't return updates to getUpdates while a webhook is set
+	if _, err := b.API.Request(tg.DeleteWebhookConfig{}); err != nil {
+		log.Warnw("Failed to delete webhook", "err", err)
+	}
 	u := tg.NewUpdate(0)
 	u.Timeout = 5
-	updatesC := b.API.GetUpdatesChan(u)
+	b.setStop(b.API.StopReceivingUpdates)
+	b.handleUpdates(b.API.GetUpdatesChan(u))
+}
+
+// handleUpdates passes updates to FSMs of their chats until the channel is closed. Returns after all received
+// updates are processed.
+func (b *Bot) handleUpdates(updatesC tg.UpdatesChannel) {
+	d := newDispatcher(b, updateWorkers)
 	for update := range updatesC {
-		msg := update.Message
-		// FIXME this is a WA, states should handle update instead of message
-		if update.MyChatMember != nil &&
-			update.MyChatMember.NewChatMember.WasKicked() {
-			chatID := domain.ChatID(update.MyChatMember.Chat.ID)
-			fsm := chatFSMs[chatID]
-			if fsm == nil {
-				fsm = NewFSM(chatID, b)
-				chatFSMs[chatID] = fsm
-			}
-			fsm.To(stopCommandState, nil)
-			continue
-		}
-		if msg == nil {
-			continue
-		}
-		chatID := domain.ChatID(msg.Chat.ID)
-		fsm := chatFSMs[chatID]
-		if fsm == nil {
-			fsm = NewFSM(chatID, b)
-			chatFSMs[chatID] = fsm
-		}
-		fsm.Do(msg)
+		d.dispatch(update)
 	}
+	d.stop()
+}
+
+// RunOutbox delivers queued notifications, including the ones left undelivered before a restart. Blocks until ctx is
+// done and messages that are being sent are finished.
+func (b *Bot) RunOutbox(ctx context.Context) {
+	b.outbox.Run(ctx)
+}
+
+// RunBroadcasts sends announcements of admins, including the ones interrupted by a restart. Blocks until ctx is
+// done.
+func (b *Bot) RunBroadcasts(ctx context.Context) {
+	b.broadcaster.Run(ctx)
+}
+
+// EnableEmail lets chats verify an email address with /email and sends notifications to verified addresses. The
+// notifier must be running to send emails.
+func (b *Bot) EnableEmail(notifier *EmailNotifier) {
+	b.email = notifier
+	b.AddNotifier(notifier)
 }
 
-// Stop closes update channel and lets a goroutine that is in Run func to exit it.
+// Stop closes update channel and lets a goroutine that is in Run or RunWebhook func to exit it.
 func (b *Bot) Stop() {
-	b.API.StopReceivingUpdates()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	if b.stop != nil {
+		b.stop()
+		b.stop = nil
+	}
+}
+
+// setStop sets the function that stops receiving updates. If Stop was already called, the function is called right
+// away.
+func (b *Bot) setStop(stop func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		stop()
+		return
+	}
+	b.stop = stop
 }
 
-// registerCommands registers available bot commands.
+// registerCommands registers available bot commands. Admin commands are only added to the menu of admin chats.
 func (b *Bot) registerCommands() {
-	commands := tg.NewSetMyCommands(
-		tg.BotCommand{
+	publicCommands := []tg.BotCommand{
+		{
 			Command:     "track",
 			Description: "Start tracking new location",
 		},
-		tg.BotCommand{
+		{
 			Command:     "stoptrack",
 			Description: "Stops all tracking",
 		},
-	)
+		{
+			Command:     "cancel",
+			Description: "Cancel the current conversation",
+		},
+		{
+			Command:     "webhook",
+			Description: "Receive events about new slots over HTTP",
+		},
+		{
+			Command:     "token",
+			Description: "Get a token of the HTTP API",
+		},
+		{
+			Command:     "help",
+			Description: "Describe all commands",
+		},
+	}
+	if b.email != nil {
+		publicCommands = append(publicCommands, tg.BotCommand{
+			Command:     "email",
+			Description: "Receive notifications by email too",
+		})
+	}
+	if b.calendar != nil {
+		publicCommands = append(publicCommands, tg.BotCommand{
+			Command:     "calendar",
+			Description: "Get calendar feeds of open slots",
+		})
+	}
+	commands := tg.NewSetMyCommands(publicCommands...)
 	resp, err := b.API.Request(commands)
 	if err != nil {
 		log.Fatalw("Failed to register commands", "err", err)
@@ -90,11 +176,39 @@ func (b *Bot) registerCommands() {
 		log.Fatalw("Failed to register commands", "code", resp.ErrorCode, "desc", resp.Description)
 	}
 	log.Infow("Commands registration successful")
+	adminCommands := append(publicCommands, tg.BotCommand{
+		Command:     "admin",
+		Description: "Operator commands",
+	})
+	for chatID := range b.admins {
+		scoped := tg.NewSetMyCommandsWithScope(tg.NewBotCommandScopeChat(int64(chatID)), adminCommands...)
+		// an admin that has never talked to the bot can't have commands, that shouldn't stop the bot
+		if _, err := b.API.Request(scoped); err != nil {
+			log.Warnw("Failed to register admin commands", "chat", chatID, "err", err)
+		}
+	}
+}
+
+// Send sends the message right away, waiting for rate limits if needed. When Telegram asks to retry later, the
+// message is retried a few times.
+func (b *Bot) Send(msg tg.MessageConfig) (tg.Message, error) {
+	chatID := domain.ChatID(msg.ChatID)
+	for attempt := 1; ; attempt++ {
+		if err := b.limiter.wait(context.Background(), chatID); err != nil {
+			return tg.Message{}, err
+		}
+		sent, err := b.API.Send(msg)
+		if attempt < maxSendAttempts && classifyError(err) == errorRateLimited {
+			b.limiter.block(chatID, retryAfter(err))
+			continue
+		}
+		return sent, err
+	}
 }
 
 // SendAndForget sends message and logs error if it occurs.
 func (b *Bot) SendAndForget(msg tg.MessageConfig, log *zap.SugaredLogger) {
-	if _, err := b.API.Send(msg); err != nil {
+	if _, err := b.Send(msg); err != nil {
 		// TODO probably need to handle unavailable users here as well
 		log.Warnw("Failed to send notification", "err", err, "text", msg.Text)
 	}
@@ -0,0 +1,211 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"sort"
+	"strings"
+)
+
+const (
+	confirmBroadcast = "Send"
+	cancelBroadcast  = "Cancel"
+)
+
+// broadcastAudience selects chats that receive a broadcast, zero values match any chat.
+type broadcastAudience struct {
+	location domain.Location
+	action   domain.Action
+}
+
+// parseAudience parses "all", "location <code or name>" or "action <code or name>".
+func parseAudience(args []string) (broadcastAudience, error) {
+	if len(args) == 0 {
+		return broadcastAudience{}, errors.New("audience is required: all, location <location> or action <action>")
+	}
+	value := strings.Join(args[1:], " ")
+	switch args[0] {
+	case "all":
+		return broadcastAudience{}, nil
+	case "location":
+		location, ok := db.LocationForCode(value)
+		if !ok {
+			location, ok = db.LocationForName(value)
+		}
+		if !ok {
+			return broadcastAudience{}, fmt.Errorf("unknown location %q", value)
+		}
+		return broadcastAudience{location: location}, nil
+	case "action":
+		action, ok := db.ActionForCode(value)
+		if !ok {
+			action, ok = db.ActionForName(value)
+		}
+		if !ok {
+			return broadcastAudience{}, fmt.Errorf("unknown action %q", value)
+		}
+		return broadcastAudience{action: action}, nil
+	default:
+		return broadcastAudience{}, fmt.Errorf("unknown audience %q", args[0])
+	}
+}
+
+func (a broadcastAudience) String() string {
+	switch {
+	case a.location.Code != "":
+		return "chats subscribed to " + a.location.Name
+	case a.action.Code != "":
+		return "chats subscribed to " + a.action.Name
+	default:
+		return "all chats"
+	}
+}
+
+// recipients returns chats of the audience in a stable order. All chats are taken from the user registry without
+// chats the bot can't write to anymore.
+func (a broadcastAudience) recipients() ([]domain.ChatID, error) {
+	var result []domain.ChatID
+	if a.location.Code == "" && a.action.Code == "" {
+		users, err := db.Users.All()
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if !user.Blocked {
+				result = append(result, user.ChatID)
+			}
+		}
+	} else {
+		seen := map[domain.ChatID]struct{}{}
+		for _, subscription := range db.Subscriptions.All() {
+			if a.location.Code != "" && subscription.Location != a.location.Code {
+				continue
+			}
+			if a.action.Code != "" && subscription.Action != a.action.Code {
+				continue
+			}
+			if _, ok := seen[subscription.ChatID]; !ok {
+				seen[subscription.ChatID] = struct{}{}
+				result = append(result, subscription.ChatID)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result, nil
+}
+
+// BroadcastTextState waits for the text of an announcement.
+type BroadcastTextState struct {
+	audience broadcastAudience
+}
+
+func (s *BroadcastTextState) String() string {
+	return "BroadcastTextState"
+}
+
+func (s *BroadcastTextState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	toSend := newMessage(
+		fsm.chatID,
+		fmt.Sprintf("Send the text of the announcement to %s. Any command cancels the broadcast.", s.audience),
+	)
+	if _, err := bot.Send(toSend); err != nil {
+		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
+		fsm.To(doneState, msg)
+	}
+}
+
+func (s *BroadcastTextState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
+	if msg.IsCommand() {
+		fsm.To(commandHandlingState, msg)
+		return nil
+	}
+	if strings.TrimSpace(msg.Text) == "" {
+		bot.SendAndForget(newMessage(fsm.chatID, "Only text announcements are supported, please send text."), fsm.log)
+		return nil
+	}
+	fsm.To(&BroadcastConfirmState{audience: s.audience, text: msg.Text}, msg)
+	return nil
+}
+
+// BroadcastConfirmState shows how the announcement will look and waits for confirmation.
+type BroadcastConfirmState struct {
+	audience   broadcastAudience
+	text       string
+	recipients []domain.ChatID
+}
+
+func (s *BroadcastConfirmState) String() string {
+	return "BroadcastConfirmState"
+}
+
+func (s *BroadcastConfirmState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	recipients, err := s.audience.recipients()
+	if err != nil {
+		fsm.log.Warnw("Failed to get broadcast recipients", "err", err)
+		bot.SendAndForget(newMessage(fsm.chatID, "Failed to get the recipients, please try again later."), fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	s.recipients = recipients
+	if len(s.recipients) == 0 {
+		reply := newMessage(fsm.chatID, fmt.Sprintf("No chats match (%s), nothing to send.", s.audience))
+		bot.SendAndForget(reply, fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	bot.SendAndForget(newMessage(fsm.chatID, "Preview:"), fsm.log)
+	bot.SendAndForget(newMessage(fsm.chatID, s.text), fsm.log)
+	s.askConfirmation(fsm, msg, bot)
+}
+
+func (s *BroadcastConfirmState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
+	if msg.IsCommand() {
+		fsm.To(commandHandlingState, msg)
+		return nil
+	}
+	switch msg.Text {
+	case confirmBroadcast:
+		broadcast, err := bot.broadcaster.Submit(domain.Broadcast{
+			CreatedBy:  fsm.chatID,
+			Location:   s.audience.location.Code,
+			Action:     s.audience.action.Code,
+			Text:       s.text,
+			Recipients: s.recipients,
+		})
+		if err != nil {
+			fsm.log.Errorw("Failed to store broadcast", "err", err)
+			bot.SendAndForget(newMessage(fsm.chatID, "Failed to start the broadcast: "+err.Error()), fsm.log)
+			fsm.To(doneState, msg)
+			return nil
+		}
+		fsm.log.Infow("Broadcast submitted", "broadcast", broadcast.ID, "recipients", len(broadcast.Recipients))
+		bot.SendAndForget(newMessage(fsm.chatID, fmt.Sprintf(
+			"Broadcast %s to %d chats started, check the progress with /admin broadcasts.",
+			broadcast.ID, len(broadcast.Recipients),
+		)), fsm.log)
+		fsm.To(doneState, msg)
+	case cancelBroadcast:
+		bot.SendAndForget(newMessage(fsm.chatID, "Broadcast cancelled."), fsm.log)
+		fsm.To(doneState, msg)
+	default:
+		s.askConfirmation(fsm, msg, bot)
+	}
+	return nil
+}
+
+func (s *BroadcastConfirmState) askConfirmation(fsm *FSM, msg *tg.Message, bot *Bot) {
+	toSend := newMessage(fsm.chatID, fmt.Sprintf("Send it to %d chats (%s)?", len(s.recipients), s.audience))
+	toSend.ReplyMarkup = tg.NewOneTimeReplyKeyboard(tg.NewKeyboardButtonRow(
+		tg.NewKeyboardButton(confirmBroadcast),
+		tg.NewKeyboardButton(cancelBroadcast),
+	))
+	if _, err := bot.Send(toSend); err != nil {
+		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
+		fsm.To(doneState, msg)
+	}
+}
@@ -0,0 +1,133 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// broadcastInterval keeps broadcasts well below Telegram limit of about 30 messages per second, leaving room for
+	// notifications about slots.
+	broadcastInterval = time.Second / 20
+	// maxBroadcastAttempts limits attempts to send a broadcast to one chat, so that a broken chat doesn't stall it.
+	maxBroadcastAttempts = 5
+)
+
+// Broadcaster sends announcements of operators to many chats one by one. Progress is stored after every message,
+// so an interrupted broadcast continues where it stopped after a restart.
+type Broadcaster struct {
+	bot  *Bot
+	wake chan struct{}
+}
+
+func newBroadcaster(bot *Bot) *Broadcaster {
+	return &Broadcaster{
+		bot:  bot,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Submit stores the broadcast, it's sent by Run.
+func (b *Broadcaster) Submit(broadcast domain.Broadcast) (domain.Broadcast, error) {
+	broadcast, err := db.Broadcasts.Add(broadcast)
+	if err != nil {
+		return broadcast, err
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default: // already woken up
+	}
+	return broadcast, nil
+}
+
+// Run sends unfinished broadcasts from the oldest to the latest until ctx is done.
+func (b *Broadcaster) Run(ctx context.Context) {
+	for {
+		broadcasts, err := db.Broadcasts.All()
+		if err != nil {
+			log.Errorw("Failed to get broadcasts", "err", err)
+		}
+		for _, broadcast := range broadcasts {
+			if !broadcast.Finished() {
+				b.send(ctx, broadcast)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.wake:
+		}
+	}
+}
+
+func (b *Broadcaster) send(ctx context.Context, broadcast domain.Broadcast) {
+	log := log.With("broadcast", broadcast.ID)
+	log.Infow("Sending broadcast", "from", broadcast.Sent, "recipients", len(broadcast.Recipients))
+	ticker := time.NewTicker(broadcastInterval)
+	defer ticker.Stop()
+	attempts := 0
+	for broadcast.Sent < len(broadcast.Recipients) {
+		select {
+		case <-ctx.Done():
+			log.Infow("Broadcast interrupted", "sent", broadcast.Sent)
+			return
+		case <-ticker.C:
+		}
+		chatID := broadcast.Recipients[broadcast.Sent]
+		_, err := b.bot.Send(tg.NewMessage(int64(chatID), broadcast.Text))
+		switch classifyError(err) {
+		case errorRateLimited, errorTemporary:
+			attempts++
+			if attempts < maxBroadcastAttempts {
+				log.Warnw("Failed to send broadcast, will retry", "chat", chatID, "attempt", attempts, "err", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryAfter(err)):
+				}
+				continue // the same recipient again
+			}
+			log.Warnw("Failed to send broadcast, giving up", "chat", chatID, "attempts", attempts, "err", err)
+			broadcast.Failed++
+		case errorChatMigrated:
+			b.bot.moveChat(chatID, migratedTo(err))
+			broadcast.Recipients[broadcast.Sent] = migratedTo(err)
+			if err := db.Broadcasts.SetRecipients(broadcast.ID, broadcast.Recipients); err != nil {
+				log.Errorw("Failed to save recipients of broadcast", "chat", chatID, "err", err)
+			}
+			continue
+		case errorChatGone:
+			b.bot.forgetChat(chatID, err)
+			broadcast.Failed++
+		case errorBadRequest:
+			log.Warnw("Failed to send broadcast", "chat", chatID, "err", err)
+			broadcast.Failed++
+		}
+		broadcast.Sent++
+		attempts = 0
+		b.saveProgress(log, broadcast)
+	}
+	broadcast.FinishedAt = time.Now()
+	b.saveProgress(log, broadcast)
+	log.Infow("Broadcast finished", "sent", broadcast.Sent, "failed", broadcast.Failed)
+	report := newMessage(broadcast.CreatedBy, fmt.Sprintf(
+		"Broadcast %s finished: %d of %d chats received it.",
+		broadcast.ID, broadcast.Sent-broadcast.Failed, len(broadcast.Recipients),
+	))
+	b.bot.SendAndForget(report, log)
+}
+
+func (b *Broadcaster) saveProgress(log *zap.SugaredLogger, broadcast domain.Broadcast) {
+	err := db.Broadcasts.UpdateProgress(broadcast.ID, broadcast.Sent, broadcast.Failed, broadcast.FinishedAt)
+	if err != nil {
+		log.Errorw("Failed to save broadcast progress", "sent", broadcast.Sent, "err", err)
+	}
+}
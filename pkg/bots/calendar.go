@@ -0,0 +1,46 @@
+package bots
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/silh/trakind/pkg/domain"
+	"net/url"
+	"strings"
+)
+
+// CalendarPath is the path iCalendar feeds of subscriptions are served under.
+const CalendarPath = "/calendar/"
+
+// CalendarConfig describes where iCalendar feeds are served and how their URLs are signed.
+type CalendarConfig struct {
+	// BaseURL is the public URL of the HTTP server, e.g. https://trakind.example.com.
+	BaseURL string
+	// Secret signs feed URLs, changing it invalidates all of them.
+	Secret string
+}
+
+// EnableCalendar lets chats get private iCalendar feeds of their subscriptions with /calendar. The feeds must be
+// served at CalendarPath of the base URL.
+func (b *Bot) EnableCalendar(config CalendarConfig) {
+	b.calendar = &config
+}
+
+// CalendarToken returns the token that authorizes reading the feed of the subscription. Only whoever knows the secret
+// can create it, so the feed URL doesn't have to be stored.
+func CalendarToken(secret string, id domain.SubscriptionID) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidCalendarToken tells whether the token authorizes reading the feed of the subscription.
+func ValidCalendarToken(secret string, id domain.SubscriptionID, token string) bool {
+	return hmac.Equal([]byte(token), []byte(CalendarToken(secret, id)))
+}
+
+// calendarURL returns the private URL of the feed of the subscription.
+func (c CalendarConfig) calendarURL(id domain.SubscriptionID) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + CalendarPath + url.PathEscape(string(id)) + "/" +
+		CalendarToken(c.Secret, id) + ".ics"
+}
@@ -0,0 +1,64 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"strings"
+)
+
+// CalendarCommandState sends private iCalendar feed URLs of all subscriptions of the chat.
+type CalendarCommandState struct {
+}
+
+func (s CalendarCommandState) String() string {
+	return "CalendarCommandState"
+}
+
+func (s CalendarCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	var text string
+	if bot.calendar == nil {
+		text = "Calendar feeds are not available."
+	} else {
+		text = calendarFeeds(fsm, *bot.calendar)
+	}
+	reply := newMessage(fsm.chatID, text)
+	reply.DisableWebPagePreview = true
+	bot.SendAndForget(fsm.personal(reply), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s CalendarCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+// calendarFeeds returns the reply with a feed URL per subscription of the chat.
+func calendarFeeds(fsm *FSM, config CalendarConfig) string {
+	subscriptions, err := db.Subscriptions.GetForChat(fsm.chatID)
+	if err != nil {
+		fsm.log.Errorw("Failed to get subscriptions", "err", err)
+		return "Failed to get your subscriptions, please try again later."
+	}
+	if len(subscriptions) == 0 {
+		return "You don't track anything yet, start with /track."
+	}
+	var sb strings.Builder
+	sb.WriteString("Add these URLs to your calendar app as subscriptions. They list open slots found by the latest " +
+		"checks as tentative events. Keep them private, anyone with a URL sees the slots:\n")
+	for _, subscription := range subscriptions {
+		sb.WriteString("\n" + subscriptionText(subscription) + ":\n" + config.calendarURL(subscription.ID) + "\n")
+	}
+	sb.WriteString("\nA feed stops working when its tracking is stopped.")
+	return sb.String()
+}
+
+func subscriptionText(subscription domain.Subscription) string {
+	text := fmt.Sprintf("%s at %s for %d people", actionName(subscription.Action),
+		locationName(subscription.Location), subscription.PeopleCount)
+	if (subscription.TrackBefore != domain.Date{}) {
+		text += fmt.Sprintf(" before %s", &subscription.TrackBefore)
+	}
+	return text
+}
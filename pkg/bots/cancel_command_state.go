@@ -0,0 +1,24 @@
+package bots
+
+import (
+	"errors"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CancelCommandState leaves the current conversation, e.g. the tracking wizard, without saving anything.
+type CancelCommandState struct {
+}
+
+func (s CancelCommandState) String() string {
+	return "CancelCommandState"
+}
+
+func (s CancelCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	reply := newMessage(fsm.chatID, "Cancelled. Send /track whenever you want to start again.")
+	bot.SendAndForget(fsm.personal(reply), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s CancelCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
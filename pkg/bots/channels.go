@@ -0,0 +1,261 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bookingURL is the IND page where an appointment of the action can be booked.
+	bookingURL = "https://oap.ind.nl/oap/en/#/%s"
+	// maxPostsPerPoll limits new posts to a channel after one poll, the rest are posted after the next polls.
+	maxPostsPerPoll = 10
+)
+
+// Channel is a Telegram channel where new time windows of a location are published.
+type Channel struct {
+	// Chat is the username of the channel, e.g. "@ind_amsterdam", or its numeric ID.
+	Chat     string
+	Location string
+	// Action limits the channel to one type of appointments, all types of the location are published if it's empty.
+	Action string
+	// PeopleCount is the number of people the published windows are for.
+	PeopleCount int
+}
+
+// publisher posts open time windows to channels and edits the posts when the windows are gone. It only uses results
+// of regular polling, fetchers of routed groups keep polling even if the groups have no subscribers.
+type publisher struct {
+	bot *Bot
+	// routes are set by SetChannels before polling starts and never change after that.
+	routes map[db.SubscriptionGroup][]domain.ChatID
+
+	mu    sync.Mutex // guards posts, never held while talking to Telegram
+	posts map[domain.ChannelPostID]domain.ChannelPost
+}
+
+func newPublisher(bot *Bot) *publisher {
+	return &publisher{
+		bot:    bot,
+		routes: map[db.SubscriptionGroup][]domain.ChatID{},
+		posts:  map[domain.ChannelPostID]domain.ChannelPost{},
+	}
+}
+
+// SetChannels configures channels where new time windows are published, must be called before polling starts.
+// Channels given by username are resolved to their IDs, the ones that can't be resolved are skipped.
+func (b *Bot) SetChannels(channels []Channel) error {
+	routes := map[db.SubscriptionGroup][]domain.ChatID{}
+	for _, channel := range channels {
+		location, ok := db.LocationForCode(channel.Location)
+		if !ok {
+			return fmt.Errorf("unknown location %q of channel %s", channel.Location, channel.Chat)
+		}
+		actions := location.AvailableActions
+		if channel.Action != "" {
+			action, ok := db.ActionForCode(channel.Action)
+			if _, offered := actions[action]; !ok || !offered {
+				return fmt.Errorf("location %s has no action %q, channel %s", location.Name, channel.Action, channel.Chat)
+			}
+			actions = map[domain.Action]struct{}{action: {}}
+		}
+		chatID, err := b.resolveChannel(channel.Chat)
+		if err != nil {
+			log.Errorw("Skipping channel that can't be resolved", "channel", channel.Chat, "err", err)
+			continue
+		}
+		for action := range actions {
+			group := db.SubscriptionGroup{Location: location.Code, Action: action.Code, PeopleCount: channel.PeopleCount}
+			routes[group] = append(routes[group], chatID)
+		}
+	}
+	posts, err := db.ChannelPosts.All()
+	if err != nil {
+		return err
+	}
+	b.publisher.routes = routes
+	b.publisher.mu.Lock()
+	defer b.publisher.mu.Unlock()
+	for _, post := range posts {
+		b.publisher.posts[post.ID] = post
+	}
+	if len(routes) > 0 {
+		log.Infow("Publishing to channels", "routes", len(routes), "posts", len(posts))
+	}
+	return nil
+}
+
+// resolveChannel returns the ID of a channel given by its numeric ID or username.
+func (b *Bot) resolveChannel(chat string) (domain.ChatID, error) {
+	if id, err := strconv.ParseInt(chat, 10, 64); err == nil {
+		return domain.ChatID(id), nil
+	}
+	if !strings.HasPrefix(chat, "@") {
+		chat = "@" + chat
+	}
+	info, err := b.API.GetChat(tg.ChatInfoConfig{ChatConfig: tg.ChatConfig{SuperGroupUsername: chat}})
+	if err != nil {
+		return 0, err
+	}
+	return domain.ChatID(info.ID), nil
+}
+
+// wants tells whether windows of the group are published anywhere.
+func (p *publisher) wants(group db.SubscriptionGroup) bool {
+	return len(p.routes[group]) > 0
+}
+
+// publish posts new windows of the group to its channels and marks posts of windows that are gone. A group is only
+// published by its fetcher, so a window planned for posting can't be planned again until it is posted.
+func (p *publisher) publish(group db.SubscriptionGroup, windows []domain.TimeWindow) {
+	channels := p.routes[group]
+	if len(channels) == 0 {
+		return
+	}
+	planned, gone := p.plan(channels, group, windows)
+	for _, post := range planned {
+		p.post(post.channelID, post.id, group, post.window)
+	}
+	for _, post := range gone {
+		p.markGone(post)
+	}
+}
+
+// plannedPost is a window that is going to be posted to a channel.
+type plannedPost struct {
+	channelID domain.ChatID
+	id        domain.ChannelPostID
+	window    domain.TimeWindow
+}
+
+// plan returns windows of the group that aren't posted to the channels yet, at most maxPostsPerPoll per channel, and
+// posts of the group's windows that are gone.
+func (p *publisher) plan(
+	channels []domain.ChatID,
+	group db.SubscriptionGroup,
+	windows []domain.TimeWindow,
+) ([]plannedPost, []domain.ChannelPost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var planned []plannedPost
+	var gone []domain.ChannelPost
+	for _, channelID := range channels {
+		current := make(map[domain.ChannelPostID]struct{}, len(windows))
+		posts := 0
+		for _, window := range windows {
+			id := channelPostID(channelID, group, window)
+			current[id] = struct{}{}
+			if _, ok := p.posts[id]; ok || posts >= maxPostsPerPoll {
+				continue
+			}
+			planned = append(planned, plannedPost{channelID: channelID, id: id, window: window})
+			posts++
+		}
+		for id, post := range p.posts {
+			if _, ok := current[id]; ok || post.ChannelID != channelID || post.Location != group.Location ||
+				post.Action != group.Action || post.PeopleCount != group.PeopleCount {
+				continue
+			}
+			gone = append(gone, post)
+		}
+	}
+	return planned, gone
+}
+
+// post sends a message about the window to the channel and remembers it.
+func (p *publisher) post(
+	channelID domain.ChatID,
+	id domain.ChannelPostID,
+	group db.SubscriptionGroup,
+	window domain.TimeWindow,
+) {
+	text := "Available: " + windowText(group, window) + "\nBook: " + BookingURL(group.Action)
+	msg := tg.NewMessage(int64(channelID), text)
+	msg.DisableWebPagePreview = true
+	sent, err := p.bot.Send(msg)
+	if err != nil {
+		p.failed(channelID, "post to", err)
+		return
+	}
+	post := domain.ChannelPost{
+		ID:          id,
+		ChannelID:   channelID,
+		Location:    group.Location,
+		Action:      group.Action,
+		PeopleCount: group.PeopleCount,
+		Date:        window.Date,
+		StartTime:   window.StartTime,
+		MessageID:   sent.MessageID,
+		PostedAt:    time.Now(),
+	}
+	p.mu.Lock()
+	p.posts[id] = post
+	p.mu.Unlock()
+	if err := db.ChannelPosts.Save(post); err != nil {
+		log.Errorw("Failed to store channel post", "channel", channelID, "post", id, "err", err)
+	}
+}
+
+// markGone edits the post of a window that isn't available anymore and forgets it.
+func (p *publisher) markGone(post domain.ChannelPost) {
+	group := db.SubscriptionGroup{Location: post.Location, Action: post.Action, PeopleCount: post.PeopleCount}
+	window := domain.TimeWindow{Date: post.Date, StartTime: post.StartTime}
+	edit := tg.NewEditMessageText(int64(post.ChannelID), post.MessageID, "No longer available: "+windowText(group, window))
+	if err := p.bot.limiter.wait(context.Background(), post.ChannelID); err != nil {
+		return
+	}
+	_, err := p.bot.API.Send(edit)
+	switch classifyError(err) {
+	case errorNone, errorBadRequest: // a deleted or already edited message can't be edited either
+	default:
+		p.failed(post.ChannelID, "edit a post in", err)
+		return // tried again after the next poll
+	}
+	p.mu.Lock()
+	delete(p.posts, post.ID)
+	p.mu.Unlock()
+	if err := db.ChannelPosts.Remove(post.ID); err != nil {
+		log.Errorw("Failed to remove channel post", "channel", post.ChannelID, "post", post.ID, "err", err)
+	}
+}
+
+func (p *publisher) failed(channelID domain.ChatID, what string, err error) {
+	switch classifyError(err) {
+	case errorChatGone, errorBadRequest:
+		p.bot.alertAdmins("Failed to "+what+" a channel", channelID, err)
+	default:
+		log.Warnw("Failed to "+what+" channel, will retry", "channel", channelID, "err", err)
+	}
+}
+
+// channelPostID identifies a post of the window in the channel.
+func channelPostID(channelID domain.ChatID, group db.SubscriptionGroup, window domain.TimeWindow) domain.ChannelPostID {
+	return domain.ChannelPostID(fmt.Sprintf(
+		"%d/%s/%s/%d/%s/%s", channelID, group.Location, group.Action, group.PeopleCount, &window.Date,
+		&window.StartTime,
+	))
+}
+
+// BookingURL returns the IND page where an appointment of the action can be booked.
+func BookingURL(actionCode string) string {
+	return fmt.Sprintf(bookingURL, strings.ToLower(actionCode))
+}
+
+func windowText(group db.SubscriptionGroup, window domain.TimeWindow) string {
+	return fmt.Sprintf("%s at %s on %s at %s for %d people", actionName(group.Action), locationName(group.Location),
+		&window.Date, &window.StartTime, group.PeopleCount)
+}
+
+func actionName(code string) string {
+	if action, ok := db.ActionForCode(code); ok {
+		return action.Name
+	}
+	return code
+}
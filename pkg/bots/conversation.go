@@ -0,0 +1,145 @@
+package bots
+
+import (
+	"fmt"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"strings"
+	"time"
+)
+
+// ConversationTimeout is how long the bot waits for an answer in the middle of a conversation before giving up.
+var ConversationTimeout = 30 * time.Minute
+
+// expiryCheckInterval is how often workers look for conversations that timed out.
+const expiryCheckInterval = time.Minute
+
+// conversationState is a state of the tracking wizard that is saved, so that the conversation continues after a
+// restart.
+type conversationState interface {
+	State
+	// conversation returns the state and the answers collected so far, ChatID and UpdatedAt are set by the caller.
+	conversation() domain.Conversation
+}
+
+func (s *WhichActionState) conversation() domain.Conversation {
+	return s.toConversation(s)
+}
+
+func (s *WhichLocationState) conversation() domain.Conversation {
+	return s.toConversation(s)
+}
+
+func (s *HowManyPeopleState) conversation() domain.Conversation {
+	return s.toConversation(s)
+}
+
+func (s *BeforeDateState) conversation() domain.Conversation {
+	return s.toConversation(s)
+}
+
+// restoreState returns the state a saved conversation was in.
+func restoreState(conversation domain.Conversation) (State, error) {
+	answers, err := restoreAnswers(conversation)
+	if err != nil {
+		return nil, err
+	}
+	switch conversation.State {
+	case whichActionState.String():
+		return &WhichActionState{answers}, nil
+	case (&WhichLocationState{}).String():
+		return &WhichLocationState{answers}, nil
+	case (&HowManyPeopleState{}).String():
+		return &HowManyPeopleState{answers}, nil
+	case (&BeforeDateState{}).String():
+		return &BeforeDateState{answers}, nil
+	default:
+		return nil, fmt.Errorf("unknown state %q", conversation.State)
+	}
+}
+
+// loadConversations returns FSMs of conversations saved before a restart.
+func loadConversations(bot *Bot) []*FSM {
+	conversations, err := db.Conversations.All()
+	if err != nil {
+		log.Errorw("Failed to load conversations", "err", err)
+		return nil
+	}
+	fsms := make([]*FSM, 0, len(conversations))
+	for _, conversation := range conversations {
+		state, err := restoreState(conversation)
+		if err != nil {
+			log.Warnw("Dropping conversation that can't be restored", "chat", conversation.ChatID, "err", err)
+			if err := db.Conversations.Remove(conversation.ChatID); err != nil {
+				log.Warnw("Failed to remove conversation", "chat", conversation.ChatID, "err", err)
+			}
+			continue
+		}
+		fsm := NewFSM(conversation.ChatID, bot)
+		fsm.state = state
+		fsm.lastActivity = conversation.UpdatedAt
+		fsm.userID = conversation.UserID
+		fsm.saved = true
+		fsms = append(fsms, fsm)
+	}
+	if len(fsms) > 0 {
+		log.Infow("Conversations restored", "count", len(fsms))
+	}
+	return fsms
+}
+
+// saveConversation saves the conversation if it's in the middle of the tracking wizard and removes the saved one
+// otherwise.
+func saveConversation(fsm *FSM) {
+	state, ok := fsm.state.(conversationState)
+	if fsm.finished || !ok {
+		if !fsm.saved {
+			return
+		}
+		if err := db.Conversations.Remove(fsm.chatID); err != nil {
+			fsm.log.Warnw("Failed to remove conversation", "err", err)
+			return
+		}
+		fsm.saved = false
+		return
+	}
+	conversation := state.conversation()
+	conversation.ChatID = fsm.chatID
+	conversation.UserID = fsm.userID
+	conversation.UpdatedAt = fsm.lastActivity
+	if err := db.Conversations.Save(conversation); err != nil {
+		fsm.log.Warnw("Failed to save conversation", "err", err)
+		return
+	}
+	fsm.saved = true
+}
+
+// expired tells whether the FSM waited for an answer longer than ConversationTimeout.
+func (fsm *FSM) expired(now time.Time) bool {
+	_, waiting := fsm.state.(conversationState)
+	return waiting && now.Sub(fsm.lastActivity) >= ConversationTimeout
+}
+
+// expire ends a conversation that timed out and lets the user know how to start over.
+func expire(fsm *FSM) {
+	fsm.log.Debugw("Conversation expired", "state", fsm.state, "lastActivity", fsm.lastActivity)
+	reply := newMessage(fsm.chatID, fmt.Sprintf(
+		"I stopped waiting for your answer after %s without a reply. Send /track to start again whenever you're ready.",
+		formatTimeout(ConversationTimeout),
+	))
+	fsm.bot.SendAndForget(fsm.personal(reply), fsm.log)
+	fsm.To(doneState, nil)
+	saveConversation(fsm)
+}
+
+// formatTimeout formats the duration without trailing zero units, e.g. "30m" instead of "30m0s".
+func formatTimeout(timeout time.Duration) string {
+	text := timeout.String()
+	if timeout%time.Minute == 0 {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if timeout%time.Hour == 0 {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
@@ -0,0 +1,164 @@
+package bots
+
+import (
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+const (
+	// updateWorkers is the number of chats whose updates are processed at the same time.
+	updateWorkers = 16
+	// workerQueueSize is the number of updates a worker can have waiting before dispatching blocks.
+	workerQueueSize = 64
+)
+
+// dispatcher processes updates of different chats in parallel. Updates of a chat always go to the same worker, so
+// they are processed one at a time in the order they were received. Each worker owns FSMs of its chats, nothing else
+// touches them. Conversations in the middle of the tracking wizard are saved after every update, restored by the
+// next dispatcher and expired after ConversationTimeout without an answer.
+type dispatcher struct {
+	bot    *Bot
+	queues []chan tg.Update
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(bot *Bot, workers int) *dispatcher {
+	d := &dispatcher{
+		bot:    bot,
+		queues: make([]chan tg.Update, workers),
+	}
+	restored := make([][]*FSM, workers)
+	for _, fsm := range loadConversations(bot) {
+		i := d.worker(fsm.chatID)
+		restored[i] = append(restored[i], fsm)
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan tg.Update, workerQueueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i], restored[i])
+	}
+	return d
+}
+
+// dispatch passes the update to the worker of its chat. Updates without a chat are ignored.
+func (d *dispatcher) dispatch(update tg.Update) {
+	chatID, ok := updateChatID(update)
+	if !ok {
+		return
+	}
+	d.queues[d.worker(chatID)] <- update
+}
+
+// worker returns the index of the worker that owns the chat.
+func (d *dispatcher) worker(chatID domain.ChatID) int {
+	return int(uint64(chatID) % uint64(len(d.queues)))
+}
+
+// stop waits until workers process all dispatched updates.
+func (d *dispatcher) stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+func (d *dispatcher) work(queue <-chan tg.Update, restored []*FSM) {
+	defer d.wg.Done()
+	fsms := make(map[domain.ChatID]*FSM, len(restored))
+	for _, fsm := range restored {
+		fsms[fsm.chatID] = fsm
+	}
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case update, ok := <-queue:
+			if !ok {
+				return
+			}
+			chatID, _ := updateChatID(update)
+			fsm := fsms[chatID]
+			if fsm == nil {
+				fsm = NewFSM(chatID, d.bot)
+				fsms[chatID] = fsm
+			}
+			fsm.lastActivity = time.Now()
+			recordActivity(chatID, update.Message)
+			d.handle(fsm, update)
+			saveConversation(fsm)
+			if fsm.finished {
+				delete(fsms, chatID)
+			}
+		case now := <-ticker.C:
+			for chatID, fsm := range fsms {
+				if fsm.expired(now) {
+					expire(fsm)
+					delete(fsms, chatID)
+				}
+			}
+		}
+	}
+}
+
+func (d *dispatcher) handle(fsm *FSM, update tg.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			fsm.log.Errorw("Update handling panicked", "panic", r)
+			fsm.finished = true // start over with a fresh FSM
+		}
+	}()
+	if update.MyChatMember != nil { // updateChatID lets through only the bot being kicked
+		d.bot.forgetChat(fsm.chatID, errBotKicked)
+		fsm.To(doneState, nil)
+		return
+	}
+	msg := update.Message
+	switch {
+	case msg.MigrateToChatID != 0:
+		d.bot.moveChat(fsm.chatID, domain.ChatID(msg.MigrateToChatID))
+		fsm.finished = true // the conversation continues in the supergroup from scratch
+		return
+	case msg.MigrateFromChatID != 0:
+		d.bot.moveChat(domain.ChatID(msg.MigrateFromChatID), fsm.chatID)
+		return
+	case d.bot.addressedToOtherBot(msg):
+		return
+	case !fsm.accepts(msg):
+		if fsm.state == initialState {
+			fsm.finished = true
+		}
+		return
+	}
+	if _, tracking := trackingCommands[msg.Command()]; tracking && !d.bot.canChangeTracking(msg) {
+		reply := tg.NewMessage(int64(fsm.chatID), "Only group admins can change tracking in this group.")
+		reply.ReplyToMessageID = msg.MessageID
+		d.bot.SendAndForget(reply, fsm.log)
+		if fsm.state == initialState {
+			fsm.finished = true
+		}
+		return
+	}
+	if msg.IsCommand() {
+		fsm.userID = senderID(msg)
+	}
+	if senderID(msg) == fsm.userID {
+		fsm.replyTo = msg.MessageID
+	}
+	if err := fsm.Do(msg); err != nil {
+		fsm.log.Warnw("Failed to handle message", "err", err)
+	}
+}
+
+// updateChatID returns the chat of updates the bot handles: messages and the bot being kicked from a chat.
+func updateChatID(update tg.Update) (domain.ChatID, bool) {
+	switch {
+	case update.MyChatMember != nil && update.MyChatMember.NewChatMember.WasKicked():
+		return domain.ChatID(update.MyChatMember.Chat.ID), true
+	case update.Message != nil:
+		return domain.ChatID(update.Message.Chat.ID), true
+	default:
+		return 0, false
+	}
+}
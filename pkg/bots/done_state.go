@@ -13,7 +13,7 @@ func (s DoneState) String() string {
 }
 
 func (s DoneState) To(fsm *FSM, _ *tg.Message, _ *Bot) {
-	delete(chatFSMs, fsm.chatID) // TODO this is ugly
+	fsm.finished = true // the owner of the FSM forgets it after the update is processed
 	fsm.log.Debug("We are done")
 }
 
@@ -0,0 +1,255 @@
+package bots
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// emailQueueSize limits notifications waiting for the SMTP server, newer ones are dropped when it's full.
+	emailQueueSize = 256
+	// emailInterval is the minimum time between emails about the same subscription, slots are checked every minute
+	// and nobody wants a mail every minute.
+	emailInterval = time.Hour
+	// emailCodeInterval is the minimum time between verification codes asked by the same chat or sent to the same
+	// address, so that the bot can't be used to flood a mailbox.
+	emailCodeInterval = 10 * time.Minute
+	// emailCodeQueueSize limits verification codes waiting for the SMTP server.
+	emailCodeQueueSize = 16
+	// smtpTimeout limits a whole SMTP session.
+	smtpTimeout = 30 * time.Second
+)
+
+// errEmailCodeTooSoon is returned by SendCode when a code was sent to the chat or the address recently.
+var errEmailCodeTooSoon = errors.New("a verification code was sent recently")
+
+// EmailConfig describes the SMTP server used to send emails. Authentication is used only if Username is set.
+type EmailConfig struct {
+	// Addr is host:port of the SMTP server.
+	Addr     string
+	Username string
+	Password string
+	// From is the sender address.
+	From string
+}
+
+// email is a plain text message to a single recipient.
+type email struct {
+	to      string
+	subject string
+	body    string
+}
+
+// EmailNotifier sends notifications to verified email addresses of chats and verification codes. Emails are sent one
+// by one by Run, codes before notifications. STARTTLS is used when the server supports it.
+type EmailNotifier struct {
+	config EmailConfig
+	queue  chan email
+	codes  chan email
+
+	mu       sync.Mutex
+	lastSent map[domain.SubscriptionID]time.Time
+	// lastCode has when a code was last asked by a chat or sent to an address.
+	lastCode map[string]time.Time
+}
+
+// NewEmailNotifier creates a notifier that sends emails through the SMTP server, Run must be running to send them.
+func NewEmailNotifier(config EmailConfig) (*EmailNotifier, error) {
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", config.Addr, err)
+	}
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", config.From, err)
+	}
+	return &EmailNotifier{
+		config:   config,
+		queue:    make(chan email, emailQueueSize),
+		codes:    make(chan email, emailCodeQueueSize),
+		lastSent: map[domain.SubscriptionID]time.Time{},
+		lastCode: map[string]time.Time{},
+	}, nil
+}
+
+// Notify queues an email if the chat has a verified address and wasn't emailed about the subscription recently.
+func (n *EmailNotifier) Notify(notification Notification) error {
+	user, err := db.Users.Get(notification.ChatID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || !n.due(notification.SubscriptionID, time.Now()) {
+		return nil
+	}
+	select {
+	case n.queue <- email{to: user.Email, subject: notification.Subject, body: notification.Text}:
+		return nil
+	default:
+		return errors.New("email queue is full")
+	}
+}
+
+// due tells whether an email about the subscription can be sent now and remembers it as sent if so.
+func (n *EmailNotifier) due(id domain.SubscriptionID, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, ok := n.lastSent[id]; ok && now.Sub(last) < emailInterval {
+		return false
+	}
+	n.lastSent[id] = now
+	return true
+}
+
+// SendCode queues an email with the code that confirms the address belongs to the chat. Returns errEmailCodeTooSoon
+// if a code was asked by the chat or sent to the address within emailCodeInterval.
+func (n *EmailNotifier) SendCode(chatID domain.ChatID, to, code string) error {
+	if !n.codeDue(chatID, to, time.Now()) {
+		return errEmailCodeTooSoon
+	}
+	message := email{
+		to:      to,
+		subject: "Your IND appointment bot verification code",
+		body: "Send this code to the bot to receive notifications by email: " + code + "\n\n" +
+			"If you didn't ask for it, just ignore this email.",
+	}
+	select {
+	case n.codes <- message:
+		return nil
+	default:
+		return errors.New("verification code queue is full")
+	}
+}
+
+// codeDue tells whether a code can be sent to the address for the chat now and remembers it as sent if so.
+func (n *EmailNotifier) codeDue(chatID domain.ChatID, to string, now time.Time) bool {
+	chatKey := fmt.Sprintf("chat:%d", chatID)
+	addressKey := "address:" + strings.ToLower(to)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, last := range n.lastCode {
+		if now.Sub(last) >= emailCodeInterval {
+			delete(n.lastCode, key)
+		}
+	}
+	if _, ok := n.lastCode[chatKey]; ok {
+		return false
+	}
+	if _, ok := n.lastCode[addressKey]; ok {
+		return false
+	}
+	n.lastCode[chatKey], n.lastCode[addressKey] = now, now
+	return true
+}
+
+// Run sends queued emails until ctx is done, verification codes go first.
+func (n *EmailNotifier) Run(ctx context.Context) {
+	for {
+		var message email
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-n.codes:
+		default:
+			select {
+			case <-ctx.Done():
+				return
+			case message = <-n.codes:
+			case message = <-n.queue:
+			}
+		}
+		if err := n.send(message); err != nil {
+			log.Warnw("Failed to send email", "to", message.to, "err", err)
+		}
+	}
+}
+
+// send delivers the email to the SMTP server.
+func (n *EmailNotifier) send(message email) error {
+	host, _, _ := net.SplitHostPort(n.config.Addr)
+	conn, err := net.DialTimeout("tcp", n.config.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.config.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(message.to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.compose(message)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// compose formats the email with headers. Line breaks are normalized to CRLF as SMTP requires.
+func (n *EmailNotifier) compose(message email) []byte {
+	var sb strings.Builder
+	sb.WriteString("From: " + n.config.From + "\r\n")
+	sb.WriteString("To: " + message.to + "\r\n")
+	sb.WriteString("Subject: " + strings.ReplaceAll(message.subject, "\n", " ") + "\r\n")
+	sb.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	sb.WriteString("\r\n")
+	body := strings.ReplaceAll(message.body, "\r\n", "\n")
+	sb.WriteString(strings.ReplaceAll(body, "\n", "\r\n") + "\r\n")
+	return []byte(sb.String())
+}
+
+// parseEmail returns the bare address if the text is a single valid email address.
+func parseEmail(text string) (string, bool) {
+	address, err := mail.ParseAddress(strings.TrimSpace(text))
+	if err != nil || address.Name != "" || strings.ContainsAny(address.Address, "\r\n") {
+		return "", false
+	}
+	return address.Address, true
+}
+
+// newVerificationCode returns a random 6 digit code.
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,148 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"strings"
+	"time"
+)
+
+const (
+	// emailCodeTimeout is how long a verification code is valid.
+	emailCodeTimeout = 15 * time.Minute
+	// maxEmailCodeAttempts limits wrong codes before the verification is cancelled.
+	maxEmailCodeAttempts = 3
+)
+
+// EmailCommandState shows, sets or removes the email address that receives notifications too.
+type EmailCommandState struct {
+}
+
+func (s EmailCommandState) String() string {
+	return "EmailCommandState"
+}
+
+func (s EmailCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	if bot.email == nil {
+		bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, "Email notifications are not available.")), fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	switch arg := strings.TrimSpace(msg.CommandArguments()); arg {
+	case "":
+		bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, emailStatus(fsm))), fsm.log)
+		fsm.To(doneState, msg)
+	case "off":
+		if err := db.Users.SetEmail(fsm.chatID, ""); err != nil {
+			fsm.log.Errorw("Failed to remove email", "err", err)
+			bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, "Failed to remove the email address.")), fsm.log)
+		} else {
+			reply := newMessage(fsm.chatID, "You won't receive notifications by email anymore.")
+			bot.SendAndForget(fsm.personal(reply), fsm.log)
+		}
+		fsm.To(doneState, msg)
+	default:
+		address, ok := parseEmail(arg)
+		if !ok {
+			reply := newMessage(fsm.chatID, fmt.Sprintf("%q doesn't look like an email address.", arg))
+			bot.SendAndForget(fsm.personal(reply), fsm.log)
+			fsm.To(doneState, msg)
+			return
+		}
+		fsm.To(&EmailCodeState{address: address}, msg)
+	}
+}
+
+func (s EmailCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+// emailStatus describes the current email address of the chat and how to change it.
+func emailStatus(fsm *FSM) string {
+	const usage = "Send /email you@example.com to receive notifications by email too, /email off to stop."
+	user, err := db.Users.Get(fsm.chatID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		fsm.log.Warnw("Failed to get user", "err", err)
+	}
+	if user.Email == "" {
+		return "Notifications are not sent by email. " + usage
+	}
+	return fmt.Sprintf("Notifications are also sent to %s. %s", user.Email, usage)
+}
+
+// EmailCodeState sends a verification code to the address and waits until the chat sends it back.
+type EmailCodeState struct {
+	address  string
+	code     string
+	expires  time.Time
+	attempts int
+}
+
+func (s *EmailCodeState) String() string {
+	return "EmailCodeState"
+}
+
+func (s *EmailCodeState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	code, err := newVerificationCode()
+	if err == nil {
+		err = bot.email.SendCode(fsm.chatID, s.address, code)
+	}
+	if errors.Is(err, errEmailCodeTooSoon) {
+		reply := newMessage(fsm.chatID, fmt.Sprintf(
+			"A code was sent recently, please wait %s before asking for another one.",
+			formatTimeout(emailCodeInterval),
+		))
+		bot.SendAndForget(fsm.personal(reply), fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	if err != nil {
+		fsm.log.Warnw("Failed to send verification code", "err", err)
+		reply := newMessage(fsm.chatID, "Failed to send an email to "+s.address+", please try again later.")
+		bot.SendAndForget(fsm.personal(reply), fsm.log)
+		fsm.To(doneState, msg)
+		return
+	}
+	s.code, s.expires = code, time.Now().Add(emailCodeTimeout)
+	reply := newMessage(fsm.chatID, fmt.Sprintf(
+		"I'm sending a code to %s, please send it here within %s. /cancel stops the verification.",
+		s.address, formatTimeout(emailCodeTimeout),
+	))
+	bot.SendAndForget(fsm.personal(reply), fsm.log)
+}
+
+func (s *EmailCodeState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
+	if msg.IsCommand() {
+		fsm.To(commandHandlingState, msg)
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		reply := newMessage(fsm.chatID, "The code has expired, send /email "+s.address+" to get a new one.")
+		bot.SendAndForget(fsm.personal(reply), fsm.log)
+		fsm.To(doneState, msg)
+		return nil
+	}
+	if strings.TrimSpace(msg.Text) != s.code {
+		s.attempts++
+		if s.attempts >= maxEmailCodeAttempts {
+			reply := newMessage(fsm.chatID, "Too many wrong codes, send /email "+s.address+" to get a new one.")
+			bot.SendAndForget(fsm.personal(reply), fsm.log)
+			fsm.To(doneState, msg)
+			return nil
+		}
+		bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, "Wrong code, please try again.")), fsm.log)
+		return nil
+	}
+	if err := db.Users.SetEmail(fsm.chatID, s.address); err != nil {
+		bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, "Failed to store the email address.")), fsm.log)
+		fsm.To(doneState, msg)
+		return fmt.Errorf("failed to store email: %w", err)
+	}
+	fsm.log.Infow("Email verified")
+	reply := newMessage(fsm.chatID, "Done! Notifications will be sent to "+s.address+" too.")
+	bot.SendAndForget(fsm.personal(reply), fsm.log)
+	fsm.To(doneState, msg)
+	return nil
+}
@@ -0,0 +1,179 @@
+package bots
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is what the stub server received in one session.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpStub is an SMTP server without TLS and authentication that accepts every message.
+type smtpStub struct {
+	listener net.Listener
+	messages chan smtpMessage
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stub := &smtpStub{listener: listener, messages: make(chan smtpMessage, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go stub.serve()
+	return stub
+}
+
+func (s *smtpStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *smtpStub) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP stub")
+	var message smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message.from = smtpPath(line[len("MAIL FROM:"):])
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.to = append(message.to, smtpPath(line[len("RCPT TO:"):]))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			message.data = data.String()
+			s.messages <- message
+			message = smtpMessage{}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of MAIL or RCPT argument without parameters, e.g. BODY=8BITMIME.
+func smtpPath(argument string) string {
+	path, _, _ := strings.Cut(strings.TrimSpace(argument), " ")
+	return strings.Trim(path, "<>")
+}
+
+// receive waits for the next message the stub accepted.
+func (s *smtpStub) receive(t *testing.T) smtpMessage {
+	t.Helper()
+	select {
+	case message := <-s.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+		return smtpMessage{}
+	}
+}
+
+func newTestEmailNotifier(t *testing.T, stub *smtpStub) *EmailNotifier {
+	t.Helper()
+	notifier, err := NewEmailNotifier(EmailConfig{Addr: stub.listener.Addr().String(), From: "bot@localhost"})
+	if err != nil {
+		t.Fatalf("failed to create notifier: %v", err)
+	}
+	return notifier
+}
+
+func TestEmailNotifierSend(t *testing.T) {
+	stub := newSMTPStub(t)
+	notifier := newTestEmailNotifier(t, stub)
+	err := notifier.send(email{to: "user@example.com", subject: "New\nslot", body: "Line one\nLine two"})
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	message := stub.receive(t)
+	if message.from != "bot@localhost" {
+		t.Errorf("expected sender bot@localhost, got %q", message.from)
+	}
+	if len(message.to) != 1 || message.to[0] != "user@example.com" {
+		t.Errorf("expected recipient user@example.com, got %q", message.to)
+	}
+	for _, expected := range []string{"To: user@example.com\r\n", "Subject: New slot\r\n", "Line one\r\nLine two\r\n"} {
+		if !strings.Contains(message.data, expected) {
+			t.Errorf("expected %q in email:\n%s", expected, message.data)
+		}
+	}
+}
+
+func TestEmailNotifierSendCode(t *testing.T) {
+	stub := newSMTPStub(t)
+	notifier := newTestEmailNotifier(t, stub)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	if err := notifier.SendCode(1, "user@example.com", "123456"); err != nil {
+		t.Fatalf("SendCode failed: %v", err)
+	}
+	message := stub.receive(t)
+	if len(message.to) != 1 || message.to[0] != "user@example.com" {
+		t.Errorf("expected recipient user@example.com, got %q", message.to)
+	}
+	if !strings.Contains(message.data, "123456") {
+		t.Errorf("expected the code in email:\n%s", message.data)
+	}
+
+	if err := notifier.SendCode(1, "other@example.com", "123456"); !errors.Is(err, errEmailCodeTooSoon) {
+		t.Errorf("expected the chat to wait for another code, got %v", err)
+	}
+	if err := notifier.SendCode(2, "USER@example.com", "123456"); !errors.Is(err, errEmailCodeTooSoon) {
+		t.Errorf("expected the address to wait for another code, got %v", err)
+	}
+	if err := notifier.SendCode(2, "other@example.com", "654321"); err != nil {
+		t.Fatalf("SendCode failed: %v", err)
+	}
+	if message := stub.receive(t); !strings.Contains(message.data, "654321") {
+		t.Errorf("expected the second code in email:\n%s", message.data)
+	}
+}
@@ -0,0 +1,358 @@
+package bots
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries "sha256=" and hex encoded HMAC-SHA256 of the timestamp, a dot and the body.
+	WebhookSignatureHeader = "X-Trakind-Signature"
+	// WebhookTimestampHeader carries Unix time of the request, it's signed to prevent replays.
+	WebhookTimestampHeader = "X-Trakind-Timestamp"
+	// windowAvailableEvent is the type of events about new time windows.
+	windowAvailableEvent = "window.available"
+
+	// maxWebhookAttempts limits attempts to deliver one event.
+	maxWebhookAttempts = 5
+	// webhookRetryDelay is the wait before the second attempt, it doubles after every attempt.
+	webhookRetryDelay = 2 * time.Second
+	// maxWebhookFailures is the number of events in a row that couldn't be delivered before a webhook is disabled.
+	maxWebhookFailures = 5
+	// webhookQueueSize limits events waiting for delivery, newer ones are dropped when it's full.
+	webhookQueueSize = 1024
+	// webhookWorkers is the number of events delivered at the same time.
+	webhookWorkers = 4
+)
+
+// WebhookEndpoint is an operator-configured endpoint that receives events about all new time windows.
+type WebhookEndpoint struct {
+	URL    string
+	Secret string
+}
+
+// WindowEvent is sent to webhooks when a new time window appears.
+type WindowEvent struct {
+	Type         string           `json:"type"`
+	Location     string           `json:"location"`
+	LocationName string           `json:"locationName"`
+	Action       string           `json:"action"`
+	ActionName   string           `json:"actionName"`
+	Persons      int              `json:"persons"`
+	Date         domain.Date      `json:"date"`
+	StartTime    domain.TimeOfDay `json:"startTime"`
+	EndTime      domain.TimeOfDay `json:"endTime"`
+	Key          string           `json:"key"`
+	BookingURL   string           `json:"bookingURL"`
+	// SubscriptionID is the matching subscription, empty for operator-configured endpoints.
+	SubscriptionID domain.SubscriptionID `json:"subscriptionID,omitempty"`
+	DetectedAt     time.Time             `json:"detectedAt"`
+}
+
+// webhookDelivery is an event on its way to an endpoint. chatID is 0 for operator-configured endpoints.
+type webhookDelivery struct {
+	chatID domain.ChatID
+	url    string
+	secret string
+	event  WindowEvent
+}
+
+// eventWebhooks sends events about new time windows to webhooks of chats with matching subscriptions and to
+// operator-configured endpoints. A window is new if it wasn't in the previous poll of its group, so the first poll
+// after a start or after polling of the group was skipped only remembers the windows.
+type eventWebhooks struct {
+	bot *Bot
+	// endpoints are set by SetEventWebhooks before polling starts and never change after that.
+	endpoints []WebhookEndpoint
+	queue     chan webhookDelivery
+
+	mu   sync.Mutex
+	seen map[db.SubscriptionGroup]map[string]struct{}
+	// endpointFailures counts failures of operator-configured endpoints, they are disabled until a restart.
+	endpointFailures map[string]int
+}
+
+func newEventWebhooks(bot *Bot) *eventWebhooks {
+	return &eventWebhooks{
+		bot:              bot,
+		queue:            make(chan webhookDelivery, webhookQueueSize),
+		seen:             map[db.SubscriptionGroup]map[string]struct{}{},
+		endpointFailures: map[string]int{},
+	}
+}
+
+// SetEventWebhooks configures endpoints that receive events about all new time windows, must be called before polling
+// starts. With endpoints every location, action and number of people is polled.
+func (b *Bot) SetEventWebhooks(endpoints []WebhookEndpoint) {
+	b.webhooks.endpoints = endpoints
+}
+
+// RunEventWebhooks delivers events to webhooks until ctx is done.
+func (b *Bot) RunEventWebhooks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-b.webhooks.queue:
+					b.webhooks.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// wantsAll tells whether windows of all groups are sent to operator-configured endpoints.
+func (w *eventWebhooks) wantsAll() bool {
+	return len(w.endpoints) > 0
+}
+
+// forget drops windows of the previous poll of the group, so that the next poll only remembers windows again.
+func (w *eventWebhooks) forget(group db.SubscriptionGroup) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.seen, group)
+}
+
+// observe queues events about windows of the group that weren't there after the previous poll.
+func (w *eventWebhooks) observe(group db.SubscriptionGroup, windows []domain.TimeWindow) {
+	current := make(map[string]struct{}, len(windows))
+	for _, window := range windows {
+		current[WindowKey(window)] = struct{}{}
+	}
+	w.mu.Lock()
+	previous, polledBefore := w.seen[group]
+	w.seen[group] = current
+	w.mu.Unlock()
+	if !polledBefore {
+		return
+	}
+	now := time.Now()
+	for _, window := range windows {
+		if _, ok := previous[WindowKey(window)]; ok {
+			continue
+		}
+		event := newWindowEvent(group, window, now)
+		for _, endpoint := range w.endpoints {
+			w.enqueue(webhookDelivery{url: endpoint.URL, secret: endpoint.Secret, event: event})
+		}
+		notified := map[domain.ChatID]struct{}{}
+		for _, subscription := range db.Subscriptions.Matching(group, window) {
+			if _, ok := notified[subscription.ChatID]; ok {
+				continue
+			}
+			notified[subscription.ChatID] = struct{}{}
+			webhook, err := db.EventWebhooks.Get(subscription.ChatID)
+			if errors.Is(err, db.ErrNotFound) || webhook.Disabled {
+				continue
+			}
+			if err != nil {
+				log.Warnw("Failed to get webhook", "chat", subscription.ChatID, "err", err)
+				continue
+			}
+			event.SubscriptionID = subscription.ID
+			w.enqueue(webhookDelivery{chatID: webhook.ChatID, url: webhook.URL, secret: webhook.Secret, event: event})
+		}
+	}
+}
+
+func (w *eventWebhooks) enqueue(delivery webhookDelivery) {
+	select {
+	case w.queue <- delivery:
+	default:
+		log.Warnw("Webhook queue is full, dropping event", "chat", delivery.chatID, "url", delivery.url)
+	}
+}
+
+// deliver posts the event, retrying with exponential backoff, and records the result.
+func (w *eventWebhooks) deliver(ctx context.Context, delivery webhookDelivery) {
+	if delivery.chatID == 0 && w.endpointDisabled(delivery.url) {
+		return
+	}
+	body, err := json.Marshal(&delivery.event)
+	if err != nil {
+		log.Errorw("Failed to encode webhook event", "err", err)
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = postEvent(ctx, delivery, body)
+		if err == nil || attempt == maxWebhookAttempts {
+			break
+		}
+		log.Debugw("Webhook delivery failed, will retry", "url", delivery.url, "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if delivery.chatID == 0 {
+		w.recordEndpoint(delivery.url, err)
+	} else {
+		w.recordChat(delivery, err)
+	}
+}
+
+func (w *eventWebhooks) endpointDisabled(url string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.endpointFailures[url] >= maxWebhookFailures
+}
+
+// recordEndpoint counts failures of an operator-configured endpoint and disables it until a restart after too many.
+func (w *eventWebhooks) recordEndpoint(url string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		w.endpointFailures[url] = 0
+		return
+	}
+	w.endpointFailures[url]++
+	if w.endpointFailures[url] == maxWebhookFailures {
+		log.Errorw("Webhook disabled until restart after repeated failures", "url", url, "err", err)
+	} else {
+		log.Warnw("Failed to deliver webhook event", "url", url, "err", err)
+	}
+}
+
+// recordChat stores the result of a delivery to the webhook of a chat, disabling it after too many failures.
+func (w *eventWebhooks) recordChat(delivery webhookDelivery, err error) {
+	webhook, changed := w.updateChat(delivery, err)
+	if changed && webhook.Disabled {
+		w.bot.SendAndForget(newMessage(delivery.chatID, fmt.Sprintf(
+			"Your webhook %s failed %d times in a row and was disabled. Send /webhook with a URL to enable it again.",
+			webhook.URL, webhook.Failures,
+		)), log)
+	}
+}
+
+// updateChat changes the failure count of the webhook the event was delivered to. Returns false if nothing changed.
+func (w *eventWebhooks) updateChat(delivery webhookDelivery, err error) (domain.EventWebhook, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	webhook, getErr := db.EventWebhooks.Get(delivery.chatID)
+	if getErr != nil || webhook.Disabled || webhook.URL != delivery.url || webhook.Secret != delivery.secret {
+		return webhook, false // removed, disabled or replaced while the event was delivered
+	}
+	if err == nil {
+		if webhook.Failures == 0 {
+			return webhook, false
+		}
+		webhook.Failures = 0
+	} else {
+		log.Infow("Failed to deliver webhook event", "chat", delivery.chatID, "err", err)
+		webhook.Failures++
+		webhook.Disabled = webhook.Failures >= maxWebhookFailures
+	}
+	if err := db.EventWebhooks.Save(webhook); err != nil {
+		log.Warnw("Failed to store webhook", "chat", delivery.chatID, "err", err)
+	}
+	return webhook, true
+}
+
+// userWebhookClient refuses to connect to loopback and private addresses, so chats can't reach services next to
+// the bot.
+var userWebhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func publicAddressOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+// postEvent sends the signed event, only 2xx responses count as delivered.
+func postEvent(ctx context.Context, delivery webhookDelivery, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.secret, timestamp, body))
+	httpClient := &client
+	if delivery.chatID != 0 {
+		httpClient = userWebhookClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the value of WebhookSignatureHeader for the request.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWindowEvent(group db.SubscriptionGroup, window domain.TimeWindow, now time.Time) WindowEvent {
+	location, _ := db.LocationForCode(group.Location)
+	action, _ := db.ActionForCode(group.Action)
+	return WindowEvent{
+		Type:         windowAvailableEvent,
+		Location:     group.Location,
+		LocationName: location.Name,
+		Action:       group.Action,
+		ActionName:   action.Name,
+		Persons:      group.PeopleCount,
+		Date:         window.Date,
+		StartTime:    window.StartTime,
+		EndTime:      window.EndTime,
+		Key:          WindowKey(window),
+		BookingURL:   BookingURL(group.Action),
+		DetectedAt:   now,
+	}
+}
+
+// WindowKey identifies the window within its group, IND gives every window a key.
+func WindowKey(window domain.TimeWindow) string {
+	if window.Key != "" {
+		return window.Key
+	}
+	return fmt.Sprintf("%s/%s", &window.Date, &window.StartTime)
+}
@@ -0,0 +1,148 @@
+package bots
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			"event", "secret", "1700000000", `{"type":"window.available"}`,
+			"sha256=0314557df306661528c438e4074db381e3c01792cf1ccee14998f99d6269ab0c",
+		},
+		{"empty", "", "0", "", "sha256=b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SignWebhook(test.secret, test.timestamp, []byte(test.body)); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPostEventIsSigned(t *testing.T) {
+	const secret = "secret"
+	var verified bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		expected := SignWebhook(secret, r.Header.Get(WebhookTimestampHeader), body)
+		verified = hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(expected))
+	}))
+	defer server.Close()
+	delivery := webhookDelivery{url: server.URL, secret: secret}
+	if err := postEvent(context.Background(), delivery, []byte(`{"type":"window.available"}`)); err != nil {
+		t.Fatalf("failed to post event: %v", err)
+	}
+	if !verified {
+		t.Error("expected the signature to match the timestamp and the body")
+	}
+}
+
+func TestRecordEndpointDisables(t *testing.T) {
+	failed := errors.New("unexpected status 500")
+	tests := []struct {
+		name         string
+		results      []error
+		wantDisabled bool
+	}{
+		{"delivered", []error{nil, nil}, false},
+		{"a few failures", []error{failed, failed, failed, failed}, false},
+		{"too many failures", []error{failed, failed, failed, failed, failed}, true},
+		{"success resets", []error{failed, failed, failed, failed, nil, failed}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhooks := newEventWebhooks(nil)
+			for _, err := range test.results {
+				webhooks.recordEndpoint("https://example.com/hook", err)
+			}
+			if got := webhooks.endpointDisabled("https://example.com/hook"); got != test.wantDisabled {
+				t.Errorf("expected disabled %t, got %t", test.wantDisabled, got)
+			}
+			if webhooks.endpointDisabled("https://example.com/other") {
+				t.Error("expected other endpoints to stay enabled")
+			}
+		})
+	}
+}
+
+func TestUpdateChatDisables(t *testing.T) {
+	failed := errors.New("unexpected status 500")
+	const chatID = domain.ChatID(1)
+	tests := []struct {
+		name         string
+		results      []error
+		secret       string
+		wantFailures int
+		wantDisabled bool
+	}{
+		{"delivered", []error{nil}, "secret", 0, false},
+		{"a few failures", []error{failed, failed}, "secret", 2, false},
+		{"too many failures", []error{failed, failed, failed, failed, failed}, "secret", maxWebhookFailures, true},
+		{"stays disabled", []error{failed, failed, failed, failed, failed, nil}, "secret", maxWebhookFailures, true},
+		{"success resets", []error{failed, failed, nil}, "secret", 0, false},
+		{"replaced webhook", []error{failed, failed}, "old", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			openMemoryStorage(t)
+			webhook := domain.EventWebhook{ChatID: chatID, URL: "https://example.com/hook", Secret: "secret"}
+			if err := db.EventWebhooks.Save(webhook); err != nil {
+				t.Fatalf("failed to save webhook: %v", err)
+			}
+			webhooks := newEventWebhooks(nil)
+			delivery := webhookDelivery{chatID: chatID, url: webhook.URL, secret: test.secret}
+			for _, err := range test.results {
+				webhooks.updateChat(delivery, err)
+			}
+			stored, err := db.EventWebhooks.Get(chatID)
+			if err != nil {
+				t.Fatalf("failed to get webhook: %v", err)
+			}
+			if stored.Failures != test.wantFailures || stored.Disabled != test.wantDisabled {
+				t.Errorf("expected %d failures and disabled %t, got %d and %t", test.wantFailures, test.wantDisabled,
+					stored.Failures, stored.Disabled)
+			}
+		})
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.10:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[fd00::1]:80", false},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := publicAddressOnly("tcp", test.address, nil)
+			if (err == nil) != test.public {
+				t.Errorf("expected public %t, got error %v", test.public, err)
+			}
+		})
+	}
+}
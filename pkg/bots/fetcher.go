@@ -3,9 +3,7 @@ package bots
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/silh/trakind/pkg/db"
 	"github.com/silh/trakind/pkg/domain"
 	"io"
@@ -60,66 +58,60 @@ func (f *Fetcher) Track(ctx context.Context) {
 
 func (f *Fetcher) trackOnce() {
 	log := log.With("location", f.location.Code)
-	subscriptions := f.getSubscriptionsFiltered()
-	if len(subscriptions) == 0 {
+	group := db.SubscriptionGroup{Location: f.location.Code, Action: f.action.Code, PeopleCount: f.peopleCount}
+	if polling.IsPaused(f.location.Code) {
+		log.Debug("Polling is paused, not fetching")
+		f.skip(group)
+		return
+	}
+	if db.Subscriptions.CountForGroup(group) == 0 && !f.bot.publisher.wants(group) && !f.bot.webhooks.wantsAll() {
 		log.Debug("No subscribers, not fetching")
+		f.skip(group)
 		return
 	}
 	datesResponse, err := f.getDates(f.path)
 	if err != nil {
 		log.Warnw("Error fetching dates", "path", f.path, "err", err)
+		polling.RecordFailure(f.location.Code, time.Now(), err)
 		return
 	}
+	now := time.Now()
+	polling.RecordSuccess(f.location.Code, now)
 	windows := datesResponse.Data
+	polling.RecordWindows(group, windows, now)
+	history.record(group, windows, now)
+	appearances.record(group, windows, now)
+	f.bot.publisher.publish(group, windows)
+	f.bot.webhooks.observe(group, windows)
 	if len(windows) == 0 {
 		return
 	}
 	log.Debugw("Windows available!", "count", len(windows))
 	firstAvailableWindow := windows[0]
-	for _, subscription := range subscriptions {
-		// we only need to check the first one as it's the earliest
-		if subscription.Matches(firstAvailableWindow) {
-			msgText := fmt.Sprintf(
-				"A slot is available for %s at %s on %s at %s and %d more.",
-				f.action.Name,
-				f.location.Name,
-				&firstAvailableWindow.Date,
-				&firstAvailableWindow.StartTime,
-				countAdditionalWindows(subscription, windows),
-			)
-			if _, err := f.bot.API.Send(tg.NewMessage(int64(subscription.ChatID), msgText)); err != nil {
-				log.Warnw("Failed to send notification", "chat", subscription.ChatID, "err", err)
-				// Remove subscription in case of tgError
-				var respErr *tg.Error
-				if errors.As(err, &respErr) {
-					if err := db.Subscriptions.RemoveFromLocation(f.location.Code, subscription); err != nil {
-						log.Warnw("Failed to delete subscription", "chat", subscription.ChatID, "err", err)
-					} else {
-						log.Infow("Deleted subscription for inactive user", "chat", subscription.ChatID)
-					}
-				}
-			}
-		}
+	// we only need to check the first one as it's the earliest
+	for _, subscription := range db.Subscriptions.Matching(group, firstAvailableWindow) {
+		text := fmt.Sprintf(
+			"A slot is available for %s at %s on %s at %s and %d more.",
+			f.action.Name,
+			f.location.Name,
+			&firstAvailableWindow.Date,
+			&firstAvailableWindow.StartTime,
+			countAdditionalWindows(subscription, windows),
+		)
+		f.bot.notify(Notification{
+			ChatID:         subscription.ChatID,
+			SubscriptionID: subscription.ID,
+			Subject:        fmt.Sprintf("IND slot available for %s at %s", f.action.Name, f.location.Name),
+			Text:           text,
+		})
 	}
 }
 
-// getSubscriptionsFiltered returns only subscriptions that match current fetchers action and peopleCount.
-// TODO move this to DB
-func (f *Fetcher) getSubscriptionsFiltered() []domain.Subscription {
-	log := log.With("location", f.location.Code)
-	subscriptions, err := db.Subscriptions.GetForLocation(f.location.Code)
-	if err != nil {
-		log.Warnw("Could not retrieve subscriptions", "err", err)
-		return nil
-	}
-	filtered := make([]domain.Subscription, 0, len(subscriptions))
-	for _, subscription := range subscriptions {
-		if subscription.Action == f.action.Code &&
-			subscription.PeopleCount == f.peopleCount { // this check was previously in domain.Subscription.Matches
-			filtered = append(filtered, subscription)
-		}
-	}
-	return filtered
+// skip forgets what the previous poll of the group found, it's outdated by the time polling resumes.
+func (f *Fetcher) skip(group db.SubscriptionGroup) {
+	polling.ForgetWindows(group)
+	f.bot.webhooks.forget(group)
+	appearances.forget(group)
 }
 
 func (f *Fetcher) getDates(path string) (domain.DatesResponse, error) {
@@ -5,14 +5,27 @@ import (
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/silh/trakind/pkg/domain"
 	"go.uber.org/zap"
+	"time"
 )
 
+// FSM keeps the conversation with a chat. It's not safe for concurrent use, each FSM is owned by a single worker of
+// the dispatcher.
 type FSM struct {
 	chatID domain.ChatID
 	log    *zap.SugaredLogger
 	bot    *Bot
 
 	state State
+	// finished is set when the conversation is over and the FSM can be forgotten.
+	finished bool
+	// lastActivity is when the chat sent the last update, conversations idle for ConversationTimeout expire.
+	lastActivity time.Time
+	// saved is set when the conversation is stored in db.Conversations.
+	saved bool
+	// userID is the user who started the conversation with the last command, in groups only their answers count.
+	userID int64
+	// replyTo is the last message of userID, in groups keyboards are sent as replies to it.
+	replyTo int
 }
 
 func NewFSM(chatID domain.ChatID, bot *Bot) *FSM {
@@ -46,12 +59,26 @@ var commandHandlingState = &CommandHandlingState{commands: map[string]State{
 	"stop":      stopCommandState,
 	"track":     whichActionState,
 	"stoptrack": stopTrackCommandState,
+	"cancel":    cancelCommandState,
+	"help":      helpCommandState,
+	"email":     emailCommandState,
+	"webhook":   webhookCommandState,
+	"token":     tokenCommandState,
+	"calendar":  calendarCommandState,
+	"admin":     adminCommandState,
 }}
 var startCommandState = &StartCommandState{}
 var stopCommandState = &StopCommandState{}
 var doneState = &DoneState{}
 var whichActionState = &WhichActionState{}
 var stopTrackCommandState = &StopTrackCommandState{}
+var adminCommandState = &AdminCommandState{}
+var cancelCommandState = &CancelCommandState{}
+var helpCommandState = &HelpCommandState{}
+var emailCommandState = &EmailCommandState{}
+var webhookCommandState = &WebhookCommandState{}
+var tokenCommandState = &TokenCommandState{}
+var calendarCommandState = &CalendarCommandState{}
 
 func newMessage(chatId domain.ChatID, text string) tg.MessageConfig {
 	message := tg.NewMessage(int64(chatId), text)
@@ -0,0 +1,97 @@
+package bots
+
+import (
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/domain"
+	"strings"
+)
+
+// trackingCommands change tracking of a chat, in groups only admins can use them.
+var trackingCommands = map[string]struct{}{
+	"start":     {},
+	"track":     {},
+	"stoptrack": {},
+	"cancel":    {},
+	"email":     {},
+	"webhook":   {},
+	"token":     {},
+}
+
+// isGroupChat tells whether the chat is a group or a supergroup, Telegram gives them negative IDs.
+func isGroupChat(chatID domain.ChatID) bool {
+	return chatID < 0
+}
+
+// addressedToOtherBot tells whether the message is a command addressed to another bot, e.g. /track@other_bot.
+func (b *Bot) addressedToOtherBot(msg *tg.Message) bool {
+	command := msg.CommandWithAt()
+	i := strings.Index(command, "@")
+	return i != -1 && !strings.EqualFold(command[i+1:], b.API.Self.UserName)
+}
+
+// canChangeTracking tells whether the sender of the message may change tracking of the chat. Anyone can in a private
+// chat, only admins can in a group.
+func (b *Bot) canChangeTracking(msg *tg.Message) bool {
+	if !isGroupChat(domain.ChatID(msg.Chat.ID)) {
+		return true
+	}
+	if msg.SenderChat != nil && msg.SenderChat.ID == msg.Chat.ID {
+		return true // an anonymous admin writing on behalf of the group
+	}
+	if msg.From == nil {
+		return false
+	}
+	member, err := b.API.GetChatMember(tg.GetChatMemberConfig{ChatConfigWithUser: tg.ChatConfigWithUser{
+		ChatID: msg.Chat.ID,
+		UserID: msg.From.ID,
+	}})
+	if err != nil {
+		log.Warnw("Failed to check group member", "chat", msg.Chat.ID, "user", msg.From.ID, "err", err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// senderID returns the user who sent the message, 0 if unknown.
+func senderID(msg *tg.Message) int64 {
+	if msg.From == nil {
+		return 0
+	}
+	return msg.From.ID
+}
+
+// personal makes a keyboard sent to a group visible only to the user the conversation is with, the message becomes
+// a reply to the last message of that user.
+func (fsm *FSM) personal(msg tg.MessageConfig) tg.MessageConfig {
+	if !isGroupChat(fsm.chatID) || fsm.replyTo == 0 {
+		return msg
+	}
+	msg.ReplyToMessageID = fsm.replyTo
+	msg.AllowSendingWithoutReply = true
+	switch markup := msg.ReplyMarkup.(type) {
+	case tg.ReplyKeyboardMarkup:
+		markup.Selective = true
+		msg.ReplyMarkup = markup
+	case tg.ReplyKeyboardRemove:
+		markup.Selective = true
+		msg.ReplyMarkup = markup
+	}
+	return msg
+}
+
+// accepts tells whether the FSM handles the message. In groups, messages other than commands are ignored outside of
+// conversations, and a conversation only accepts messages from the user who started it. Tracking commands of other
+// users are accepted too, as long as they are allowed to use them.
+func (fsm *FSM) accepts(msg *tg.Message) bool {
+	if !isGroupChat(fsm.chatID) {
+		return true
+	}
+	if fsm.state == initialState {
+		return msg.IsCommand()
+	}
+	if senderID(msg) == fsm.userID {
+		return true
+	}
+	_, tracking := trackingCommands[msg.Command()]
+	return tracking
+}
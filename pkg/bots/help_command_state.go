@@ -0,0 +1,71 @@
+package bots
+
+import (
+	"errors"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+)
+
+// commandHelp describes a command in /help.
+type commandHelp struct {
+	command     string
+	description string
+}
+
+var publicCommandsHelp = []commandHelp{
+	{"/start", "introduction and setting up tracking"},
+	{"/track", "track appointments of a type at a location for a number of people"},
+	{"/stoptrack", "stop all tracking, no more notifications will be sent"},
+	{"/cancel", "leave the current conversation without saving anything"},
+	{"/webhook", "show, set (/webhook https://example.com/hook, private chats only) or remove (/webhook off) the URL"},
+	{"/token", "get a token of the HTTP API in a private chat (/token revoke revokes it)"},
+	{"/help", "this message"},
+}
+
+var emailCommandsHelp = []commandHelp{
+	{"/email", "show, set (/email you@example.com) or remove (/email off) the address that gets notifications too"},
+}
+
+var calendarCommandsHelp = []commandHelp{
+	{"/calendar", "get private calendar feed URLs that list open slots of your subscriptions"},
+}
+
+var adminCommandsHelp = []commandHelp{
+	{"/admin", "operator commands, send it without arguments to list them"},
+}
+
+// HelpCommandState describes every command available in the chat.
+type HelpCommandState struct {
+}
+
+func (s HelpCommandState) String() string {
+	return "HelpCommandState"
+}
+
+func (s HelpCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	var sb strings.Builder
+	sb.WriteString("Commands:\n")
+	writeCommandsHelp(&sb, publicCommandsHelp)
+	if bot.email != nil {
+		writeCommandsHelp(&sb, emailCommandsHelp)
+	}
+	if bot.calendar != nil {
+		writeCommandsHelp(&sb, calendarCommandsHelp)
+	}
+	if bot.IsAdmin(fsm.chatID) {
+		writeCommandsHelp(&sb, adminCommandsHelp)
+	}
+	sb.WriteString("\nWhile setting up tracking use \"" + backButton + "\" to change the previous answer.")
+	bot.SendAndForget(newMessage(fsm.chatID, sb.String()), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s HelpCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+func writeCommandsHelp(sb *strings.Builder, commands []commandHelp) {
+	for _, command := range commands {
+		sb.WriteString(command.command + " - " + command.description + "\n")
+	}
+}
@@ -0,0 +1,65 @@
+package bots
+
+import (
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+const (
+	// HistoryRetention is how long earliest dates are kept.
+	HistoryRetention = 14 * 24 * time.Hour
+	// historyPruneInterval is how often earliest dates older than HistoryRetention are deleted.
+	historyPruneInterval = time.Hour
+)
+
+// availabilityHistory stores the earliest date of every fetched group per hour. A date is written when the hour
+// starts and again only if it changes within the hour.
+type availabilityHistory struct {
+	mu        sync.Mutex
+	last      map[db.SubscriptionGroup]domain.EarliestDate
+	lastPrune time.Time
+}
+
+// history is shared by all fetchers.
+var history = &availabilityHistory{last: map[db.SubscriptionGroup]domain.EarliestDate{}}
+
+func (h *availabilityHistory) record(group db.SubscriptionGroup, windows []domain.TimeWindow, now time.Time) {
+	earliest := domain.EarliestDate{
+		Location:    group.Location,
+		Action:      group.Action,
+		PeopleCount: group.PeopleCount,
+		Hour:        now.UTC().Truncate(time.Hour),
+	}
+	if len(windows) > 0 {
+		earliest.Date = windows[0].Date // windows are ordered by time
+	}
+	h.mu.Lock()
+	last, ok := h.last[group]
+	unchanged := ok && last.Hour.Equal(earliest.Hour) && time.Time(last.Date).Equal(time.Time(earliest.Date))
+	h.last[group] = earliest
+	prune := now.Sub(h.lastPrune) >= historyPruneInterval
+	if prune {
+		h.lastPrune = now
+	}
+	h.mu.Unlock()
+	if !unchanged {
+		if err := db.AvailabilityHistory.Save(earliest); err != nil {
+			log.Warnw("Failed to store earliest date", "location", group.Location, "err", err)
+		}
+	}
+	if prune {
+		removed, err := db.AvailabilityHistory.RemoveBefore(now.Add(-HistoryRetention))
+		if err != nil {
+			log.Warnw("Failed to delete old earliest dates", "err", err)
+		} else if removed > 0 {
+			log.Debugw("Deleted old earliest dates", "count", removed)
+		}
+	}
+}
+
+// FetchHealth returns how fetching of the location goes.
+func FetchHealth(locationCode string) LocationHealth {
+	return polling.Health(locationCode)
+}
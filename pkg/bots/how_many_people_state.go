@@ -14,8 +14,7 @@ const (
 )
 
 type HowManyPeopleState struct {
-	action   domain.Action
-	location domain.Location
+	trackAnswers
 }
 
 func (s *HowManyPeopleState) String() string {
@@ -23,9 +22,13 @@ func (s *HowManyPeopleState) String() string {
 }
 
 func (s *HowManyPeopleState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
-	toSend := newMessage(fsm.chatID, "How many people?")
+	var previous string
+	if s.peopleCount > 0 {
+		previous = strconv.Itoa(s.peopleCount)
+	}
+	toSend := newMessage(fsm.chatID, withPrevious("How many people?", previous))
 	toSend.ReplyMarkup = s.makeReplyKeyboard()
-	if _, err := bot.API.Send(toSend); err != nil {
+	if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 		fsm.To(doneState, msg)
 	}
@@ -36,17 +39,23 @@ func (s *HowManyPeopleState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 		fsm.To(commandHandlingState, msg)
 		return nil
 	}
+	if msg.Text == backButton {
+		fsm.To(&WhichLocationState{s.trackAnswers}, msg)
+		return nil
+	}
 	peopleCount, replyText, ok := s.getPeopleCount(msg)
 	if !ok {
 		toSend := newMessage(fsm.chatID, replyText)
 		toSend.ReplyMarkup = s.makeReplyKeyboard()
-		if _, err := bot.API.Send(toSend); err != nil {
+		if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 			fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 			fsm.To(doneState, msg)
 		}
 		return nil
 	}
-	nextState := &BeforeDateState{action: s.action, location: s.location, peopleCount: peopleCount}
+	answers := s.trackAnswers
+	answers.peopleCount = peopleCount
+	nextState := &BeforeDateState{answers}
 	fsm.To(nextState, msg)
 	return nil
 }
@@ -76,5 +85,5 @@ func (s *HowManyPeopleState) makeReplyKeyboard() tg.ReplyKeyboardMarkup {
 	for i := 0; i < 6; i++ {
 		row[i] = tg.NewKeyboardButton(strconv.Itoa(i + 1))
 	}
-	return tg.NewOneTimeReplyKeyboard(row)
+	return withBackButton(tg.NewOneTimeReplyKeyboard(row))
 }
@@ -0,0 +1,49 @@
+package bots
+
+import (
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+)
+
+// Notification tells a chat about time windows that match one of its subscriptions.
+type Notification struct {
+	ChatID         domain.ChatID
+	SubscriptionID domain.SubscriptionID
+	// Subject is a one line summary, used where a channel has a separate title like an email.
+	Subject string
+	Text    string
+}
+
+// Notifier delivers notifications through one channel, e.g. Telegram or email. Notify must not block for long, it's
+// called from the fetch loop.
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// telegramNotifier queues notifications in the outbox that sends them to the chat itself.
+type telegramNotifier struct {
+	outbox *Outbox
+}
+
+func (n telegramNotifier) Notify(notification Notification) error {
+	return n.outbox.Enqueue(domain.OutgoingMessage{
+		ChatID:         notification.ChatID,
+		Text:           notification.Text,
+		SubscriptionID: notification.SubscriptionID,
+	})
+}
+
+// AddNotifier makes the bot deliver notifications through one more channel, Telegram is always used.
+func (b *Bot) AddNotifier(notifier Notifier) {
+	b.notifiers = append(b.notifiers, notifier)
+}
+
+// notify passes the notification to all notifiers.
+func (b *Bot) notify(notification Notification) {
+	for _, notifier := range b.notifiers {
+		if err := notifier.Notify(notification); err != nil {
+			notifierType := fmt.Sprintf("%T", notifier)
+			log.Errorw("Failed to notify", "chat", notification.ChatID, "notifier", notifierType, "err", err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package bots
+
+import (
+	"context"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+const (
+	// maxInFlight limits the number of messages that are sent at the same time.
+	maxInFlight = 8
+	// networkRetryDelay is how long a chat waits after a message didn't reach Telegram at all.
+	networkRetryDelay = 5 * time.Second
+	// idleCheckInterval is how often an empty outbox looks for work it might have missed.
+	idleCheckInterval = time.Minute
+)
+
+// Outbox delivers queued messages within Telegram rate limits. Messages are stored until they are delivered, so the
+// ones left after a restart are delivered on the next start. Messages to the same chat are delivered one at a time
+// in the order they were queued.
+type Outbox struct {
+	bot *Bot
+
+	mu      sync.Mutex
+	pending []domain.OutgoingMessage
+	sending map[domain.ChatID]struct{}
+	wake    chan struct{}
+}
+
+func newOutbox(bot *Bot) *Outbox {
+	return &Outbox{
+		bot:     bot,
+		sending: map[domain.ChatID]struct{}{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores the message, it's delivered by Run. A notification that still waits for delivery is replaced by a
+// newer one for the same subscription, so slow delivery doesn't pile up outdated notifications.
+func (o *Outbox) Enqueue(message domain.OutgoingMessage) error {
+	message, err := db.Outbox.Add(message)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	replaced := o.replacePending(message)
+	if replaced == nil {
+		o.pending = append(o.pending, message)
+	}
+	o.mu.Unlock()
+	if replaced != nil {
+		if err := db.Outbox.Remove(replaced.ID); err != nil {
+			log.Warnw("Failed to remove replaced message", "message", replaced.ID, "err", err)
+		}
+	}
+	o.signal()
+	return nil
+}
+
+// replacePending puts the message in place of a pending notification of the same subscription and returns the
+// replaced one. Must be called with the lock held.
+func (o *Outbox) replacePending(message domain.OutgoingMessage) *domain.OutgoingMessage {
+	if message.SubscriptionID == "" {
+		return nil
+	}
+	for i, pending := range o.pending {
+		if pending.SubscriptionID == message.SubscriptionID {
+			o.pending[i] = message
+			return &pending
+		}
+	}
+	return nil
+}
+
+// Run delivers queued messages until ctx is done. Messages left from the previous run go first.
+func (o *Outbox) Run(ctx context.Context) {
+	o.loadStored()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, maxInFlight)
+	for {
+		message, wait := o.next(time.Now())
+		if message == nil {
+			if wait == 0 {
+				wait = idleCheckInterval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			o.requeue(*message)
+			return
+		}
+		wg.Add(1)
+		go func(message domain.OutgoingMessage) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			o.deliver(message)
+		}(*message)
+	}
+}
+
+// Len returns the number of messages waiting for delivery.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending) + len(o.sending)
+}
+
+func (o *Outbox) loadStored() {
+	stored, err := db.Outbox.All()
+	if err != nil {
+		log.Errorw("Failed to load undelivered messages", "err", err)
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queued := make(map[domain.OutgoingMessageID]struct{}, len(o.pending))
+	for _, message := range o.pending {
+		queued[message.ID] = struct{}{}
+	}
+	var previous []domain.OutgoingMessage
+	for _, message := range stored {
+		if _, ok := queued[message.ID]; !ok {
+			previous = append(previous, message)
+		}
+	}
+	o.pending = append(previous, o.pending...)
+	if len(previous) > 0 {
+		log.Infow("Undelivered messages loaded", "count", len(previous))
+	}
+}
+
+// next takes the first message that can be sent now. If there is none, returns how long to wait for one.
+func (o *Outbox) next(now time.Time) (*domain.OutgoingMessage, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return nil, 0
+	}
+	if wait := o.bot.limiter.globalDelay(now); wait > 0 {
+		return nil, wait
+	}
+	minWait := idleCheckInterval
+	for i, message := range o.pending {
+		if _, ok := o.sending[message.ChatID]; ok {
+			continue // keeps the order of messages to the same chat
+		}
+		wait := o.bot.limiter.reserve(message.ChatID, now)
+		if wait == 0 {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			o.sending[message.ChatID] = struct{}{}
+			return &message, 0
+		}
+		if wait < minWait {
+			minWait = wait
+		}
+	}
+	return nil, minWait
+}
+
+// requeue puts the message back in front of newer messages.
+func (o *Outbox) requeue(message domain.OutgoingMessage) {
+	o.mu.Lock()
+	delete(o.sending, message.ChatID)
+	i := 0
+	for i < len(o.pending) && !message.CreatedAt.Before(o.pending[i].CreatedAt) {
+		i++
+	}
+	o.pending = append(o.pending, domain.OutgoingMessage{})
+	copy(o.pending[i+1:], o.pending[i:])
+	o.pending[i] = message
+	o.mu.Unlock()
+	o.signal()
+}
+
+func (o *Outbox) deliver(message domain.OutgoingMessage) {
+	chatID := message.ChatID
+	log := log.With("chat", chatID, "message", message.ID)
+	_, err := o.bot.API.Send(tg.NewMessage(int64(message.ChatID), message.Text))
+	switch classifyError(err) {
+	case errorNone:
+		o.delivered(message)
+	case errorRateLimited, errorTemporary:
+		log.Warnw("Failed to send message, will retry", "retryAfter", retryAfter(err), "err", err)
+		o.bot.limiter.block(message.ChatID, retryAfter(err))
+		o.requeue(message)
+		return
+	case errorChatMigrated:
+		o.bot.moveChat(chatID, migratedTo(err))
+		redirected := message
+		redirected.ID = "" // stored as a new message, the stored one to the old chat is removed below
+		redirected.ChatID = migratedTo(err)
+		if err := o.Enqueue(redirected); err != nil {
+			log.Errorw("Failed to queue message to migrated chat", "err", err)
+		}
+	case errorChatGone:
+		o.bot.forgetChat(chatID, err)
+	case errorBadRequest:
+		o.bot.alertAdmins("Telegram refused a message", chatID, err)
+	}
+	if err := db.Outbox.Remove(message.ID); err != nil {
+		log.Errorw("Failed to remove message from outbox", "err", err)
+	}
+	o.mu.Lock()
+	delete(o.sending, chatID)
+	o.mu.Unlock()
+	o.signal()
+}
+
+func (o *Outbox) delivered(message domain.OutgoingMessage) {
+	if message.SubscriptionID == "" {
+		return
+	}
+	if err := db.Subscriptions.MarkNotified(message.SubscriptionID, time.Now()); err != nil {
+		log.Warnw("Failed to mark subscription notified", "id", message.SubscriptionID, "err", err)
+	}
+}
+
+// dropChat removes pending messages to the chat and returns their number.
+func (o *Outbox) dropChat(chatID domain.ChatID) int {
+	o.mu.Lock()
+	var dropped []domain.OutgoingMessage
+	kept := o.pending[:0]
+	for _, message := range o.pending {
+		if message.ChatID == chatID {
+			dropped = append(dropped, message)
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	o.pending = kept
+	o.mu.Unlock()
+	for _, message := range dropped {
+		if err := db.Outbox.Remove(message.ID); err != nil {
+			log.Warnw("Failed to remove message from outbox", "message", message.ID, "err", err)
+		}
+	}
+	return len(dropped)
+}
+
+// moveChat redirects pending messages of a group to the supergroup it became. Stored copies keep the old chat, after
+// a restart they are redirected again when Telegram reports the migration.
+func (o *Outbox) moveChat(from, to domain.ChatID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.pending {
+		if o.pending[i].ChatID == from {
+			o.pending[i].ChatID = to
+		}
+	}
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
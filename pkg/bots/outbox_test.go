@@ -0,0 +1,85 @@
+package bots
+
+import (
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTelegramStub returns a bot API of a stub server. sendMessage is answered with the JSON that respond returns for
+// the chat, other methods get an empty successful response.
+func newTelegramStub(t *testing.T, respond func(chatID string) string) *tg.BotAPI {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"trakind","username":"trakind_bot"}}`)
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			fmt.Fprint(w, respond(r.FormValue("chat_id")))
+		default:
+			fmt.Fprint(w, `{"ok":true,"result":true}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	api, err := tg.NewBotAPIWithClient("token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("failed to create bot API: %v", err)
+	}
+	return api
+}
+
+// openMemoryStorage makes an empty in-memory storage the one used by the package level stores.
+func openMemoryStorage(t *testing.T) {
+	t.Helper()
+	if err := db.Open(db.Config{Backend: db.BackendMemory}); err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+func TestOutboxRedirectsMessageToMigratedChat(t *testing.T) {
+	openMemoryStorage(t)
+	const group, supergroup = domain.ChatID(-1), domain.ChatID(-1001)
+	api := newTelegramStub(t, func(chatID string) string {
+		if chatID == fmt.Sprint(group) {
+			return fmt.Sprintf(`{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a `+
+				`supergroup chat","parameters":{"migrate_to_chat_id":%d}}`, supergroup)
+		}
+		return `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":` + chatID + `}}}`
+	})
+	bot := &Bot{API: api, limiter: newRateLimiter()}
+	bot.outbox = newOutbox(bot)
+
+	if err := bot.outbox.Enqueue(domain.OutgoingMessage{ChatID: group, Text: "New slot"}); err != nil {
+		t.Fatalf("failed to queue message: %v", err)
+	}
+	message, _ := bot.outbox.next(time.Now())
+	if message == nil {
+		t.Fatal("expected a message to send")
+	}
+	bot.outbox.deliver(*message)
+
+	stored, err := db.Outbox.All()
+	if err != nil {
+		t.Fatalf("failed to get stored messages: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(stored))
+	}
+	if stored[0].ChatID != supergroup || stored[0].Text != "New slot" {
+		t.Errorf("expected the message to chat %d to be stored, got %+v", supergroup, stored[0])
+	}
+	if stored[0].ID == message.ID {
+		t.Errorf("expected the redirected message to be stored as a new one, got ID %s again", message.ID)
+	}
+	if pending := bot.outbox.Len(); pending != 1 {
+		t.Errorf("expected 1 pending message, got %d", pending)
+	}
+}
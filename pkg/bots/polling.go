@@ -0,0 +1,160 @@
+package bots
+
+import (
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LocationHealth describes how fetching of a location goes.
+type LocationHealth struct {
+	Paused              bool
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           string
+	ConsecutiveFailures int
+}
+
+// Availability is what the latest successful fetch of a group found.
+type Availability struct {
+	Group     db.SubscriptionGroup
+	Windows   []domain.TimeWindow
+	CheckedAt time.Time
+}
+
+// Polling lets operators pause fetching of locations and keeps track of fetch results. Safe for concurrent use.
+type Polling struct {
+	mu           sync.RWMutex
+	locations    map[string]*LocationHealth
+	availability map[db.SubscriptionGroup]Availability
+}
+
+// polling is shared by all fetchers.
+var polling = NewPolling()
+
+func NewPolling() *Polling {
+	return &Polling{
+		locations:    map[string]*LocationHealth{},
+		availability: map[db.SubscriptionGroup]Availability{},
+	}
+}
+
+// LatestAvailability returns the latest fetch results of all groups that are polled and were fetched since the start.
+func LatestAvailability() []Availability {
+	return polling.Availability()
+}
+
+// IsPolled tells if any group of the location and the action is polled and was fetched since the start.
+func IsPolled(locationCode, actionCode string) bool {
+	return polling.Polled(locationCode, actionCode)
+}
+
+// Pause stops fetching of the location until Resume is called. Pauses are kept only in memory and end on restart.
+func (p *Polling) Pause(locationCode string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health(locationCode).Paused = true
+}
+
+// Resume restarts fetching of the location.
+func (p *Polling) Resume(locationCode string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health(locationCode).Paused = false
+}
+
+func (p *Polling) IsPaused(locationCode string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	health, ok := p.locations[locationCode]
+	return ok && health.Paused
+}
+
+// RecordSuccess marks that the location was fetched successfully.
+func (p *Polling) RecordSuccess(locationCode string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	health := p.health(locationCode)
+	health.LastSuccess = at
+	health.ConsecutiveFailures = 0
+}
+
+// RecordFailure marks that fetching of the location failed.
+func (p *Polling) RecordFailure(locationCode string, at time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	health := p.health(locationCode)
+	health.LastFailure = at
+	health.LastError = err.Error()
+	health.ConsecutiveFailures++
+}
+
+// RecordWindows remembers the windows the latest fetch of the group found.
+func (p *Polling) RecordWindows(group db.SubscriptionGroup, windows []domain.TimeWindow, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.availability[group] = Availability{Group: group, Windows: windows, CheckedAt: at}
+}
+
+// ForgetWindows drops the latest fetch result of the group when it isn't polled anymore, so that it isn't shown as
+// current.
+func (p *Polling) ForgetWindows(group db.SubscriptionGroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.availability, group)
+}
+
+// Polled tells if there is a fetch result of any group of the location and the action.
+func (p *Polling) Polled(locationCode, actionCode string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for group := range p.availability {
+		if group.Location == locationCode && group.Action == actionCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Availability returns the latest fetch results ordered by location, action and number of people.
+func (p *Polling) Availability() []Availability {
+	p.mu.RLock()
+	result := make([]Availability, 0, len(p.availability))
+	for _, availability := range p.availability {
+		result = append(result, availability)
+	}
+	p.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Group, result[j].Group
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		if a.Action != b.Action {
+			return a.Action < b.Action
+		}
+		return a.PeopleCount < b.PeopleCount
+	})
+	return result
+}
+
+// Health returns a copy of the state of the location.
+func (p *Polling) Health(locationCode string) LocationHealth {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if health, ok := p.locations[locationCode]; ok {
+		return *health
+	}
+	return LocationHealth{}
+}
+
+// health returns the state of the location, creating it if needed. Must be called with the lock held.
+func (p *Polling) health(locationCode string) *LocationHealth {
+	health, ok := p.locations[locationCode]
+	if !ok {
+		health = &LocationHealth{}
+		p.locations[locationCode] = health
+	}
+	return health
+}
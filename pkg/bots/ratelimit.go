@@ -0,0 +1,140 @@
+package bots
+
+import (
+	"context"
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+// Telegram allows about 30 messages per second in total and about one message per second to the same chat,
+// short bursts are tolerated.
+const (
+	globalRate  = 30
+	globalBurst = 30
+	chatRate    = 1
+	chatBurst   = 3
+	// maxIdleChatBuckets is the number of chat buckets after which full ones are forgotten.
+	maxIdleChatBuckets = 10000
+)
+
+// tokenBucket allows rate events per second with bursts up to burst events.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// blockedUntil is set when Telegram asks to retry later.
+	blockedUntil time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// delay returns how long to wait until a token is available.
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.refill(now)
+	if now.Before(b.blockedUntil) {
+		return b.blockedUntil.Sub(now)
+	}
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst && !now.Before(b.blockedUntil)
+}
+
+// rateLimiter combines the global token bucket with a bucket per chat. Safe for concurrent use.
+type rateLimiter struct {
+	mu     sync.Mutex
+	global *tokenBucket
+	chats  map[domain.ChatID]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		global: newTokenBucket(globalRate, globalBurst, time.Now()),
+		chats:  map[domain.ChatID]*tokenBucket{},
+	}
+}
+
+// reserve takes a token for a message to the chat if both the global and the chat buckets have one. Otherwise,
+// nothing is taken and the time to wait is returned.
+func (l *rateLimiter) reserve(chatID domain.ChatID, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if wait := l.global.delay(now); wait > 0 {
+		return wait
+	}
+	chat := l.chat(chatID, now)
+	if wait := chat.delay(now); wait > 0 {
+		return wait
+	}
+	l.global.tokens--
+	chat.tokens--
+	return 0
+}
+
+// globalDelay returns how long to wait until any chat can get a message.
+func (l *rateLimiter) globalDelay(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.global.delay(now)
+}
+
+// wait blocks until a message to the chat can be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, chatID domain.ChatID) error {
+	for {
+		wait := l.reserve(chatID, time.Now())
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// block stops messages to the chat for the duration, Telegram returns it with 429 Too Many Requests.
+func (l *rateLimiter) block(chatID domain.ChatID, duration time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	chat := l.chat(chatID, now)
+	chat.blockedUntil = now.Add(duration)
+}
+
+// chat returns the bucket of the chat, creating it if needed. Must be called with the lock held.
+func (l *rateLimiter) chat(chatID domain.ChatID, now time.Time) *tokenBucket {
+	bucket, ok := l.chats[chatID]
+	if ok {
+		return bucket
+	}
+	if len(l.chats) >= maxIdleChatBuckets {
+		for id, other := range l.chats {
+			if other.full(now) {
+				delete(l.chats, id) // a full bucket is the same as a new one
+			}
+		}
+	}
+	bucket = newTokenBucket(chatRate, chatBurst, now)
+	l.chats[chatID] = bucket
+	return bucket
+}
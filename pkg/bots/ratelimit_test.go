@@ -0,0 +1,110 @@
+package bots
+
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketDelay(t *testing.T) {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		taken   int
+		blocked time.Duration
+		after   time.Duration
+		want    time.Duration
+	}{
+		{"full", 1, 3, 0, 0, 0, 0},
+		{"within burst", 1, 3, 2, 0, 0, 0},
+		{"burst used", 1, 3, 3, 0, 0, time.Second},
+		{"partly refilled", 1, 3, 3, 0, 400 * time.Millisecond, 600 * time.Millisecond},
+		{"refilled", 1, 3, 3, 0, time.Second, 0},
+		{"faster rate", 30, 30, 30, 0, 0, time.Second / 30},
+		{"blocked", 1, 3, 0, 5 * time.Second, time.Second, 4 * time.Second},
+		{"block is over", 1, 3, 0, 5 * time.Second, 5 * time.Second, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := newTokenBucket(test.rate, test.burst, start)
+			bucket.tokens -= float64(test.taken)
+			bucket.blockedUntil = start.Add(test.blocked)
+			got := bucket.delay(start.Add(test.after))
+			if diff := got - test.want; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("expected delay %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestTokenBucketNeverExceedsBurst(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(chatRate, chatBurst, start)
+	bucket.refill(start.Add(time.Hour))
+	if bucket.tokens != chatBurst {
+		t.Errorf("expected %d tokens after a long pause, got %f", chatBurst, bucket.tokens)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		// chats get a message each, in order, all at start
+		chats []domain.ChatID
+		// wantWaiting is the number of messages that had to wait
+		wantWaiting int
+	}{
+		{"one chat within burst", []domain.ChatID{1, 1, 1}, 0},
+		{"one chat over burst", []domain.ChatID{1, 1, 1, 1, 1}, 2},
+		{"chats have own buckets", []domain.ChatID{1, 1, 1, 2, 2, 2}, 0},
+		{"global limit", manyChats(globalBurst + 5), 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := &rateLimiter{
+				global: newTokenBucket(globalRate, globalBurst, start),
+				chats:  map[domain.ChatID]*tokenBucket{},
+			}
+			waiting := 0
+			for _, chatID := range test.chats {
+				if limiter.reserve(chatID, start) > 0 {
+					waiting++
+				}
+			}
+			if waiting != test.wantWaiting {
+				t.Errorf("expected %d messages to wait, got %d", test.wantWaiting, waiting)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWaitingTakesNothing(t *testing.T) {
+	start := time.Now()
+	limiter := &rateLimiter{
+		global: newTokenBucket(globalRate, globalBurst, start),
+		chats:  map[domain.ChatID]*tokenBucket{},
+	}
+	for i := 0; i < chatBurst; i++ {
+		limiter.reserve(1, start)
+	}
+	if wait := limiter.reserve(1, start); wait != time.Second/chatRate {
+		t.Errorf("expected to wait %s, got %s", time.Second/chatRate, wait)
+	}
+	if tokens := limiter.global.tokens; tokens != globalBurst-chatBurst {
+		t.Errorf("expected a waiting message to take no global token, %f are left", tokens)
+	}
+	if wait := limiter.reserve(1, start.Add(time.Second)); wait != 0 {
+		t.Errorf("expected a token after a second, got wait %s", wait)
+	}
+}
+
+func manyChats(n int) []domain.ChatID {
+	chats := make([]domain.ChatID, n)
+	for i := range chats {
+		chats[i] = domain.ChatID(i + 1)
+	}
+	return chats
+}
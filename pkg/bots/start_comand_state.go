@@ -2,10 +2,16 @@ package bots
 
 import (
 	"errors"
+	"fmt"
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/silh/trakind/pkg/db"
+	"strconv"
+	"strings"
 )
 
+// startPayloadSeparator separates answers in the /start payload, e.g. "BIO_AM_2" from t.me/<bot>?start=BIO_AM_2.
+const startPayloadSeparator = "_"
+
 type StartCommandState struct {
 }
 
@@ -13,11 +19,71 @@ func (s StartCommandState) String() string {
 	return "StartCommandState"
 }
 
-func (s StartCommandState) To(fsm *FSM, msg *tg.Message, _ *Bot) {
-	db.Users.Increment()
-	fsm.To(doneState, msg)
+func (s StartCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	bot.SendAndForget(newMessage(fsm.chatID, welcomeText()), fsm.log)
+	answers := parseStartPayload(msg.CommandArguments())
+	switch {
+	case answers.peopleCount > 0:
+		fsm.To(&BeforeDateState{answers}, msg)
+	case answers.location.Code != "":
+		fsm.To(&HowManyPeopleState{answers}, msg)
+	case answers.action.Code != "":
+		fsm.To(&WhichLocationState{answers}, msg)
+	default:
+		fsm.To(&WhichActionState{}, msg)
+	}
 }
 
 func (s StartCommandState) Do(*FSM, *tg.Message, *Bot) error {
 	panic(errors.New("should not be called"))
 }
+
+// parseStartPayload reads answers of the tracking wizard from the payload of /start: action code, location code and
+// number of people separated by "_", later parts are optional. Parsing stops at the first invalid part.
+func parseStartPayload(payload string) trackAnswers {
+	var answers trackAnswers
+	parts := strings.Split(strings.TrimSpace(payload), startPayloadSeparator)
+	if len(parts) < 1 || parts[0] == "" {
+		return answers
+	}
+	action, ok := db.ActionForCode(strings.ToUpper(parts[0]))
+	if !ok {
+		return answers
+	}
+	answers.action = action
+	if len(parts) < 2 {
+		return answers
+	}
+	location, ok := db.LocationForCode(parts[1])
+	if !ok {
+		location, ok = db.LocationForCode(strings.ToUpper(parts[1]))
+	}
+	if _, offered := location.AvailableActions[action]; !ok || !offered {
+		return answers
+	}
+	answers.location = location
+	if len(parts) < 3 {
+		return answers
+	}
+	peopleCount, err := strconv.Atoi(parts[2])
+	if err != nil || peopleCount < minPeople || peopleCount > maxPeople {
+		return answers
+	}
+	answers.peopleCount = peopleCount
+	return answers
+}
+
+// welcomeText explains what the bot does and what it can track.
+func welcomeText() string {
+	var sb strings.Builder
+	sb.WriteString("Hi! I watch IND appointment slots and send you a message as soon as a time window opens.\n\n")
+	for _, action := range db.SortedActions() {
+		sb.WriteString(fmt.Sprintf("%s is available at:\n", action.Name))
+		for _, location := range db.LocationsForAction(action) {
+			sb.WriteString(fmt.Sprintf("• %s\n", location.Name))
+		}
+		sb.WriteRune('\n')
+	}
+	sb.WriteString("Let's set up tracking, you can go back at any step or /cancel. Send /help to see all commands.")
+	return sb.String()
+}
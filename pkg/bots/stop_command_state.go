@@ -14,23 +14,14 @@ func (s StopCommandState) String() string {
 }
 
 func (s StopCommandState) To(fsm *FSM, _ *tg.Message, _ *Bot) {
-	for _, location := range db.Locations {
-		subscriptions, err := db.Subscriptions.GetForLocation(location.Code)
-		if err != nil {
-			fsm.log.Warnw("Failed to get subscriptions", "location", location.Code, "err", err)
-			continue
-		}
-		for _, subscription := range subscriptions {
-			if subscription.ChatID == fsm.chatID {
-				if err := db.Subscriptions.RemoveFromLocation(location.Code, subscription); err != nil {
-					log.Warnw("Failed to delete subscription", "err", err)
-					continue
-				}
-				fsm.log.Infow("Unsubscribed", "location", location.Code)
-			}
-		}
+	removed, err := db.Subscriptions.RemoveForChat(fsm.chatID)
+	if err != nil {
+		fsm.log.Warnw("Failed to delete subscriptions", "err", err)
 	}
-	db.Users.Decrement()
+	for _, subscription := range removed {
+		fsm.log.Infow("Unsubscribed", "location", subscription.Location)
+	}
+	db.UpdateSubscriptionCount(fsm.chatID)
 	fsm.log.Info("Stopped")
 	fsm.To(doneState, nil)
 }
@@ -0,0 +1,174 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorClass tells what to do after Telegram failed to deliver a message.
+type errorClass int
+
+const (
+	errorNone errorClass = iota
+	// errorTemporary means the message didn't reach Telegram or Telegram failed on its side, it's worth retrying.
+	errorTemporary
+	// errorRateLimited means Telegram asked to retry after ResponseParameters.RetryAfter seconds.
+	errorRateLimited
+	// errorChatGone means the bot can't write to the chat anymore: it was blocked, kicked or the chat doesn't exist.
+	errorChatGone
+	// errorChatMigrated means the group became a supergroup with ResponseParameters.MigrateToChatID.
+	errorChatMigrated
+	// errorBadRequest means the message itself is wrong, retrying won't help.
+	errorBadRequest
+)
+
+// errBotKicked is the reason to forget a chat that removed the bot.
+var errBotKicked = errors.New("the bot was removed from the chat")
+
+// alertInterval limits how often operators are alerted about the same problem.
+const alertInterval = 10 * time.Minute
+
+// classifyError returns the class of an error returned by Telegram API.
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errorNone
+	}
+	var tgErr *tg.Error
+	if !errors.As(err, &tgErr) {
+		return errorTemporary
+	}
+	description := strings.ToLower(tgErr.Message)
+	switch {
+	case tgErr.RetryAfter > 0 || tgErr.Code == http.StatusTooManyRequests:
+		return errorRateLimited
+	case tgErr.MigrateToChatID != 0:
+		return errorChatMigrated
+	case tgErr.Code == http.StatusForbidden,
+		strings.Contains(description, "chat not found"),
+		strings.Contains(description, "user not found"),
+		strings.Contains(description, "user is deactivated"):
+		return errorChatGone
+	case tgErr.Code >= http.StatusInternalServerError:
+		return errorTemporary
+	default:
+		return errorBadRequest
+	}
+}
+
+// retryAfter returns how long Telegram asked to wait before the next attempt.
+func retryAfter(err error) time.Duration {
+	var tgErr *tg.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second
+	}
+	return networkRetryDelay
+}
+
+// migratedTo returns the new ID of a chat that became a supergroup.
+func migratedTo(err error) domain.ChatID {
+	var tgErr *tg.Error
+	if errors.As(err, &tgErr) {
+		return domain.ChatID(tgErr.MigrateToChatID)
+	}
+	return 0
+}
+
+// forgetChat removes everything the bot keeps for a chat it can't write to anymore.
+func (b *Bot) forgetChat(chatID domain.ChatID, reason error) {
+	removed, err := db.Subscriptions.RemoveForChat(chatID)
+	if err != nil {
+		log.Warnw("Failed to delete subscriptions of unavailable chat", "chat", chatID, "err", err)
+	}
+	dropped := b.outbox.dropChat(chatID)
+	if err := db.EventWebhooks.Remove(chatID); err != nil {
+		log.Warnw("Failed to delete webhook of unavailable chat", "chat", chatID, "err", err)
+	}
+	if _, err := db.APITokens.RemoveForChat(chatID); err != nil {
+		log.Warnw("Failed to delete API tokens of unavailable chat", "chat", chatID, "err", err)
+	}
+	db.UpdateSubscriptionCount(chatID)
+	markBlocked(chatID)
+	log.Infow("Forgot unavailable chat",
+		"chat", chatID, "reason", reason, "subscriptions", len(removed), "messages", dropped)
+}
+
+// moveChat moves subscriptions of a group to the supergroup it became.
+func (b *Bot) moveChat(from, to domain.ChatID) {
+	subscriptions, err := db.Subscriptions.GetForChat(from)
+	if err != nil {
+		log.Warnw("Failed to get subscriptions of migrated chat", "chat", from, "err", err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		subscription.ChatID = to
+		if err := db.Subscriptions.Update(subscription); err != nil {
+			log.Warnw("Failed to move subscription to migrated chat", "id", subscription.ID, "err", err)
+		}
+	}
+	b.outbox.moveChat(from, to)
+	if webhook, err := db.EventWebhooks.Get(from); err == nil {
+		webhook.ChatID = to
+		if err := db.EventWebhooks.Save(webhook); err == nil {
+			err = db.EventWebhooks.Remove(from)
+		}
+		if err != nil {
+			log.Warnw("Failed to move webhook to migrated chat", "chat", from, "err", err)
+		}
+	}
+	tokens, err := db.APITokens.RemoveForChat(from)
+	if err != nil {
+		log.Warnw("Failed to get API tokens of migrated chat", "chat", from, "err", err)
+	}
+	for _, token := range tokens {
+		token.ChatID = to
+		if err := db.APITokens.Save(token); err != nil {
+			log.Warnw("Failed to move API token to migrated chat", "chat", from, "err", err)
+		}
+	}
+	db.UpdateSubscriptionCount(from)
+	db.UpdateSubscriptionCount(to)
+	log.Infow("Chat migrated to supergroup", "from", from, "to", to, "subscriptions", len(subscriptions))
+}
+
+// alerts remembers when operators were last alerted about a problem.
+var alerts = struct {
+	sync.Mutex
+	sent map[string]time.Time
+}{sent: map[string]time.Time{}}
+
+// alertAdmins tells operators about a problem they need to look at. The same problem is reported at most once per
+// alertInterval whatever chat it happened in, so a problem of all chats doesn't send an alert per chat. The chat is
+// only logged.
+func (b *Bot) alertAdmins(problem string, chatID domain.ChatID, err error) {
+	log.Errorw(problem, "chat", chatID, "err", err)
+	if !alertDue(problem+": "+err.Error(), time.Now()) {
+		return
+	}
+	for adminID := range b.admins {
+		b.SendAndForget(newMessage(adminID, fmt.Sprintf("Alert: %s: %s", problem, err)), log)
+	}
+}
+
+// alertDue tells if the problem wasn't reported during the last alertInterval and remembers that it's reported now.
+// Problems reported earlier than that are forgotten.
+func alertDue(problem string, now time.Time) bool {
+	alerts.Lock()
+	defer alerts.Unlock()
+	for reported, at := range alerts.sent {
+		if now.Sub(at) >= alertInterval {
+			delete(alerts.sent, reported)
+		}
+	}
+	if _, ok := alerts.sent[problem]; ok {
+		return false
+	}
+	alerts.sent[problem] = now
+	return true
+}
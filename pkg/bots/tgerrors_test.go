@@ -0,0 +1,101 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"no error", nil, errorNone},
+		{"network", errors.New("connection reset by peer"), errorTemporary},
+		{"wrapped network", fmt.Errorf("send: %w", errors.New("timeout")), errorTemporary},
+		{
+			"retry after",
+			&tg.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests: retry after 5",
+				ResponseParameters: tg.ResponseParameters{RetryAfter: 5}},
+			errorRateLimited,
+		},
+		{"too many requests", &tg.Error{Code: http.StatusTooManyRequests}, errorRateLimited},
+		{
+			"migrated",
+			&tg.Error{Code: http.StatusBadRequest, Message: "Bad Request: group chat was upgraded to a supergroup chat",
+				ResponseParameters: tg.ResponseParameters{MigrateToChatID: -1001}},
+			errorChatMigrated,
+		},
+		{"blocked", &tg.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was blocked"}, errorChatGone},
+		{"kicked", &tg.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was kicked"}, errorChatGone},
+		{"chat not found", &tg.Error{Code: http.StatusBadRequest, Message: "Bad Request: chat not found"}, errorChatGone},
+		{"user not found", &tg.Error{Code: http.StatusBadRequest, Message: "Bad Request: USER NOT FOUND"}, errorChatGone},
+		{"deactivated", &tg.Error{Code: http.StatusForbidden, Message: "Forbidden: user is deactivated"}, errorChatGone},
+		{"server error", &tg.Error{Code: http.StatusBadGateway, Message: "Bad Gateway"}, errorTemporary},
+		{
+			"bad request",
+			&tg.Error{Code: http.StatusBadRequest, Message: "Bad Request: can't parse entities"},
+			errorBadRequest,
+		},
+		{"wrapped bad request", fmt.Errorf("send: %w", &tg.Error{Code: http.StatusBadRequest}), errorBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classifyError(test.err); got != test.want {
+				t.Errorf("expected class %d, got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"asked by Telegram", &tg.Error{ResponseParameters: tg.ResponseParameters{RetryAfter: 3}}, 3 * time.Second},
+		{"not asked", &tg.Error{Code: http.StatusBadGateway}, networkRetryDelay},
+		{"network", errors.New("timeout"), networkRetryDelay},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryAfter(test.err); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAlertDue(t *testing.T) {
+	alerts.Lock()
+	alerts.sent = map[string]time.Time{}
+	alerts.Unlock()
+	now := time.Now()
+	tests := []struct {
+		name    string
+		problem string
+		at      time.Time
+		want    bool
+	}{
+		{"first", "Telegram refused a message: Bad Request", now, true},
+		{"repeated", "Telegram refused a message: Bad Request", now.Add(time.Minute), false},
+		{"another problem", "Failed to post to a channel: Forbidden", now.Add(time.Minute), true},
+		{"after the interval", "Telegram refused a message: Bad Request", now.Add(alertInterval + time.Minute), true},
+	}
+	for _, test := range tests {
+		if got := alertDue(test.problem, test.at); got != test.want {
+			t.Errorf("%s: expected %t, got %t", test.name, test.want, got)
+		}
+	}
+	alerts.Lock()
+	defer alerts.Unlock()
+	if len(alerts.sent) != 1 {
+		t.Errorf("expected old problems to be forgotten, %d are remembered", len(alerts.sent))
+	}
+}
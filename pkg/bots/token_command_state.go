@@ -0,0 +1,79 @@
+package bots
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix makes tokens easy to recognize, e.g. by secret scanners.
+const apiTokenPrefix = "trk_"
+
+// TokenCommandState issues a token of the HTTP API for the chat or revokes it. A chat has at most one token, a new one
+// replaces the previous. Tokens are issued only in private chats, in a group every member would see the token and
+// could manage subscriptions of the group with it. Groups can only revoke a token issued before.
+type TokenCommandState struct {
+}
+
+func (s TokenCommandState) String() string {
+	return "TokenCommandState"
+}
+
+func (s TokenCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	var text string
+	switch arg := strings.TrimSpace(msg.CommandArguments()); {
+	case isGroupChat(fsm.chatID) && arg != "revoke":
+		text = "Tokens are issued only in a private chat with the bot."
+	case arg == "":
+		text = issueToken(fsm)
+	case arg == "revoke":
+		if _, err := db.APITokens.RemoveForChat(fsm.chatID); err != nil {
+			fsm.log.Errorw("Failed to revoke API tokens", "err", err)
+			text = "Failed to revoke the token, please try again later."
+		} else {
+			text = "Token revoked, it can't be used anymore."
+		}
+	default:
+		text = "Send /token to get a token of the HTTP API or /token revoke to revoke it."
+	}
+	bot.SendAndForget(fsm.personal(newMessage(fsm.chatID, text)), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s TokenCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+// issueToken replaces tokens of the chat with a new one and returns the reply.
+func issueToken(fsm *FSM) string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fsm.log.Errorw("Failed to generate API token", "err", err)
+		return "Failed to issue a token, please try again later."
+	}
+	token := apiTokenPrefix + hex.EncodeToString(secret)
+	if _, err := db.APITokens.RemoveForChat(fsm.chatID); err != nil {
+		fsm.log.Errorw("Failed to revoke API tokens", "err", err)
+		return "Failed to issue a token, please try again later."
+	}
+	err := db.APITokens.Save(domain.APIToken{Hash: HashAPIToken(token), ChatID: fsm.chatID, CreatedAt: time.Now()})
+	if err != nil {
+		fsm.log.Errorw("Failed to store API token", "err", err)
+		return "Failed to issue a token, please try again later."
+	}
+	fsm.log.Infow("API token issued")
+	return "Your token of the HTTP API, keep it private. It replaces the previous one:\n" + token + "\n\n" +
+		"Send it in \"Authorization: Bearer <token>\" header. /token revoke revokes it."
+}
+
+// HashAPIToken returns the hash a token is stored by.
+func HashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
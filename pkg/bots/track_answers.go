@@ -0,0 +1,69 @@
+package bots
+
+import (
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+)
+
+// backButton returns to the previous step of the tracking wizard.
+const backButton = "« Back"
+
+// trackAnswers are the answers collected by the tracking wizard. Steps keep answers to later steps too, so that after
+// going back they are suggested again.
+type trackAnswers struct {
+	action      domain.Action
+	location    domain.Location
+	peopleCount int
+}
+
+// withAction returns answers with the action replaced. The location is kept only if it offers the action.
+func (a trackAnswers) withAction(action domain.Action) trackAnswers {
+	a.action = action
+	if _, ok := a.location.AvailableActions[action]; !ok {
+		a.location = domain.Location{}
+	}
+	return a
+}
+
+// toConversation returns the answers as a saved conversation in the state.
+func (a trackAnswers) toConversation(state State) domain.Conversation {
+	return domain.Conversation{
+		State:       state.String(),
+		Action:      a.action.Code,
+		Location:    a.location.Code,
+		PeopleCount: a.peopleCount,
+	}
+}
+
+// restoreAnswers returns answers of a saved conversation.
+func restoreAnswers(conversation domain.Conversation) (trackAnswers, error) {
+	answers := trackAnswers{peopleCount: conversation.PeopleCount}
+	var ok bool
+	if conversation.Action != "" {
+		if answers.action, ok = db.ActionForCode(conversation.Action); !ok {
+			return answers, fmt.Errorf("unknown action %q", conversation.Action)
+		}
+	}
+	if conversation.Location != "" {
+		if answers.location, ok = db.LocationForCode(conversation.Location); !ok {
+			return answers, fmt.Errorf("unknown location %q", conversation.Location)
+		}
+	}
+	return answers, nil
+}
+
+// withPrevious adds the previous answer to the question of a step the user came back to.
+func withPrevious(question, previous string) string {
+	if previous == "" {
+		return question
+	}
+	return fmt.Sprintf("%s Previously you chose %s.", question, previous)
+}
+
+// withBackButton adds a row with the back button to the keyboard.
+func withBackButton(keyboard tg.ReplyKeyboardMarkup) tg.ReplyKeyboardMarkup {
+	keyboard.Keyboard = append(keyboard.Keyboard, tg.NewKeyboardButtonRow(tg.NewKeyboardButton(backButton)))
+	return keyboard
+}
@@ -0,0 +1,34 @@
+package bots
+
+import (
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"time"
+)
+
+// recordActivity updates the user registry with a message from the chat.
+func recordActivity(chatID domain.ChatID, msg *tg.Message) {
+	if msg == nil {
+		return
+	}
+	var language string
+	if msg.From != nil {
+		language = msg.From.LanguageCode
+	}
+	user, err := db.Users.Seen(chatID, language, time.Now())
+	if err != nil {
+		log.Warnw("Failed to record user activity", "chat", chatID, "err", err)
+		return
+	}
+	if user.FirstSeen.Equal(user.LastActive) {
+		log.Infow("New user", "chat", chatID, "language", language)
+	}
+}
+
+// markBlocked remembers that the bot can't write to the chat anymore.
+func markBlocked(chatID domain.ChatID) {
+	if err := db.Users.SetBlocked(chatID, true); err != nil {
+		log.Warnw("Failed to mark user blocked", "chat", chatID, "err", err)
+	}
+}
@@ -0,0 +1,151 @@
+package bots
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// secretTokenHeader carries the secret token set with setWebhook in every webhook request.
+	secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+	// webhookShutdownTimeout limits how long requests that are being handled delay the stop.
+	webhookShutdownTimeout = 5 * time.Second
+)
+
+// WebhookConfig describes how Telegram delivers updates to the bot in webhook mode.
+type WebhookConfig struct {
+	// URL is the public address Telegram sends updates to, e.g. the address of a reverse proxy.
+	URL string
+	// ListenAddr is the address the embedded server listens on.
+	ListenAddr string
+	// SecretToken must be sent by Telegram with every update, requests without it are rejected.
+	SecretToken string
+	// CertFile and KeyFile enable HTTPS, plain HTTP is served if they are empty.
+	CertFile string
+	KeyFile  string
+}
+
+// RunWebhook starts the embedded server receiving updates from Telegram, registers it with setWebhook and processes
+// updates. When Stop is called the webhook is deleted, the server is shut down and the function returns.
+func (b *Bot) RunWebhook(cfg WebhookConfig) error {
+	if cfg.URL == "" || cfg.SecretToken == "" {
+		return errors.New("webhook URL and secret token are required")
+	}
+	b.registerCommands()
+	receiver := newWebhookReceiver(b.API, cfg.SecretToken)
+	server := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           receiver,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		if cfg.CertFile != "" || cfg.KeyFile != "" {
+			err = server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+	params := tg.Params{}
+	params["url"] = cfg.URL
+	params["secret_token"] = cfg.SecretToken
+	if _, err := b.API.MakeRequest("setWebhook", params); err != nil {
+		server.Close()
+		return err
+	}
+	log.Infow("Webhook set", "url", cfg.URL, "listen", cfg.ListenAddr)
+	b.setStop(func() {
+		if _, err := b.API.Request(tg.DeleteWebhookConfig{}); err != nil {
+			log.Warnw("Failed to delete webhook", "err", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+		receiver.stop()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnw("Failed to shut down webhook server", "err", err)
+		}
+		receiver.close()
+	})
+	var serveFailure error
+	go func() {
+		if err := <-serveErr; err != nil {
+			serveFailure = err
+			b.Stop()
+		}
+	}()
+	b.handleUpdates(receiver.updates)
+	return serveFailure // updates are closed by Stop, which happens after serveFailure is set
+}
+
+// webhookReceiver accepts updates from Telegram that carry the secret token and passes them to the updates channel.
+type webhookReceiver struct {
+	api         *tg.BotAPI
+	secretToken string
+	updates     chan tg.Update
+	stopping    chan struct{}
+
+	mu     sync.RWMutex // held for reading while an update is being passed, so the channel isn't closed under it
+	closed bool
+}
+
+func newWebhookReceiver(api *tg.BotAPI, secretToken string) *webhookReceiver {
+	return &webhookReceiver{
+		api:         api,
+		secretToken: secretToken,
+		updates:     make(chan tg.Update, api.Buffer),
+		stopping:    make(chan struct{}),
+	}
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(secretTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(r.secretToken)) != 1 {
+		log.Warnw("Webhook request with wrong secret token", "remote", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	update, err := r.api.HandleUpdate(req)
+	if err != nil {
+		log.Warnw("Bad webhook request", "remote", req.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case r.updates <- *update:
+		w.WriteHeader(http.StatusOK)
+	case <-r.stopping:
+		// Telegram sends the update again after the bot is back
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+	case <-req.Context().Done():
+		// Telegram gave up waiting and will send the update again
+	}
+}
+
+// stop makes requests that wait for the updates channel give up.
+func (r *webhookReceiver) stop() {
+	close(r.stopping)
+}
+
+// close closes the updates channel once no request is passing an update.
+func (r *webhookReceiver) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	close(r.updates)
+}
@@ -0,0 +1,98 @@
+package bots
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WebhookCommandState shows, sets or removes the URL that receives events about new time windows. Webhooks are set
+// only in private chats, the reply has the signing secret and events of a group shouldn't go where one member wants.
+// Groups can only remove a webhook set before.
+type WebhookCommandState struct {
+}
+
+func (s WebhookCommandState) String() string {
+	return "WebhookCommandState"
+}
+
+func (s WebhookCommandState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
+	var text string
+	switch arg := strings.TrimSpace(msg.CommandArguments()); {
+	case isGroupChat(fsm.chatID) && arg != "off":
+		text = "Webhooks can be set only in a private chat with the bot."
+	case arg == "":
+		text = webhookStatus(fsm)
+	case arg == "off":
+		if err := db.EventWebhooks.Remove(fsm.chatID); err != nil {
+			fsm.log.Errorw("Failed to remove webhook", "err", err)
+			text = "Failed to remove the webhook."
+		} else {
+			text = "Webhook removed, no more events will be sent."
+		}
+	default:
+		text = setWebhook(fsm, arg)
+	}
+	reply := newMessage(fsm.chatID, text)
+	reply.DisableWebPagePreview = true
+	bot.SendAndForget(fsm.personal(reply), fsm.log)
+	fsm.To(doneState, msg)
+}
+
+func (s WebhookCommandState) Do(*FSM, *tg.Message, *Bot) error {
+	panic(errors.New("should never be called"))
+}
+
+// setWebhook stores the URL with a new secret and returns the reply.
+func setWebhook(fsm *FSM, rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Sprintf("%q is not a valid https URL.", rawURL)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fsm.log.Errorw("Failed to generate webhook secret", "err", err)
+		return "Failed to set the webhook, please try again later."
+	}
+	webhook := domain.EventWebhook{
+		ChatID:    fsm.chatID,
+		URL:       parsed.String(),
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}
+	if err := db.EventWebhooks.Save(webhook); err != nil {
+		fsm.log.Errorw("Failed to store webhook", "err", err)
+		return "Failed to set the webhook, please try again later."
+	}
+	fsm.log.Infow("Webhook set")
+	return fmt.Sprintf(
+		"Webhook set. %s will receive a POST with a JSON event for every new slot matching your tracking.\n\n"+
+			"Requests are signed with this secret, keep it private:\n%s\n\n"+
+			"%s header is \"sha256=\" and hex encoded HMAC-SHA256 of the %s header, a dot and the body.",
+		webhook.URL, webhook.Secret, WebhookSignatureHeader, WebhookTimestampHeader,
+	)
+}
+
+// webhookStatus describes the webhook of the chat and how to change it.
+func webhookStatus(fsm *FSM) string {
+	const usage = "Send /webhook https://example.com/hook to set it, /webhook off to remove."
+	webhook, err := db.EventWebhooks.Get(fsm.chatID)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return "No webhook is set. " + usage
+	case err != nil:
+		fsm.log.Warnw("Failed to get webhook", "err", err)
+		return "Failed to get the webhook, please try again later."
+	case webhook.Disabled:
+		return fmt.Sprintf("Webhook %s was disabled after %d failed deliveries. %s", webhook.URL, webhook.Failures, usage)
+	default:
+		return fmt.Sprintf("Events are sent to %s. %s", webhook.URL, usage)
+	}
+}
@@ -7,6 +7,7 @@ import (
 )
 
 type WhichActionState struct {
+	trackAnswers
 }
 
 func (s *WhichActionState) String() string {
@@ -14,9 +15,12 @@ func (s *WhichActionState) String() string {
 }
 
 func (s *WhichActionState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
-	toSend := newMessage(fsm.chatID, "Which type of appointment are you interested in?")
+	toSend := newMessage(
+		fsm.chatID,
+		withPrevious("Which type of appointment are you interested in?", s.action.Name),
+	)
 	toSend.ReplyMarkup = s.makeReplyKeyboard()
-	if _, err := bot.API.Send(toSend); err != nil {
+	if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 		fsm.To(doneState, msg)
 	}
@@ -37,13 +41,13 @@ func (s *WhichActionState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 			),
 		)
 		toSend.ReplyMarkup = s.makeReplyKeyboard()
-		if _, err := bot.API.Send(toSend); err != nil {
+		if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 			fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 			fsm.To(doneState, msg)
 		}
 		return nil
 	}
-	nextState := &WhichLocationState{action: action}
+	nextState := &WhichLocationState{s.withAction(action)}
 	fsm.To(nextState, msg)
 	return nil
 }
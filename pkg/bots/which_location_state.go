@@ -4,11 +4,10 @@ import (
 	"fmt"
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/silh/trakind/pkg/db"
-	"github.com/silh/trakind/pkg/domain"
 )
 
 type WhichLocationState struct {
-	action domain.Action
+	trackAnswers
 }
 
 func (s *WhichLocationState) String() string {
@@ -16,9 +15,9 @@ func (s *WhichLocationState) String() string {
 }
 
 func (s *WhichLocationState) To(fsm *FSM, msg *tg.Message, bot *Bot) {
-	toSend := newMessage(fsm.chatID, "Which location?")
+	toSend := newMessage(fsm.chatID, withPrevious("Which location?", s.location.Name))
 	toSend.ReplyMarkup = s.makeReplyKeyboard()
-	if _, err := bot.API.Send(toSend); err != nil {
+	if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 		fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 		fsm.To(doneState, msg)
 	}
@@ -29,6 +28,10 @@ func (s *WhichLocationState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 		fsm.To(commandHandlingState, msg)
 		return nil
 	}
+	if msg.Text == backButton {
+		fsm.To(&WhichActionState{s.trackAnswers}, msg)
+		return nil
+	}
 	location, ok := db.LocationForName(msg.Text)
 	if !ok {
 		toSend := newMessage(
@@ -39,13 +42,15 @@ func (s *WhichLocationState) Do(fsm *FSM, msg *tg.Message, bot *Bot) error {
 			),
 		)
 		toSend.ReplyMarkup = s.makeReplyKeyboard()
-		if _, err := bot.API.Send(toSend); err != nil {
+		if _, err := bot.Send(fsm.personal(toSend)); err != nil {
 			fsm.log.Warnw("Failed to send message", "msg", toSend.Text, "err", err)
 			fsm.To(doneState, msg)
 		}
 		return nil
 	}
-	nextState := &HowManyPeopleState{action: s.action, location: location}
+	answers := s.trackAnswers
+	answers.location = location
+	nextState := &HowManyPeopleState{answers}
 	fsm.To(nextState, msg)
 	return nil
 }
@@ -63,5 +68,5 @@ func (s *WhichLocationState) makeReplyKeyboard() tg.ReplyKeyboardMarkup {
 			}
 		}
 	}
-	return tg.NewOneTimeReplyKeyboard(rows...)
+	return withBackButton(tg.NewOneTimeReplyKeyboard(rows...))
 }
@@ -1,6 +1,9 @@
 package db
 
-import "github.com/silh/trakind/pkg/domain"
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"sort"
+)
 
 // Actions is a set of all supported actions.
 var Actions = map[domain.Action]struct{}{
@@ -17,3 +20,25 @@ func ActionForName(name string) (domain.Action, bool) {
 	}
 	return domain.Action{}, false
 }
+
+// ActionForCode returns action by its IND product key.
+func ActionForCode(code string) (domain.Action, bool) {
+	for action := range Actions {
+		if action.Code == code {
+			return action, true
+		}
+	}
+	return domain.Action{}, false
+}
+
+// SortedActions returns all supported actions ordered by name.
+func SortedActions() []domain.Action {
+	actions := make([]domain.Action, 0, len(Actions))
+	for action := range Actions {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Name < actions[j].Name
+	})
+	return actions
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+)
+
+const apiTokensBucket = "apiTokens"
+
+// APITokens is the API token store of the storage opened with Open.
+var APITokens APITokenStore
+
+// APITokenStore keeps hashes of tokens of the HTTP API.
+type APITokenStore interface {
+	// Save stores the token, replacing the one with the same hash.
+	Save(token domain.APIToken) error
+	// Get returns the token with the hash or ErrNotFound.
+	Get(hash string) (domain.APIToken, error)
+	// RemoveForChat deletes all tokens of the chat and returns them.
+	RemoveForChat(chatID domain.ChatID) ([]domain.APIToken, error)
+	// All returns tokens of all chats.
+	All() ([]domain.APIToken, error)
+}
+
+// NutsAPITokensDB keeps tokens as JSON in a nutsdb bucket by their hash.
+type NutsAPITokensDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsAPITokensDB) Save(token domain.APIToken) error {
+	value, err := json.Marshal(&token)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(apiTokensBucket, []byte(token.Hash), value, TTLInfinite)
+	})
+}
+
+func (db *NutsAPITokensDB) Get(hash string) (domain.APIToken, error) {
+	var token domain.APIToken
+	return token, db.storage.View(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(apiTokensBucket, []byte(hash))
+		if isNutsNotFound(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(entry.Value, &token)
+	})
+}
+
+func (db *NutsAPITokensDB) RemoveForChat(chatID domain.ChatID) ([]domain.APIToken, error) {
+	var removed []domain.APIToken
+	return removed, db.storage.Update(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(apiTokensBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var token domain.APIToken
+			if err := json.Unmarshal(entry.Value, &token); err != nil {
+				return err
+			}
+			if token.ChatID != chatID {
+				continue
+			}
+			if err := tx.Delete(apiTokensBucket, entry.Key); err != nil {
+				return err
+			}
+			removed = append(removed, token)
+		}
+		return nil
+	})
+}
+
+func (db *NutsAPITokensDB) All() ([]domain.APIToken, error) {
+	var result []domain.APIToken
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(apiTokensBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var token domain.APIToken
+			if err := json.Unmarshal(entry.Value, &token); err != nil {
+				return err
+			}
+			result = append(result, token)
+		}
+		return nil
+	})
+}
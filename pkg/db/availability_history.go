@@ -0,0 +1,109 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+	"sort"
+	"time"
+)
+
+const availabilityHistoryBucket = "availabilityHistory"
+
+// AvailabilityHistory is the availability history store of the storage opened with Open.
+var AvailabilityHistory AvailabilityHistoryStore
+
+// AvailabilityHistoryStore keeps earliest dates of polled groups per hour.
+type AvailabilityHistoryStore interface {
+	// Save stores the earliest date, replacing the one of the same group and hour.
+	Save(earliest domain.EarliestDate) error
+	// Since returns earliest dates of hours starting at or after the time, ordered by hour.
+	Since(from time.Time) ([]domain.EarliestDate, error)
+	// RemoveBefore deletes earliest dates of hours starting before the time and returns how many were deleted.
+	RemoveBefore(before time.Time) (int, error)
+}
+
+// NutsAvailabilityHistoryDB keeps earliest dates as JSON in a nutsdb bucket. Keys start with the hour, so they are
+// ordered by time.
+type NutsAvailabilityHistoryDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsAvailabilityHistoryDB) Save(earliest domain.EarliestDate) error {
+	value, err := json.Marshal(&earliest)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(availabilityHistoryBucket, earliestDateKey(earliest), value, TTLInfinite)
+	})
+}
+
+func (db *NutsAvailabilityHistoryDB) Since(from time.Time) ([]domain.EarliestDate, error) {
+	var result []domain.EarliestDate
+	err := db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsEarliestDates(tx, func(earliest domain.EarliestDate) bool {
+			return !earliest.Hour.Before(from)
+		})
+		return err
+	})
+	sortEarliestDates(result)
+	return result, err
+}
+
+func (db *NutsAvailabilityHistoryDB) RemoveBefore(before time.Time) (int, error) {
+	var removed int
+	return removed, db.storage.Update(func(tx *nutsdb.Tx) error {
+		old, err := nutsEarliestDates(tx, func(earliest domain.EarliestDate) bool {
+			return earliest.Hour.Before(before)
+		})
+		if err != nil {
+			return err
+		}
+		for _, earliest := range old {
+			if err := tx.Delete(availabilityHistoryBucket, earliestDateKey(earliest)); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+}
+
+// nutsEarliestDates returns stored earliest dates the filter accepts.
+func nutsEarliestDates(tx *nutsdb.Tx, filter func(domain.EarliestDate) bool) ([]domain.EarliestDate, error) {
+	entries, err := tx.GetAll(availabilityHistoryBucket)
+	if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []domain.EarliestDate
+	for _, entry := range entries {
+		var earliest domain.EarliestDate
+		if err := json.Unmarshal(entry.Value, &earliest); err != nil {
+			return nil, err
+		}
+		if filter(earliest) {
+			result = append(result, earliest)
+		}
+	}
+	return result, nil
+}
+
+func earliestDateKey(earliest domain.EarliestDate) []byte {
+	return []byte(fmt.Sprintf(
+		"%s/%s/%s/%d", earliest.Hour.UTC().Format(time.RFC3339), earliest.Location, earliest.Action, earliest.PeopleCount,
+	))
+}
+
+// sortEarliestDates orders earliest dates by hour, keeping the order of the same hour stable.
+func sortEarliestDates(dates []domain.EarliestDate) {
+	sort.SliceStable(dates, func(i, j int) bool {
+		return dates[i].Hour.Before(dates[j].Hour)
+	})
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix = "trakind-"
+	snapshotSuffix = ".json.gz"
+)
+
+// BackupConfig describes scheduled snapshots of the storage.
+type BackupConfig struct {
+	Dir string
+	// Interval between snapshots, zero disables them.
+	Interval time.Duration
+	// Keep is the number of the latest snapshots that are kept, older ones are removed.
+	Keep int
+}
+
+// RunBackups takes snapshots of the storage opened with Open every configured interval until ctx is done.
+func RunBackups(ctx context.Context, cfg BackupConfig) {
+	if cfg.Interval <= 0 {
+		log.Info("Scheduled backups are disabled")
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			snapshot, err := TakeSnapshot(current)
+			if err != nil {
+				log.Errorw("Backup failed", "dir", cfg.Dir, "err", err)
+				continue
+			}
+			path, err := TakeBackup(cfg.Dir, cfg.Keep, snapshot)
+			if err != nil {
+				log.Errorw("Backup failed", "dir", cfg.Dir, "err", err)
+				continue
+			}
+			log.Infow("Backup done", "path", path)
+		}
+	}
+}
+
+// TakeBackup writes the snapshot into a new file in dir and removes the oldest snapshots so that only keep of them
+// remain. Returns the path of the new file.
+func TakeBackup(dir string, keep int, snapshot Snapshot) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := snapshotPrefix + snapshot.CreatedAt.UTC().Format("20060102T150405.000Z") + snapshotSuffix
+	path := filepath.Join(dir, name)
+	// write to a temporary file first, so that a crash never leaves a broken snapshot with a proper name
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := WriteSnapshot(tmp, snapshot); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, rotateBackups(dir, keep)
+}
+
+// ListBackups returns paths of snapshots in dir from the oldest to the latest.
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(paths) // names contain UTC timestamps, so lexical order is chronological
+	return paths, nil
+}
+
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	paths, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
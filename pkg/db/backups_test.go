@@ -0,0 +1,77 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTakeBackupRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		keep      int
+		taken     int
+		wantKept  int
+		wantFirst int
+	}{
+		{"below the limit", 3, 2, 2, 0},
+		{"at the limit", 3, 3, 3, 0},
+		{"over the limit", 2, 4, 2, 2},
+		{"no limit", 0, 4, 4, 0},
+	}
+	createdAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var paths []string
+			for i := 0; i < test.taken; i++ {
+				snapshot := Snapshot{
+					FormatVersion: snapshotFormatVersion,
+					CreatedAt:     createdAt.Add(time.Duration(i) * time.Hour),
+				}
+				path, err := TakeBackup(dir, test.keep, snapshot)
+				if err != nil {
+					t.Fatalf("failed to take backup: %v", err)
+				}
+				paths = append(paths, path)
+			}
+			kept, err := ListBackups(dir)
+			if err != nil {
+				t.Fatalf("failed to list backups: %v", err)
+			}
+			if len(kept) != test.wantKept {
+				t.Fatalf("expected %d backups, got %d", test.wantKept, len(kept))
+			}
+			for i, path := range kept {
+				if path != paths[test.wantFirst+i] {
+					t.Errorf("expected backup %d to be %s, got %s", i, paths[test.wantFirst+i], path)
+				}
+			}
+		})
+	}
+}
+
+func TestListBackupsSkipsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"notes.txt", snapshotPrefix + "broken" + snapshotSuffix + ".tmp-1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := Snapshot{FormatVersion: snapshotFormatVersion, CreatedAt: time.Now()}
+	path, err := TakeBackup(dir, 1, snapshot)
+	if err != nil {
+		t.Fatalf("failed to take backup: %v", err)
+	}
+	paths, err := ListBackups(dir)
+	if err != nil {
+		t.Fatalf("failed to list backups: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != path {
+		t.Errorf("expected only %s, got %v", path, paths)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("expected other files to stay: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+	"sort"
+	"time"
+)
+
+const (
+	broadcastsBucket        = "broadcasts"
+	broadcastProgressBucket = "broadcastProgress"
+)
+
+// Broadcasts is the broadcast store of the storage opened with Open.
+var Broadcasts BroadcastStore
+
+// BroadcastStore keeps announcements and the progress of sending them.
+type BroadcastStore interface {
+	// Add stores a new broadcast without progress. ID and creation time are assigned unless they are already set.
+	// Returns the broadcast as it was stored.
+	Add(broadcast domain.Broadcast) (domain.Broadcast, error)
+	// UpdateProgress remembers how many recipients were processed. Zero finishedAt means sending isn't finished.
+	UpdateProgress(id domain.BroadcastID, sent, failed int, finishedAt time.Time) error
+	// SetRecipients replaces the recipients of the broadcast, e.g. when a chat got another ID. Progress is kept.
+	SetRecipients(id domain.BroadcastID, recipients []domain.ChatID) error
+	// All returns all broadcasts from the oldest to the latest.
+	All() ([]domain.Broadcast, error)
+}
+
+// broadcastProgress is kept apart from the broadcast, so that frequent updates don't rewrite the list of recipients.
+type broadcastProgress struct {
+	Sent       int       `json:"sent"`
+	Failed     int       `json:"failed"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+func prepareBroadcastForAdd(broadcast *domain.Broadcast, now time.Time) {
+	if broadcast.ID == "" {
+		broadcast.ID = domain.BroadcastID(newRandomID())
+	}
+	if broadcast.CreatedAt.IsZero() {
+		broadcast.CreatedAt = now
+	}
+	broadcast.Sent = 0
+	broadcast.Failed = 0
+	broadcast.FinishedAt = time.Time{}
+}
+
+func sortBroadcasts(broadcasts []domain.Broadcast) {
+	sort.Slice(broadcasts, func(i, j int) bool {
+		return broadcasts[i].CreatedAt.Before(broadcasts[j].CreatedAt)
+	})
+}
+
+// NutsBroadcastsDB keeps broadcasts and their progress in two nutsdb buckets under the same keys.
+type NutsBroadcastsDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsBroadcastsDB) Add(broadcast domain.Broadcast) (domain.Broadcast, error) {
+	prepareBroadcastForAdd(&broadcast, time.Now())
+	value, err := json.Marshal(&broadcast)
+	if err != nil {
+		return broadcast, err
+	}
+	return broadcast, db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(broadcastsBucket, []byte(broadcast.ID), value, TTLInfinite)
+	})
+}
+
+func (db *NutsBroadcastsDB) UpdateProgress(
+	id domain.BroadcastID,
+	sent, failed int,
+	finishedAt time.Time,
+) error {
+	value, err := json.Marshal(&broadcastProgress{Sent: sent, Failed: failed, FinishedAt: finishedAt})
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(broadcastProgressBucket, []byte(id), value, TTLInfinite)
+	})
+}
+
+func (db *NutsBroadcastsDB) SetRecipients(id domain.BroadcastID, recipients []domain.ChatID) error {
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(broadcastsBucket, []byte(id))
+		if isNutsNotFound(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var broadcast domain.Broadcast
+		if err := json.Unmarshal(entry.Value, &broadcast); err != nil {
+			return err
+		}
+		broadcast.Recipients = recipients
+		value, err := json.Marshal(&broadcast)
+		if err != nil {
+			return err
+		}
+		return tx.Put(broadcastsBucket, []byte(id), value, TTLInfinite)
+	})
+}
+
+func (db *NutsBroadcastsDB) All() ([]domain.Broadcast, error) {
+	var result []domain.Broadcast
+	err := db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(broadcastsBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var broadcast domain.Broadcast
+			if err := json.Unmarshal(entry.Value, &broadcast); err != nil {
+				return err
+			}
+			progressEntry, err := tx.Get(broadcastProgressBucket, entry.Key)
+			if err != nil && !isNutsNotFound(err) {
+				return err
+			}
+			if err == nil {
+				var progress broadcastProgress
+				if err := json.Unmarshal(progressEntry.Value, &progress); err != nil {
+					return err
+				}
+				broadcast.Sent, broadcast.Failed, broadcast.FinishedAt = progress.Sent, progress.Failed, progress.FinishedAt
+			}
+			result = append(result, broadcast)
+		}
+		return nil
+	})
+	sortBroadcasts(result)
+	return result, err
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+)
+
+const channelPostsBucket = "channelPosts"
+
+// ChannelPosts is the channel post store of the storage opened with Open.
+var ChannelPosts ChannelPostStore
+
+// ChannelPostStore keeps messages about open time windows in channels, so that they are neither posted again nor
+// left unedited after a restart.
+type ChannelPostStore interface {
+	// Save stores the post, replacing the one with the same ID.
+	Save(post domain.ChannelPost) error
+	// Remove deletes the post. Removing a missing post is not an error.
+	Remove(id domain.ChannelPostID) error
+	// All returns all posts.
+	All() ([]domain.ChannelPost, error)
+}
+
+// NutsChannelPostsDB keeps channel posts as JSON in a nutsdb bucket by their ID.
+type NutsChannelPostsDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsChannelPostsDB) Save(post domain.ChannelPost) error {
+	value, err := json.Marshal(&post)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(channelPostsBucket, []byte(post.ID), value, TTLInfinite)
+	})
+}
+
+func (db *NutsChannelPostsDB) Remove(id domain.ChannelPostID) error {
+	err := db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(channelPostsBucket, []byte(id))
+	})
+	if isNutsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *NutsChannelPostsDB) All() ([]domain.ChannelPost, error) {
+	var result []domain.ChannelPost
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(channelPostsBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var post domain.ChannelPost
+			if err := json.Unmarshal(entry.Value, &post); err != nil {
+				return err
+			}
+			result = append(result, post)
+		}
+		return nil
+	})
+}
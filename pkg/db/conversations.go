@@ -0,0 +1,69 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+)
+
+const conversationsBucket = "conversations"
+
+// Conversations is the conversation store of the storage opened with Open.
+var Conversations ConversationStore
+
+// ConversationStore keeps unfinished conversations by chat, so that they survive a restart.
+type ConversationStore interface {
+	// Save stores the conversation, replacing the previous one of the chat.
+	Save(conversation domain.Conversation) error
+	// Remove deletes the conversation of the chat. Removing a missing conversation is not an error.
+	Remove(chatID domain.ChatID) error
+	// All returns conversations of all chats.
+	All() ([]domain.Conversation, error)
+}
+
+// NutsConversationsDB keeps conversations as JSON in a nutsdb bucket by chat ID.
+type NutsConversationsDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsConversationsDB) Save(conversation domain.Conversation) error {
+	value, err := json.Marshal(&conversation)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(conversationsBucket, nutsChatKey(conversation.ChatID), value, TTLInfinite)
+	})
+}
+
+func (db *NutsConversationsDB) Remove(chatID domain.ChatID) error {
+	err := db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(conversationsBucket, nutsChatKey(chatID))
+	})
+	if isNutsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *NutsConversationsDB) All() ([]domain.Conversation, error) {
+	var result []domain.Conversation
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(conversationsBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var conversation domain.Conversation
+			if err := json.Unmarshal(entry.Value, &conversation); err != nil {
+				return err
+			}
+			result = append(result, conversation)
+		}
+		return nil
+	})
+}
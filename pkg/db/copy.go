@@ -0,0 +1,20 @@
+package db
+
+import "github.com/silh/trakind/pkg/domain"
+
+// AllSubscriptions returns every subscription in the store.
+func AllSubscriptions(store SubscriptionStore) ([]domain.Subscription, error) {
+	codes, err := store.LocationCodes()
+	if err != nil {
+		return nil, err
+	}
+	var result []domain.Subscription
+	for _, code := range codes {
+		subscriptions, err := store.GetForLocation(code)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, subscriptions...)
+	}
+	return result, nil
+}
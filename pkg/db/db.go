@@ -1,14 +1,150 @@
 package db
 
-import "github.com/xujiajun/nutsdb"
+import (
+	"errors"
+	"fmt"
+	"io"
+)
 
-var db *nutsdb.DB
+// ErrNotFound is returned when requested record doesn't exist.
+var ErrNotFound = errors.New("not found")
 
-func init() {
-	opt := nutsdb.DefaultOptions
-	opt.Dir = "./db"
-	var err error
-	if db, err = nutsdb.Open(opt); err != nil {
-		log.Fatal("Failed to open DB", "err", err)
+// Names of the supported storage backends.
+const (
+	BackendNuts   = "nutsdb"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// Config selects the storage backend and the place where it keeps data.
+type Config struct {
+	Backend string
+	// Path is a directory for nutsdb and a file for SQLite. In-memory storage ignores it.
+	Path string
+	// BackupDir is where copies of the data are made before migrations.
+	BackupDir string
+}
+
+// DefaultBackupDir is used when Config.BackupDir is empty.
+const DefaultBackupDir = "./backups"
+
+// DefaultPath returns the path used by a backend when none is configured.
+func DefaultPath(backend string) string {
+	switch backend {
+	case BackendSQLite:
+		return "./trakind.sqlite"
+	case BackendMemory:
+		return ""
+	default:
+		return "./db"
+	}
+}
+
+// Storage groups all stores that are kept in the same backend.
+type Storage struct {
+	Subscriptions       SubscriptionStore
+	Users               UserStore
+	Broadcasts          BroadcastStore
+	Outbox              OutboxStore
+	Conversations       ConversationStore
+	ChannelPosts        ChannelPostStore
+	EventWebhooks       EventWebhookStore
+	APITokens           APITokenStore
+	AvailabilityHistory AvailabilityHistoryStore
+	SlotAppearances     SlotAppearanceStore
+
+	closer io.Closer
+	// backend and backup make a copy of the data at a single point in time for snapshots, backup is nil for
+	// in-memory storage.
+	backend string
+	backup  func(dir string) (string, error)
+}
+
+// OpenStorage opens the backend described by cfg. Pending schema migrations are applied.
+func OpenStorage(cfg Config) (*Storage, error) {
+	cfg = withDefaults(cfg)
+	switch cfg.Backend {
+	case BackendNuts:
+		return openNuts(cfg.Path, cfg.BackupDir)
+	case BackendSQLite:
+		return openSQLite(cfg.Path, cfg.BackupDir)
+	case BackendMemory:
+		return openMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// PlanMigrations reports migrations that would be applied when the storage described by cfg is opened. Nothing is
+// changed.
+func PlanMigrations(cfg Config) ([]MigrationReport, error) {
+	cfg = withDefaults(cfg)
+	switch cfg.Backend {
+	case BackendNuts:
+		return planNutsMigrations(cfg.Path)
+	case BackendSQLite:
+		return planSQLiteMigrations(cfg.Path)
+	case BackendMemory:
+		return nil, nil // always starts empty with the latest schema
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.Backend == "" {
+		cfg.Backend = BackendNuts
+	}
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath(cfg.Backend)
+	}
+	if cfg.BackupDir == "" {
+		cfg.BackupDir = DefaultBackupDir
+	}
+	return cfg
+}
+
+// Close releases resources held by the backend.
+func (s *Storage) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+var current *Storage
+
+// Open opens the storage described by cfg and makes its stores available as package level variables.
+func Open(cfg Config) error {
+	cfg = withDefaults(cfg)
+	storage, err := OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	indexed, err := NewIndexedSubscriptions(storage.Subscriptions)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	current = storage
+	Subscriptions = indexed
+	Users = storage.Users
+	Broadcasts = storage.Broadcasts
+	Outbox = storage.Outbox
+	Conversations = storage.Conversations
+	ChannelPosts = storage.ChannelPosts
+	EventWebhooks = storage.EventWebhooks
+	APITokens = storage.APITokens
+	AvailabilityHistory = storage.AvailabilityHistory
+	SlotAppearances = storage.SlotAppearances
+	log.Infow("Storage opened", "backend", cfg.Backend, "path", cfg.Path)
+	return nil
+}
+
+// Close closes the storage opened with Open.
+func Close() error {
+	if current == nil {
+		return nil
 	}
+	return current.Close()
 }
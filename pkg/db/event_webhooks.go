@@ -0,0 +1,85 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+)
+
+const eventWebhooksBucket = "eventWebhooks"
+
+// EventWebhooks is the event webhook store of the storage opened with Open.
+var EventWebhooks EventWebhookStore
+
+// EventWebhookStore keeps webhooks of chats, a chat has at most one.
+type EventWebhookStore interface {
+	// Save stores the webhook, replacing the one of the same chat.
+	Save(webhook domain.EventWebhook) error
+	// Remove deletes the webhook of the chat. Removing a missing webhook is not an error.
+	Remove(chatID domain.ChatID) error
+	// Get returns the webhook of the chat or ErrNotFound.
+	Get(chatID domain.ChatID) (domain.EventWebhook, error)
+	// All returns webhooks of all chats.
+	All() ([]domain.EventWebhook, error)
+}
+
+// NutsEventWebhooksDB keeps webhooks as JSON in a nutsdb bucket by chat ID.
+type NutsEventWebhooksDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsEventWebhooksDB) Save(webhook domain.EventWebhook) error {
+	value, err := json.Marshal(&webhook)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(eventWebhooksBucket, nutsChatKey(webhook.ChatID), value, TTLInfinite)
+	})
+}
+
+func (db *NutsEventWebhooksDB) Remove(chatID domain.ChatID) error {
+	err := db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(eventWebhooksBucket, nutsChatKey(chatID))
+	})
+	if isNutsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *NutsEventWebhooksDB) Get(chatID domain.ChatID) (domain.EventWebhook, error) {
+	var webhook domain.EventWebhook
+	return webhook, db.storage.View(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(eventWebhooksBucket, nutsChatKey(chatID))
+		if isNutsNotFound(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(entry.Value, &webhook)
+	})
+}
+
+func (db *NutsEventWebhooksDB) All() ([]domain.EventWebhook, error) {
+	var result []domain.EventWebhook
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(eventWebhooksBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var webhook domain.EventWebhook
+			if err := json.Unmarshal(entry.Value, &webhook); err != nil {
+				return err
+			}
+			result = append(result, webhook)
+		}
+		return nil
+	})
+}
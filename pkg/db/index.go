@@ -0,0 +1,254 @@
+package db
+
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SubscriptionGroup is a set of subscriptions that are served by the same IND request.
+type SubscriptionGroup struct {
+	Location    string
+	Action      string
+	PeopleCount int
+}
+
+// GroupOf returns the group the subscription belongs to.
+func GroupOf(subscription domain.Subscription) SubscriptionGroup {
+	return SubscriptionGroup{
+		Location:    subscription.Location,
+		Action:      subscription.Action,
+		PeopleCount: subscription.PeopleCount,
+	}
+}
+
+// IndexedSubscriptionsDB keeps all subscriptions in memory, grouped by SubscriptionGroup, and writes every change
+// through to the underlying store. Within a group subscriptions are sorted by deadline, the ones without deadline
+// first and then from the latest deadline to the earliest. This way subscriptions matching a window are always a
+// prefix of the group.
+type IndexedSubscriptionsDB struct {
+	store SubscriptionStore
+
+	mu     sync.RWMutex
+	byID   map[domain.SubscriptionID]domain.Subscription
+	groups map[SubscriptionGroup][]domain.Subscription
+}
+
+// NewIndexedSubscriptions loads all subscriptions from the store into memory.
+func NewIndexedSubscriptions(store SubscriptionStore) (*IndexedSubscriptionsDB, error) {
+	db := &IndexedSubscriptionsDB{
+		store:  store,
+		byID:   map[domain.SubscriptionID]domain.Subscription{},
+		groups: map[SubscriptionGroup][]domain.Subscription{},
+	}
+	codes, err := store.LocationCodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		subscriptions, err := store.GetForLocation(code)
+		if err != nil {
+			return nil, err
+		}
+		for _, subscription := range subscriptions {
+			db.put(subscription)
+		}
+	}
+	log.Infow("Subscriptions loaded", "count", len(db.byID), "groups", len(db.groups))
+	return db, nil
+}
+
+// CountForGroup returns number of subscriptions in the group.
+func (db *IndexedSubscriptionsDB) CountForGroup(group SubscriptionGroup) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.groups[group])
+}
+
+// Matching returns subscriptions of the group that match the window.
+func (db *IndexedSubscriptionsDB) Matching(group SubscriptionGroup, window domain.TimeWindow) []domain.Subscription {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	subscriptions := db.groups[group]
+	count := sort.Search(len(subscriptions), func(i int) bool {
+		return !subscriptions[i].Matches(window)
+	})
+	result := make([]domain.Subscription, count)
+	copy(result, subscriptions[:count])
+	return result
+}
+
+// All returns every subscription. The result is consistent, no changes happen while it's collected.
+func (db *IndexedSubscriptionsDB) All() []domain.Subscription {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.Subscription, 0, len(db.byID))
+	for _, subscription := range db.byID {
+		result = append(result, subscription)
+	}
+	return result
+}
+
+func (db *IndexedSubscriptionsDB) Add(subscription domain.Subscription) (domain.Subscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	subscription, err := db.store.Add(subscription)
+	if err != nil {
+		return subscription, err
+	}
+	db.put(subscription)
+	return subscription, nil
+}
+
+func (db *IndexedSubscriptionsDB) Get(id domain.SubscriptionID) (domain.Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	subscription, ok := db.byID[id]
+	if !ok {
+		return domain.Subscription{}, ErrNotFound
+	}
+	return subscription, nil
+}
+
+func (db *IndexedSubscriptionsDB) Update(subscription domain.Subscription) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.store.Update(subscription); err != nil {
+		return err
+	}
+	// the store sets update time, so we take it as it was stored
+	updated, err := db.store.Get(subscription.ID)
+	if err != nil {
+		return err
+	}
+	db.put(updated)
+	return nil
+}
+
+func (db *IndexedSubscriptionsDB) MarkNotified(id domain.SubscriptionID, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.store.MarkNotified(id, at); err != nil {
+		return err
+	}
+	if subscription, ok := db.byID[id]; ok {
+		subscription.LastNotifiedAt = at
+		db.put(subscription)
+	}
+	return nil
+}
+
+func (db *IndexedSubscriptionsDB) Remove(id domain.SubscriptionID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.store.Remove(id); err != nil {
+		return err
+	}
+	db.delete(id)
+	return nil
+}
+
+func (db *IndexedSubscriptionsDB) RemoveForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	removed, err := db.store.RemoveForChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	for _, subscription := range removed {
+		db.delete(subscription.ID)
+	}
+	return removed, nil
+}
+
+func (db *IndexedSubscriptionsDB) GetForLocation(locationCode string) ([]domain.Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var result []domain.Subscription
+	for group, subscriptions := range db.groups {
+		if group.Location == locationCode {
+			result = append(result, subscriptions...)
+		}
+	}
+	return result, nil
+}
+
+// GetForChat is served by the underlying store, which has its own index by chat.
+func (db *IndexedSubscriptionsDB) GetForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	return db.store.GetForChat(chatID)
+}
+
+func (db *IndexedSubscriptionsDB) CountForLocation(locationCode string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	count := 0
+	for group, subscriptions := range db.groups {
+		if group.Location == locationCode {
+			count += len(subscriptions)
+		}
+	}
+	return count, nil
+}
+
+func (db *IndexedSubscriptionsDB) LocationCodes() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	seen := map[string]struct{}{}
+	var result []string
+	for group := range db.groups {
+		if _, ok := seen[group.Location]; !ok {
+			seen[group.Location] = struct{}{}
+			result = append(result, group.Location)
+		}
+	}
+	return result, nil
+}
+
+// put adds the subscription to the index or replaces the previous version of it. Must be called with the lock held.
+func (db *IndexedSubscriptionsDB) put(subscription domain.Subscription) {
+	db.delete(subscription.ID)
+	db.byID[subscription.ID] = subscription
+	group := GroupOf(subscription)
+	subscriptions := db.groups[group]
+	i := sort.Search(len(subscriptions), func(i int) bool {
+		return deadlineBefore(subscriptions[i].TrackBefore, subscription.TrackBefore)
+	})
+	subscriptions = append(subscriptions, domain.Subscription{})
+	copy(subscriptions[i+1:], subscriptions[i:])
+	subscriptions[i] = subscription
+	db.groups[group] = subscriptions
+}
+
+// delete removes the subscription from the index. Must be called with the lock held.
+func (db *IndexedSubscriptionsDB) delete(id domain.SubscriptionID) {
+	subscription, ok := db.byID[id]
+	if !ok {
+		return
+	}
+	delete(db.byID, id)
+	group := GroupOf(subscription)
+	subscriptions := db.groups[group]
+	for i := range subscriptions {
+		if subscriptions[i].ID == id {
+			subscriptions = append(subscriptions[:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(db.groups, group)
+	} else {
+		db.groups[group] = subscriptions
+	}
+}
+
+// deadlineBefore returns true if deadline a comes earlier than b. No deadline is later than any date.
+func deadlineBefore(a, b domain.Date) bool {
+	if (a == domain.Date{}) {
+		return false
+	}
+	if (b == domain.Date{}) {
+		return true
+	}
+	return time.Time(a).Before(time.Time(b))
+}
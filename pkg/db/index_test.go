@@ -0,0 +1,111 @@
+package db
+
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func day(d int) domain.Date {
+	return domain.Date(time.Date(2026, 11, d, 0, 0, 0, 0, time.UTC))
+}
+
+// newTestIndex returns an index over an in-memory store with the subscriptions, all of group AM/BIO/1 unless
+// a subscription says otherwise.
+func newTestIndex(t *testing.T, subscriptions ...domain.Subscription) *IndexedSubscriptionsDB {
+	t.Helper()
+	index, err := NewIndexedSubscriptions(openMemory().Subscriptions)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	for _, subscription := range subscriptions {
+		if subscription.Location == "" {
+			subscription.Location, subscription.Action, subscription.PeopleCount = "AM", "BIO", 1
+		}
+		if _, err := index.Add(subscription); err != nil {
+			t.Fatalf("failed to add subscription %s: %v", subscription.ID, err)
+		}
+	}
+	return index
+}
+
+func ids(subscriptions []domain.Subscription) []domain.SubscriptionID {
+	result := make([]domain.SubscriptionID, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		result = append(result, subscription.ID)
+	}
+	return result
+}
+
+func TestIndexedSubscriptionsOrderByDeadline(t *testing.T) {
+	index := newTestIndex(t,
+		domain.Subscription{ID: "early", ChatID: 1, TrackBefore: day(5)},
+		domain.Subscription{ID: "none", ChatID: 2},
+		domain.Subscription{ID: "late", ChatID: 3, TrackBefore: day(20)},
+		domain.Subscription{ID: "middle", ChatID: 4, TrackBefore: day(10)},
+		domain.Subscription{ID: "other", ChatID: 5, Location: "DH", Action: "BIO", PeopleCount: 1},
+	)
+	group := SubscriptionGroup{Location: "AM", Action: "BIO", PeopleCount: 1}
+	want := []domain.SubscriptionID{"none", "late", "middle", "early"}
+	if got := ids(index.groups[group]); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected order %v, got %v", want, got)
+	}
+
+	middle, _ := index.Get("middle")
+	middle.TrackBefore = day(25)
+	if err := index.Update(middle); err != nil {
+		t.Fatalf("failed to update subscription: %v", err)
+	}
+	if err := index.Remove("late"); err != nil {
+		t.Fatalf("failed to remove subscription: %v", err)
+	}
+	want = []domain.SubscriptionID{"none", "middle", "early"}
+	if got := ids(index.groups[group]); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected order %v after changes, got %v", want, got)
+	}
+}
+
+func TestIndexedSubscriptionsMatching(t *testing.T) {
+	index := newTestIndex(t,
+		domain.Subscription{ID: "early", ChatID: 1, TrackBefore: day(5)},
+		domain.Subscription{ID: "none", ChatID: 2},
+		domain.Subscription{ID: "late", ChatID: 3, TrackBefore: day(20)},
+		domain.Subscription{ID: "middle", ChatID: 4, TrackBefore: day(10)},
+		domain.Subscription{ID: "persons", ChatID: 5, Location: "AM", Action: "BIO", PeopleCount: 2},
+	)
+	single := SubscriptionGroup{Location: "AM", Action: "BIO", PeopleCount: 1}
+	tests := []struct {
+		name   string
+		group  SubscriptionGroup
+		window domain.Date
+		want   []domain.SubscriptionID
+	}{
+		{"before every deadline", single, day(1), []domain.SubscriptionID{"early", "late", "middle", "none"}},
+		{"on a deadline", single, day(5), []domain.SubscriptionID{"late", "middle", "none"}},
+		{"between deadlines", single, day(15), []domain.SubscriptionID{"late", "none"}},
+		{"after every deadline", single, day(28), []domain.SubscriptionID{"none"}},
+		{
+			"another number of people",
+			SubscriptionGroup{Location: "AM", Action: "BIO", PeopleCount: 2},
+			day(28),
+			[]domain.SubscriptionID{"persons"},
+		},
+		{
+			"empty group",
+			SubscriptionGroup{Location: "DH", Action: "BIO", PeopleCount: 1},
+			day(1),
+			[]domain.SubscriptionID{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ids(index.Matching(test.group, domain.TimeWindow{Date: test.window}))
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
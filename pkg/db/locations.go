@@ -44,6 +44,16 @@ func LocationForName(name string) (domain.Location, bool) {
 	return domain.Location{}, false
 }
 
+// LocationForCode returns location by its IND code.
+func LocationForCode(code string) (domain.Location, bool) {
+	for _, location := range Locations {
+		if location.Code == code {
+			return location, true
+		}
+	}
+	return domain.Location{}, false
+}
+
 func LocationsForAction(action domain.Action) []domain.Location {
 	locations := make([]domain.Location, 0)
 	for _, location := range Locations {
@@ -0,0 +1,560 @@
+package db
+
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"sync"
+	"time"
+)
+
+func openMemory() *Storage {
+	return &Storage{
+		Subscriptions: &MemorySubscriptionsDB{
+			subscriptions: map[domain.SubscriptionID]domain.Subscription{},
+			locations:     map[string]map[domain.SubscriptionID]struct{}{},
+			chats:         map[domain.ChatID]map[domain.SubscriptionID]struct{}{},
+		},
+		Users:               &MemoryUsersDB{users: map[domain.ChatID]domain.User{}},
+		Broadcasts:          &MemoryBroadcastsDB{broadcasts: map[domain.BroadcastID]domain.Broadcast{}},
+		Outbox:              &MemoryOutboxDB{messages: map[domain.OutgoingMessageID]domain.OutgoingMessage{}},
+		Conversations:       &MemoryConversationsDB{conversations: map[domain.ChatID]domain.Conversation{}},
+		ChannelPosts:        &MemoryChannelPostsDB{posts: map[domain.ChannelPostID]domain.ChannelPost{}},
+		EventWebhooks:       &MemoryEventWebhooksDB{webhooks: map[domain.ChatID]domain.EventWebhook{}},
+		APITokens:           &MemoryAPITokensDB{tokens: map[string]domain.APIToken{}},
+		AvailabilityHistory: &MemoryAvailabilityHistoryDB{dates: map[string]domain.EarliestDate{}},
+		SlotAppearances:     &MemorySlotAppearancesDB{appearances: map[string]domain.SlotAppearance{}},
+	}
+}
+
+// MemorySubscriptionsDB keeps subscriptions only in memory, everything is lost on restart.
+// Useful for development and tests.
+type MemorySubscriptionsDB struct {
+	mu            sync.RWMutex
+	subscriptions map[domain.SubscriptionID]domain.Subscription
+	locations     map[string]map[domain.SubscriptionID]struct{}
+	chats         map[domain.ChatID]map[domain.SubscriptionID]struct{}
+}
+
+func (db *MemorySubscriptionsDB) Add(subscription domain.Subscription) (domain.Subscription, error) {
+	prepareForAdd(&subscription, time.Now())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.put(subscription)
+	return subscription, nil
+}
+
+func (db *MemorySubscriptionsDB) Get(id domain.SubscriptionID) (domain.Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	subscription, ok := db.subscriptions[id]
+	if !ok {
+		return domain.Subscription{}, ErrNotFound
+	}
+	return subscription, nil
+}
+
+func (db *MemorySubscriptionsDB) Update(subscription domain.Subscription) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.subscriptions[subscription.ID]; !ok {
+		return ErrNotFound
+	}
+	subscription.UpdatedAt = time.Now()
+	db.put(subscription)
+	return nil
+}
+
+func (db *MemorySubscriptionsDB) MarkNotified(id domain.SubscriptionID, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	subscription, ok := db.subscriptions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	subscription.LastNotifiedAt = at
+	db.subscriptions[id] = subscription
+	return nil
+}
+
+func (db *MemorySubscriptionsDB) Remove(id domain.SubscriptionID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	subscription, ok := db.subscriptions[id]
+	if !ok {
+		return nil
+	}
+	db.delete(subscription)
+	return nil
+}
+
+func (db *MemorySubscriptionsDB) RemoveForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	removed := db.getByIDs(db.chats[chatID])
+	for _, subscription := range removed {
+		db.delete(subscription)
+	}
+	return removed, nil
+}
+
+func (db *MemorySubscriptionsDB) GetForLocation(locationCode string) ([]domain.Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getByIDs(db.locations[locationCode]), nil
+}
+
+func (db *MemorySubscriptionsDB) GetForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getByIDs(db.chats[chatID]), nil
+}
+
+func (db *MemorySubscriptionsDB) CountForLocation(locationCode string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.locations[locationCode]), nil
+}
+
+func (db *MemorySubscriptionsDB) LocationCodes() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]string, 0, len(db.locations))
+	for code := range db.locations {
+		result = append(result, code)
+	}
+	return result, nil
+}
+
+// put stores the subscription and moves it between locations and chats if needed. Must be called with the lock held.
+func (db *MemorySubscriptionsDB) put(subscription domain.Subscription) {
+	if previous, ok := db.subscriptions[subscription.ID]; ok {
+		removeFromIndex(db.locations, previous.Location, subscription.ID)
+		removeFromIndex(db.chats, previous.ChatID, subscription.ID)
+	}
+	db.subscriptions[subscription.ID] = subscription
+	addToIndex(db.locations, subscription.Location, subscription.ID)
+	addToIndex(db.chats, subscription.ChatID, subscription.ID)
+}
+
+// delete removes the subscription and references to it. Must be called with the lock held.
+func (db *MemorySubscriptionsDB) delete(subscription domain.Subscription) {
+	removeFromIndex(db.locations, subscription.Location, subscription.ID)
+	removeFromIndex(db.chats, subscription.ChatID, subscription.ID)
+	delete(db.subscriptions, subscription.ID)
+}
+
+// getByIDs returns subscriptions with given IDs. Must be called with the lock held.
+func (db *MemorySubscriptionsDB) getByIDs(ids map[domain.SubscriptionID]struct{}) []domain.Subscription {
+	result := make([]domain.Subscription, 0, len(ids))
+	for id := range ids {
+		result = append(result, db.subscriptions[id])
+	}
+	return result
+}
+
+func addToIndex[K comparable](index map[K]map[domain.SubscriptionID]struct{}, key K, id domain.SubscriptionID) {
+	ids, ok := index[key]
+	if !ok {
+		ids = map[domain.SubscriptionID]struct{}{}
+		index[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func removeFromIndex[K comparable](index map[K]map[domain.SubscriptionID]struct{}, key K, id domain.SubscriptionID) {
+	ids := index[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(index, key)
+	}
+}
+
+// MemoryUsersDB keeps users only in memory.
+type MemoryUsersDB struct {
+	mu    sync.RWMutex
+	users map[domain.ChatID]domain.User
+}
+
+func (db *MemoryUsersDB) Seen(chatID domain.ChatID, language string, at time.Time) (domain.User, error) {
+	return db.change(chatID, func(user *domain.User) {
+		seen(user, language, at)
+	}), nil
+}
+
+func (db *MemoryUsersDB) SetBlocked(chatID domain.ChatID, blocked bool) error {
+	db.change(chatID, func(user *domain.User) {
+		user.Blocked = blocked
+	})
+	return nil
+}
+
+func (db *MemoryUsersDB) SetSubscriptions(chatID domain.ChatID, count int) error {
+	db.change(chatID, func(user *domain.User) {
+		user.Subscriptions = count
+	})
+	return nil
+}
+
+func (db *MemoryUsersDB) SetEmail(chatID domain.ChatID, email string) error {
+	db.change(chatID, func(user *domain.User) {
+		user.Email = email
+	})
+	return nil
+}
+
+func (db *MemoryUsersDB) Save(user domain.User) error {
+	db.change(user.ChatID, func(stored *domain.User) {
+		*stored = user
+	})
+	return nil
+}
+
+func (db *MemoryUsersDB) change(chatID domain.ChatID, apply func(user *domain.User)) domain.User {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[chatID]
+	if !ok {
+		user = newUser(chatID, time.Now())
+	}
+	apply(&user)
+	db.users[chatID] = user
+	return user
+}
+
+func (db *MemoryUsersDB) Get(chatID domain.ChatID) (domain.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user, ok := db.users[chatID]
+	if !ok {
+		return domain.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (db *MemoryUsersDB) All() ([]domain.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.User, 0, len(db.users))
+	for _, user := range db.users {
+		result = append(result, user)
+	}
+	return result, nil
+}
+
+// MemoryBroadcastsDB keeps broadcasts only in memory.
+type MemoryBroadcastsDB struct {
+	mu         sync.RWMutex
+	broadcasts map[domain.BroadcastID]domain.Broadcast
+}
+
+func (db *MemoryBroadcastsDB) Add(broadcast domain.Broadcast) (domain.Broadcast, error) {
+	prepareBroadcastForAdd(&broadcast, time.Now())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.broadcasts[broadcast.ID] = broadcast
+	return broadcast, nil
+}
+
+func (db *MemoryBroadcastsDB) UpdateProgress(
+	id domain.BroadcastID,
+	sent, failed int,
+	finishedAt time.Time,
+) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	broadcast, ok := db.broadcasts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	broadcast.Sent, broadcast.Failed, broadcast.FinishedAt = sent, failed, finishedAt
+	db.broadcasts[id] = broadcast
+	return nil
+}
+
+func (db *MemoryBroadcastsDB) SetRecipients(id domain.BroadcastID, recipients []domain.ChatID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	broadcast, ok := db.broadcasts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	broadcast.Recipients = append([]domain.ChatID(nil), recipients...)
+	db.broadcasts[id] = broadcast
+	return nil
+}
+
+func (db *MemoryBroadcastsDB) All() ([]domain.Broadcast, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.Broadcast, 0, len(db.broadcasts))
+	for _, broadcast := range db.broadcasts {
+		result = append(result, broadcast)
+	}
+	sortBroadcasts(result)
+	return result, nil
+}
+
+// MemoryOutboxDB keeps undelivered messages only in memory.
+type MemoryOutboxDB struct {
+	mu       sync.RWMutex
+	messages map[domain.OutgoingMessageID]domain.OutgoingMessage
+}
+
+func (db *MemoryOutboxDB) Add(message domain.OutgoingMessage) (domain.OutgoingMessage, error) {
+	prepareOutgoingMessageForAdd(&message, time.Now())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.messages[message.ID] = message
+	return message, nil
+}
+
+func (db *MemoryOutboxDB) Remove(id domain.OutgoingMessageID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.messages, id)
+	return nil
+}
+
+func (db *MemoryOutboxDB) All() ([]domain.OutgoingMessage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.OutgoingMessage, 0, len(db.messages))
+	for _, message := range db.messages {
+		result = append(result, message)
+	}
+	sortOutgoingMessages(result)
+	return result, nil
+}
+
+// MemoryConversationsDB keeps conversations only in memory.
+type MemoryConversationsDB struct {
+	mu            sync.RWMutex
+	conversations map[domain.ChatID]domain.Conversation
+}
+
+func (db *MemoryConversationsDB) Save(conversation domain.Conversation) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.conversations[conversation.ChatID] = conversation
+	return nil
+}
+
+func (db *MemoryConversationsDB) Remove(chatID domain.ChatID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.conversations, chatID)
+	return nil
+}
+
+func (db *MemoryConversationsDB) All() ([]domain.Conversation, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.Conversation, 0, len(db.conversations))
+	for _, conversation := range db.conversations {
+		result = append(result, conversation)
+	}
+	return result, nil
+}
+
+// MemoryChannelPostsDB keeps channel posts only in memory.
+type MemoryChannelPostsDB struct {
+	mu    sync.RWMutex
+	posts map[domain.ChannelPostID]domain.ChannelPost
+}
+
+func (db *MemoryChannelPostsDB) Save(post domain.ChannelPost) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.posts[post.ID] = post
+	return nil
+}
+
+func (db *MemoryChannelPostsDB) Remove(id domain.ChannelPostID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.posts, id)
+	return nil
+}
+
+func (db *MemoryChannelPostsDB) All() ([]domain.ChannelPost, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.ChannelPost, 0, len(db.posts))
+	for _, post := range db.posts {
+		result = append(result, post)
+	}
+	return result, nil
+}
+
+// MemoryEventWebhooksDB keeps webhooks only in memory.
+type MemoryEventWebhooksDB struct {
+	mu       sync.RWMutex
+	webhooks map[domain.ChatID]domain.EventWebhook
+}
+
+func (db *MemoryEventWebhooksDB) Save(webhook domain.EventWebhook) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.webhooks[webhook.ChatID] = webhook
+	return nil
+}
+
+func (db *MemoryEventWebhooksDB) Remove(chatID domain.ChatID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.webhooks, chatID)
+	return nil
+}
+
+func (db *MemoryEventWebhooksDB) Get(chatID domain.ChatID) (domain.EventWebhook, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	webhook, ok := db.webhooks[chatID]
+	if !ok {
+		return domain.EventWebhook{}, ErrNotFound
+	}
+	return webhook, nil
+}
+
+func (db *MemoryEventWebhooksDB) All() ([]domain.EventWebhook, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.EventWebhook, 0, len(db.webhooks))
+	for _, webhook := range db.webhooks {
+		result = append(result, webhook)
+	}
+	return result, nil
+}
+
+// MemoryAPITokensDB keeps API tokens only in memory.
+type MemoryAPITokensDB struct {
+	mu     sync.RWMutex
+	tokens map[string]domain.APIToken
+}
+
+func (db *MemoryAPITokensDB) Save(token domain.APIToken) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tokens[token.Hash] = token
+	return nil
+}
+
+func (db *MemoryAPITokensDB) Get(hash string) (domain.APIToken, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	token, ok := db.tokens[hash]
+	if !ok {
+		return domain.APIToken{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (db *MemoryAPITokensDB) RemoveForChat(chatID domain.ChatID) ([]domain.APIToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var removed []domain.APIToken
+	for hash, token := range db.tokens {
+		if token.ChatID == chatID {
+			delete(db.tokens, hash)
+			removed = append(removed, token)
+		}
+	}
+	return removed, nil
+}
+
+func (db *MemoryAPITokensDB) All() ([]domain.APIToken, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.APIToken, 0, len(db.tokens))
+	for _, token := range db.tokens {
+		result = append(result, token)
+	}
+	return result, nil
+}
+
+// MemoryAvailabilityHistoryDB keeps earliest dates only in memory.
+type MemoryAvailabilityHistoryDB struct {
+	mu    sync.RWMutex
+	dates map[string]domain.EarliestDate
+}
+
+func (db *MemoryAvailabilityHistoryDB) Save(earliest domain.EarliestDate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.dates[string(earliestDateKey(earliest))] = earliest
+	return nil
+}
+
+func (db *MemoryAvailabilityHistoryDB) Since(from time.Time) ([]domain.EarliestDate, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var result []domain.EarliestDate
+	for _, earliest := range db.dates {
+		if !earliest.Hour.Before(from) {
+			result = append(result, earliest)
+		}
+	}
+	sortEarliestDates(result)
+	return result, nil
+}
+
+func (db *MemoryAvailabilityHistoryDB) RemoveBefore(before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var removed int
+	for key, earliest := range db.dates {
+		if earliest.Hour.Before(before) {
+			delete(db.dates, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// MemorySlotAppearancesDB keeps appearances only in memory.
+type MemorySlotAppearancesDB struct {
+	mu          sync.RWMutex
+	appearances map[string]domain.SlotAppearance
+}
+
+func (db *MemorySlotAppearancesDB) Add(appearance domain.SlotAppearance) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.appearances[string(slotAppearanceKey(appearance))] = appearance
+	return nil
+}
+
+func (db *MemorySlotAppearancesDB) Latest(location, action string, limit int) ([]domain.SlotAppearance, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var result []domain.SlotAppearance
+	for _, appearance := range db.appearances {
+		if appearance.Location == location && appearance.Action == action {
+			result = append(result, appearance)
+		}
+	}
+	return latestSlotAppearances(result, limit), nil
+}
+
+func (db *MemorySlotAppearancesDB) All() ([]domain.SlotAppearance, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result := make([]domain.SlotAppearance, 0, len(db.appearances))
+	for _, appearance := range db.appearances {
+		result = append(result, appearance)
+	}
+	sortSlotAppearances(result)
+	return result, nil
+}
+
+func (db *MemorySlotAppearancesDB) RemoveBefore(before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var removed int
+	for key, appearance := range db.appearances {
+		if appearance.FoundAt.Before(before) {
+			delete(db.appearances, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Migration moves stored data from the previous schema version to Version.
+type Migration struct {
+	Version     int
+	Description string
+	// Apply changes the data and returns the number of changed records. When dryRun is true nothing must be changed,
+	// only the number of records that would be changed is returned.
+	Apply func(dryRun bool) (int, error)
+}
+
+// MigrationReport describes what a migration did, or would do in dry-run mode.
+type MigrationReport struct {
+	Version     int
+	Description string
+	Changes     int
+	// Backup is a path to the copy of the data made right before the migration. It is empty when there was nothing
+	// to change.
+	Backup string
+}
+
+// versionedSchema is implemented by backends that keep data between restarts.
+type versionedSchema interface {
+	// SchemaVersion returns the version of the stored data, 0 if it was never set.
+	SchemaVersion() (int, error)
+	SetSchemaVersion(version int) error
+	// Backup copies all data into a new directory or file inside dir and returns its path.
+	Backup(dir string) (string, error)
+}
+
+// runMigrations applies, in order of versions, every migration that is newer than the stored schema version.
+// In dry-run mode the data and the schema version stay untouched. Note that in dry-run mode every migration sees the
+// current data, not the data as previous migrations would leave it.
+func runMigrations(
+	schema versionedSchema,
+	migrations []Migration,
+	backupDir string,
+	dryRun bool,
+) ([]MigrationReport, error) {
+	current, err := schema.SchemaVersion()
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema version: %w", err)
+	}
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	if latest := latestVersion(sorted); current > latest {
+		return nil, fmt.Errorf("schema version %d is newer than the latest known %d", current, latest)
+	}
+	var reports []MigrationReport
+	for _, migration := range sorted {
+		if migration.Version <= current {
+			continue
+		}
+		report := MigrationReport{Version: migration.Version, Description: migration.Description}
+		if report.Changes, err = migration.Apply(true); err != nil {
+			return reports, fmt.Errorf("migration %d failed in dry-run: %w", migration.Version, err)
+		}
+		if !dryRun {
+			if report.Changes > 0 {
+				if report.Backup, err = schema.Backup(backupDir); err != nil {
+					return reports, fmt.Errorf("backup before migration %d failed: %w", migration.Version, err)
+				}
+				if report.Changes, err = migration.Apply(false); err != nil {
+					return reports, fmt.Errorf("migration %d failed: %w", migration.Version, err)
+				}
+			}
+			if err = schema.SetSchemaVersion(migration.Version); err != nil {
+				return reports, fmt.Errorf("could not set schema version %d: %w", migration.Version, err)
+			}
+		}
+		log.Infow("Migration",
+			"version", report.Version,
+			"description", report.Description,
+			"changes", report.Changes,
+			"backup", report.Backup,
+			"dryRun", dryRun,
+		)
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func latestVersion(migrations []Migration) int {
+	latest := 0
+	for _, migration := range migrations {
+		if migration.Version > latest {
+			latest = migration.Version
+		}
+	}
+	return latest
+}
+
+// backupName returns a name for a backup of a schema version that is unique enough for our purposes.
+func backupName(backend string, version int) string {
+	return fmt.Sprintf("%s-v%d-%s", backend, version, time.Now().UTC().Format("20060102T150405Z"))
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeSchema keeps the schema version and the data, a number of unmigrated records, in memory.
+type fakeSchema struct {
+	version int
+	backups int
+}
+
+func (s *fakeSchema) SchemaVersion() (int, error) {
+	return s.version, nil
+}
+
+func (s *fakeSchema) SetSchemaVersion(version int) error {
+	s.version = version
+	return nil
+}
+
+func (s *fakeSchema) Backup(string) (string, error) {
+	s.backups++
+	return "backup", nil
+}
+
+// fakeMigration changes pending records, failing with err if it is set.
+type fakeMigration struct {
+	pending int
+	applied int
+	err     error
+}
+
+func (m *fakeMigration) apply(dryRun bool) (int, error) {
+	if m.err != nil && !dryRun {
+		return 0, m.err
+	}
+	changes := m.pending
+	if !dryRun {
+		m.applied += m.pending
+		m.pending = 0
+	}
+	return changes, nil
+}
+
+func TestRunMigrations(t *testing.T) {
+	failed := errors.New("disk is full")
+	tests := []struct {
+		name        string
+		version     int
+		pending     []int
+		failing     int
+		dryRun      bool
+		wantVersion int
+		wantReports []int
+		wantApplied []int
+		wantBackups int
+		wantErr     bool
+	}{
+		{
+			name: "apply all", pending: []int{2, 0, 3},
+			wantVersion: 3, wantReports: []int{2, 0, 3}, wantApplied: []int{2, 0, 3}, wantBackups: 2,
+		},
+		{
+			name: "dry run changes nothing", pending: []int{2, 0, 3}, dryRun: true,
+			wantVersion: 0, wantReports: []int{2, 0, 3}, wantApplied: []int{0, 0, 0},
+		},
+		{
+			name: "only newer ones", version: 2, pending: []int{2, 5, 3},
+			wantVersion: 3, wantReports: []int{3}, wantApplied: []int{0, 0, 3}, wantBackups: 1,
+		},
+		{
+			name: "dry run of newer ones", version: 2, pending: []int{2, 5, 3}, dryRun: true,
+			wantVersion: 2, wantReports: []int{3}, wantApplied: []int{0, 0, 0},
+		},
+		{
+			name: "up to date", version: 3, pending: []int{1, 1, 1},
+			wantVersion: 3, wantApplied: []int{0, 0, 0},
+		},
+		{
+			name: "newer than known", version: 4, pending: []int{1, 1, 1},
+			wantVersion: 4, wantApplied: []int{0, 0, 0}, wantErr: true,
+		},
+		{
+			name: "stops at a failure", pending: []int{1, 1, 1}, failing: 2,
+			wantVersion: 1, wantReports: []int{1}, wantApplied: []int{1, 0, 0}, wantBackups: 2, wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := &fakeSchema{version: test.version}
+			fakes := make([]*fakeMigration, len(test.pending))
+			migrations := make([]Migration, len(test.pending))
+			// listed from the latest to check that they are sorted by version
+			for i := len(test.pending) - 1; i >= 0; i-- {
+				fakes[i] = &fakeMigration{pending: test.pending[i]}
+				if i+1 == test.failing {
+					fakes[i].err = failed
+				}
+				migrations[len(test.pending)-1-i] = Migration{Version: i + 1, Apply: fakes[i].apply}
+			}
+
+			reports, err := runMigrations(schema, migrations, t.TempDir(), test.dryRun)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if schema.version != test.wantVersion {
+				t.Errorf("expected version %d, got %d", test.wantVersion, schema.version)
+			}
+			if schema.backups != test.wantBackups {
+				t.Errorf("expected %d backups, got %d", test.wantBackups, schema.backups)
+			}
+			if len(reports) != len(test.wantReports) {
+				t.Fatalf("expected %d reports, got %d", len(test.wantReports), len(reports))
+			}
+			for i, report := range reports {
+				if report.Changes != test.wantReports[i] {
+					t.Errorf("expected report %d to have %d changes, got %d", i, test.wantReports[i], report.Changes)
+				}
+				if (report.Backup != "") != (!test.dryRun && report.Changes > 0) {
+					t.Errorf("unexpected backup %q of report %d", report.Backup, i)
+				}
+			}
+			for i, fake := range fakes {
+				if fake.applied != test.wantApplied[i] {
+					t.Errorf("expected migration %d to change %d records, got %d", i+1, test.wantApplied[i], fake.applied)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const metaBucket = "meta"
+
+var schemaVersionKey = []byte("schemaVersion")
+
+func openNuts(dir, backupDir string) (*Storage, error) {
+	opt := nutsdb.DefaultOptions
+	opt.Dir = dir
+	storage, err := nutsdb.Open(opt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = runMigrations(&nutsSchema{storage: storage}, nutsMigrations(storage), backupDir, false); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &Storage{
+		Subscriptions:       &NutsSubscriptionsDB{storage: storage},
+		Users:               &NutsUsersDB{storage: storage},
+		Broadcasts:          &NutsBroadcastsDB{storage: storage},
+		Outbox:              &NutsOutboxDB{storage: storage},
+		Conversations:       &NutsConversationsDB{storage: storage},
+		ChannelPosts:        &NutsChannelPostsDB{storage: storage},
+		EventWebhooks:       &NutsEventWebhooksDB{storage: storage},
+		APITokens:           &NutsAPITokensDB{storage: storage},
+		AvailabilityHistory: &NutsAvailabilityHistoryDB{storage: storage},
+		SlotAppearances:     &NutsSlotAppearancesDB{storage: storage},
+		closer:              storage,
+		backend:             BackendNuts,
+		backup:              (&nutsSchema{storage: storage}).Backup,
+	}, nil
+}
+
+// planNutsMigrations reports pending migrations without applying them.
+func planNutsMigrations(dir string) ([]MigrationReport, error) {
+	opt := nutsdb.DefaultOptions
+	opt.Dir = dir
+	storage, err := nutsdb.Open(opt)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	return runMigrations(&nutsSchema{storage: storage}, nutsMigrations(storage), "", true)
+}
+
+// nutsMigrations returns all migrations of nutsdb data. Never change or remove existing ones, add new ones with the
+// next version instead.
+func nutsMigrations(storage *nutsdb.DB) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "store subscriptions by ID, location sets keep only IDs",
+			Apply: func(dryRun bool) (int, error) {
+				return migrateLegacySubscriptions(storage, dryRun)
+			},
+		},
+		{
+			Version:     2,
+			Description: "index subscriptions by chat",
+			Apply: func(dryRun bool) (int, error) {
+				return indexSubscriptionsByChat(storage, dryRun)
+			},
+		},
+		{
+			Version:     3,
+			Description: "replace users counter with user records of chats with subscriptions",
+			Apply: func(dryRun bool) (int, error) {
+				return migrateNutsUsersCounter(storage, dryRun)
+			},
+		},
+	}
+}
+
+// nutsSchema keeps schema version in the meta bucket.
+type nutsSchema struct {
+	storage *nutsdb.DB
+}
+
+func (s *nutsSchema) SchemaVersion() (int, error) {
+	var version int
+	err := s.storage.View(func(tx *nutsdb.Tx) error {
+		entry, err := tx.Get(metaBucket, schemaVersionKey)
+		if isNutsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		version, err = strconv.Atoi(string(entry.Value))
+		return err
+	})
+	return version, err
+}
+
+func (s *nutsSchema) SetSchemaVersion(version int) error {
+	return s.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(metaBucket, schemaVersionKey, []byte(strconv.Itoa(version)), TTLInfinite)
+	})
+}
+
+func (s *nutsSchema) Backup(dir string) (string, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupName(BackendNuts, version))
+	return path, s.storage.Backup(path)
+}
+
+// migrateLegacySubscriptions converts subscriptions that are stored as JSON members of location sets into separate
+// records with IDs, location sets keep only IDs after that. Returns number of converted subscriptions.
+func migrateLegacySubscriptions(storage *nutsdb.DB, dryRun bool) (int, error) {
+	legacy := map[string][][]byte{}
+	count := 0
+	err := storage.View(func(tx *nutsdb.Tx) error {
+		var codes []string
+		err := tx.SKeys(locationsBucket, "*", func(key string) bool {
+			codes = append(codes, key)
+			return true
+		})
+		if errors.Is(err, nutsdb.ErrBucket) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			members, err := tx.SMembers(locationsBucket, []byte(code))
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				// IDs are hex strings, so anything that looks like a JSON object is an old record
+				if len(member) > 0 && member[0] == '{' {
+					legacy[code] = append(legacy[code], member)
+					count++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || dryRun || count == 0 {
+		return count, err
+	}
+	now := time.Now()
+	err = storage.Update(func(tx *nutsdb.Tx) error {
+		for code, members := range legacy {
+			for _, member := range members {
+				var subscription domain.Subscription
+				if err := json.Unmarshal(member, &subscription); err != nil {
+					return err
+				}
+				subscription.Location = code
+				prepareForAdd(&subscription, now)
+				if err := nutsPutSubscription(tx, subscription); err != nil {
+					return err
+				}
+				if err := tx.SRem(locationsBucket, []byte(code), member); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// indexSubscriptionsByChat adds subscriptions that are missing from the chats index to it. Returns number of added
+// subscriptions.
+func indexSubscriptionsByChat(storage *nutsdb.DB, dryRun bool) (int, error) {
+	var missing []domain.Subscription
+	err := storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(subscriptionsBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var subscription domain.Subscription
+			if err := json.Unmarshal(entry.Value, &subscription); err != nil {
+				return err
+			}
+			ok, err := tx.SIsMember(chatsBucket, nutsChatKey(subscription.ChatID), []byte(subscription.ID))
+			if err != nil && !errors.Is(err, nutsdb.ErrBucket) && !isNutsNotFound(err) {
+				return err
+			}
+			if !ok {
+				missing = append(missing, subscription)
+			}
+		}
+		return nil
+	})
+	if err != nil || dryRun || len(missing) == 0 {
+		return len(missing), err
+	}
+	err = storage.Update(func(tx *nutsdb.Tx) error {
+		for _, subscription := range missing {
+			if err := tx.SAdd(chatsBucket, nutsChatKey(subscription.ChatID), []byte(subscription.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(missing), nil
+}
+
+// migrateNutsUsersCounter removes the users counter and creates records of users that have subscriptions.
+func migrateNutsUsersCounter(storage *nutsdb.DB, dryRun bool) (int, error) {
+	var subscriptions []domain.Subscription
+	hasCounter := false
+	existing := map[domain.ChatID]struct{}{}
+	err := storage.View(func(tx *nutsdb.Tx) error {
+		_, err := tx.Get(usersBucket, usersCounterKey)
+		if err != nil && !isNutsNotFound(err) {
+			return err
+		}
+		hasCounter = err == nil
+		entries, err := tx.GetAll(subscriptionsBucket)
+		if err != nil && !isNutsNotFound(err) && !errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return err
+		}
+		for _, entry := range entries {
+			var subscription domain.Subscription
+			if err := json.Unmarshal(entry.Value, &subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			if _, err := getNutsUser(tx, subscription.ChatID); err == nil {
+				existing[subscription.ChatID] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var missing []domain.User
+	for chatID, user := range usersFromSubscriptions(subscriptions, time.Now()) {
+		if _, ok := existing[chatID]; !ok {
+			missing = append(missing, user)
+		}
+	}
+	changes := len(missing)
+	if hasCounter {
+		changes++
+	}
+	if dryRun || changes == 0 {
+		return changes, nil
+	}
+	err = storage.Update(func(tx *nutsdb.Tx) error {
+		if hasCounter {
+			if err := tx.Delete(usersBucket, usersCounterKey); err != nil {
+				return err
+			}
+		}
+		for _, user := range missing {
+			if err := putNutsUser(tx, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return changes, nil
+}
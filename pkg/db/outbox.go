@@ -0,0 +1,90 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+	"sort"
+	"time"
+)
+
+const outboxBucket = "outbox"
+
+// Outbox is the outbox store of the storage opened with Open.
+var Outbox OutboxStore
+
+// OutboxStore keeps messages that weren't delivered yet, so that they survive a restart.
+type OutboxStore interface {
+	// Add stores a new message, ID and creation time are assigned unless they are already set. Returns the message as
+	// it was stored.
+	Add(message domain.OutgoingMessage) (domain.OutgoingMessage, error)
+	// Remove deletes a delivered or abandoned message. Removing a missing message is not an error.
+	Remove(id domain.OutgoingMessageID) error
+	// All returns all messages from the oldest to the latest.
+	All() ([]domain.OutgoingMessage, error)
+}
+
+func prepareOutgoingMessageForAdd(message *domain.OutgoingMessage, now time.Time) {
+	if message.ID == "" {
+		message.ID = domain.OutgoingMessageID(newRandomID())
+	}
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = now
+	}
+}
+
+func sortOutgoingMessages(messages []domain.OutgoingMessage) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+}
+
+// NutsOutboxDB keeps messages as JSON in a nutsdb bucket by their ID.
+type NutsOutboxDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsOutboxDB) Add(message domain.OutgoingMessage) (domain.OutgoingMessage, error) {
+	prepareOutgoingMessageForAdd(&message, time.Now())
+	value, err := json.Marshal(&message)
+	if err != nil {
+		return message, err
+	}
+	return message, db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(outboxBucket, []byte(message.ID), value, TTLInfinite)
+	})
+}
+
+func (db *NutsOutboxDB) Remove(id domain.OutgoingMessageID) error {
+	err := db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(outboxBucket, []byte(id))
+	})
+	if isNutsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *NutsOutboxDB) All() ([]domain.OutgoingMessage, error) {
+	var result []domain.OutgoingMessage
+	err := db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(outboxBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			var message domain.OutgoingMessage
+			if err := json.Unmarshal(entry.Value, &message); err != nil {
+				return err
+			}
+			result = append(result, message)
+		}
+		return nil
+	})
+	sortOutgoingMessages(result)
+	return result, err
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/xujiajun/nutsdb"
+	"sort"
+	"time"
+)
+
+const slotAppearancesBucket = "slotAppearances"
+
+// SlotAppearances is the slot appearance store of the storage opened with Open.
+var SlotAppearances SlotAppearanceStore
+
+// SlotAppearanceStore keeps what polls found, it's the source of feeds of locations.
+type SlotAppearanceStore interface {
+	// Add stores the appearance, replacing the one of the same group, kind and time.
+	Add(appearance domain.SlotAppearance) error
+	// Latest returns at most limit appearances of the location and action for all numbers of people, the newest
+	// first.
+	Latest(location, action string, limit int) ([]domain.SlotAppearance, error)
+	// RemoveBefore deletes appearances found before the time and returns how many were deleted.
+	RemoveBefore(before time.Time) (int, error)
+	// All returns all appearances, the oldest first.
+	All() ([]domain.SlotAppearance, error)
+}
+
+// NutsSlotAppearancesDB keeps appearances as JSON in a nutsdb bucket.
+type NutsSlotAppearancesDB struct {
+	storage *nutsdb.DB
+}
+
+func (db *NutsSlotAppearancesDB) Add(appearance domain.SlotAppearance) error {
+	value, err := json.Marshal(&appearance)
+	if err != nil {
+		return err
+	}
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(slotAppearancesBucket, slotAppearanceKey(appearance), value, TTLInfinite)
+	})
+}
+
+func (db *NutsSlotAppearancesDB) Latest(location, action string, limit int) ([]domain.SlotAppearance, error) {
+	var result []domain.SlotAppearance
+	err := db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsSlotAppearances(tx, func(appearance domain.SlotAppearance) bool {
+			return appearance.Location == location && appearance.Action == action
+		})
+		return err
+	})
+	return latestSlotAppearances(result, limit), err
+}
+
+func (db *NutsSlotAppearancesDB) RemoveBefore(before time.Time) (int, error) {
+	var removed int
+	return removed, db.storage.Update(func(tx *nutsdb.Tx) error {
+		old, err := nutsSlotAppearances(tx, func(appearance domain.SlotAppearance) bool {
+			return appearance.FoundAt.Before(before)
+		})
+		if err != nil {
+			return err
+		}
+		for _, appearance := range old {
+			if err := tx.Delete(slotAppearancesBucket, slotAppearanceKey(appearance)); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+}
+
+func (db *NutsSlotAppearancesDB) All() ([]domain.SlotAppearance, error) {
+	var result []domain.SlotAppearance
+	err := db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsSlotAppearances(tx, func(domain.SlotAppearance) bool {
+			return true
+		})
+		return err
+	})
+	sortSlotAppearances(result)
+	return result, err
+}
+
+// nutsSlotAppearances returns stored appearances the filter accepts.
+func nutsSlotAppearances(tx *nutsdb.Tx, filter func(domain.SlotAppearance) bool) ([]domain.SlotAppearance, error) {
+	entries, err := tx.GetAll(slotAppearancesBucket)
+	if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []domain.SlotAppearance
+	for _, entry := range entries {
+		var appearance domain.SlotAppearance
+		if err := json.Unmarshal(entry.Value, &appearance); err != nil {
+			return nil, err
+		}
+		if filter(appearance) {
+			result = append(result, appearance)
+		}
+	}
+	return result, nil
+}
+
+func slotAppearanceKey(appearance domain.SlotAppearance) []byte {
+	return []byte(fmt.Sprintf(
+		"%s/%s/%s/%d/%s", appearance.FoundAt.UTC().Format(time.RFC3339Nano), appearance.Location, appearance.Action,
+		appearance.PeopleCount, appearance.Kind,
+	))
+}
+
+// sortSlotAppearances orders appearances from the oldest.
+func sortSlotAppearances(appearances []domain.SlotAppearance) {
+	sort.SliceStable(appearances, func(i, j int) bool {
+		return appearances[i].FoundAt.Before(appearances[j].FoundAt)
+	})
+}
+
+// latestSlotAppearances orders appearances from the newest and keeps at most limit of them.
+func latestSlotAppearances(appearances []domain.SlotAppearance, limit int) []domain.SlotAppearance {
+	sort.SliceStable(appearances, func(i, j int) bool {
+		return appearances[i].FoundAt.After(appearances[j].FoundAt)
+	})
+	if len(appearances) > limit {
+		appearances = appearances[:limit]
+	}
+	return appearances
+}
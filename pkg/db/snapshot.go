@@ -0,0 +1,493 @@
+package db
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"time"
+)
+
+// snapshotFormatVersion is increased every time Snapshot changes, adding a store or a field included. Snapshots of
+// other versions are refused, restoring them would lose data they don't have.
+const snapshotFormatVersion = 11
+
+// Snapshot is a copy of all stored data that doesn't depend on a storage backend. Restoring it replaces the whole
+// storage, so every store must be in it.
+type Snapshot struct {
+	FormatVersion int       `json:"formatVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// Counts has the number of records of every store, it tells a complete snapshot from a cut one.
+	Counts              map[string]int           `json:"counts"`
+	Subscriptions       []domain.Subscription    `json:"subscriptions"`
+	Broadcasts          []domain.Broadcast       `json:"broadcasts"`
+	Outbox              []domain.OutgoingMessage `json:"outbox"`
+	Conversations       []domain.Conversation    `json:"conversations"`
+	Users               []domain.User            `json:"users"`
+	ChannelPosts        []domain.ChannelPost     `json:"channelPosts"`
+	EventWebhooks       []domain.EventWebhook    `json:"eventWebhooks"`
+	APITokens           []domain.APIToken        `json:"apiTokens"`
+	AvailabilityHistory []domain.EarliestDate    `json:"availabilityHistory"`
+	SlotAppearances     []domain.SlotAppearance  `json:"slotAppearances"`
+}
+
+// TakeSnapshot copies all data of the storage. Data of nutsdb and SQLite is first copied by the backend at a single
+// point in time and the snapshot is read from that copy, so it is consistent even while the storage is written to.
+// In-memory stores are read one after another, a write in between may be seen by only some of them.
+func TakeSnapshot(storage *Storage) (Snapshot, error) {
+	if storage.backup == nil {
+		return readSnapshot(storage)
+	}
+	dir, err := os.MkdirTemp("", "trakind-snapshot-")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.RemoveAll(dir)
+	path, err := storage.backup(dir)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to copy storage: %w", err)
+	}
+	copied, err := OpenStorage(Config{Backend: storage.backend, Path: path, BackupDir: dir})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer copied.Close()
+	return readSnapshot(copied)
+}
+
+// readSnapshot reads every store of the storage.
+func readSnapshot(storage *Storage) (Snapshot, error) {
+	snapshot := Snapshot{FormatVersion: snapshotFormatVersion, CreatedAt: time.Now()}
+	for _, store := range snapshotStores {
+		if err := store.take(storage, &snapshot); err != nil {
+			return Snapshot{}, fmt.Errorf("failed to read %s: %w", store.name(), err)
+		}
+	}
+	snapshot.Counts = snapshot.count()
+	return snapshot, nil
+}
+
+// count returns the number of records of every store in the snapshot.
+func (s *Snapshot) count() map[string]int {
+	counts := make(map[string]int, len(snapshotStores))
+	for _, store := range snapshotStores {
+		counts[store.name()] = store.count(s)
+	}
+	return counts
+}
+
+// Verify checks that the snapshot is complete and every record in it is usable.
+func (s *Snapshot) Verify() error {
+	if s.FormatVersion != snapshotFormatVersion {
+		return fmt.Errorf("unsupported snapshot format %d", s.FormatVersion)
+	}
+	counts := s.count()
+	for name, count := range counts {
+		expected, ok := s.Counts[name]
+		if !ok {
+			return fmt.Errorf("snapshot has no count of %s", name)
+		}
+		if expected != count {
+			return fmt.Errorf("snapshot is incomplete: expected %d %s, got %d", expected, name, count)
+		}
+	}
+	for name := range s.Counts {
+		if _, ok := counts[name]; !ok {
+			return fmt.Errorf("snapshot has unknown %s", name)
+		}
+	}
+	for _, store := range snapshotStores {
+		if err := store.verify(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotStore moves records of one store between a storage and a snapshot.
+type snapshotStore interface {
+	// name is the key of the store in Snapshot.Counts.
+	name() string
+	count(snapshot *Snapshot) int
+	take(storage *Storage, snapshot *Snapshot) error
+	verify(snapshot *Snapshot) error
+	fill(storage *Storage, snapshot *Snapshot) error
+	// compare checks that every record of the original snapshot is in the restored one.
+	compare(original, restored *Snapshot) error
+}
+
+// storeOf describes a store with records of type T.
+type storeOf[T any] struct {
+	key     string
+	records func(snapshot *Snapshot) *[]T
+	all     func(storage *Storage) ([]T, error)
+	add     func(storage *Storage, record T) error
+	// id is unique for every record of the store.
+	id    func(record T) string
+	check func(record T) error
+	// same tells whether a restored record kept the data that isn't part of its ID, nil if there is no such data.
+	same func(original, restored T) bool
+}
+
+func (s storeOf[T]) name() string {
+	return s.key
+}
+
+func (s storeOf[T]) count(snapshot *Snapshot) int {
+	return len(*s.records(snapshot))
+}
+
+func (s storeOf[T]) take(storage *Storage, snapshot *Snapshot) error {
+	records, err := s.all(storage)
+	*s.records(snapshot) = records
+	return err
+}
+
+func (s storeOf[T]) verify(snapshot *Snapshot) error {
+	records := *s.records(snapshot)
+	ids := make(map[string]struct{}, len(records))
+	for i, record := range records {
+		if err := s.check(record); err != nil {
+			return fmt.Errorf("%s record %d %w", s.key, i, err)
+		}
+		id := s.id(record)
+		if _, ok := ids[id]; ok {
+			return fmt.Errorf("%s record %d is duplicated", s.key, i)
+		}
+		ids[id] = struct{}{}
+	}
+	return nil
+}
+
+func (s storeOf[T]) fill(storage *Storage, snapshot *Snapshot) error {
+	for i, record := range *s.records(snapshot) {
+		if err := s.add(storage, record); err != nil {
+			return fmt.Errorf("failed to restore %s record %d: %w", s.key, i, err)
+		}
+	}
+	return nil
+}
+
+func (s storeOf[T]) compare(original, restored *Snapshot) error {
+	byID := map[string]T{}
+	for _, record := range *s.records(restored) {
+		byID[s.id(record)] = record
+	}
+	for i, record := range *s.records(original) {
+		found, ok := byID[s.id(record)]
+		if !ok {
+			return fmt.Errorf("%s record %d is missing", s.key, i)
+		}
+		if s.same != nil && !s.same(record, found) {
+			return fmt.Errorf("%s record %d differs", s.key, i)
+		}
+	}
+	return nil
+}
+
+// snapshotStores lists every store kept in a snapshot.
+var snapshotStores = []snapshotStore{
+	storeOf[domain.Subscription]{
+		key:     "subscriptions",
+		records: func(snapshot *Snapshot) *[]domain.Subscription { return &snapshot.Subscriptions },
+		all: func(storage *Storage) ([]domain.Subscription, error) {
+			return AllSubscriptions(storage.Subscriptions)
+		},
+		add: func(storage *Storage, subscription domain.Subscription) error {
+			_, err := storage.Subscriptions.Add(subscription)
+			return err
+		},
+		id: func(subscription domain.Subscription) string { return string(subscription.ID) },
+		check: func(subscription domain.Subscription) error {
+			switch {
+			case subscription.ID == "":
+				return errors.New("has no ID")
+			case subscription.ChatID == 0:
+				return errors.New("has no chat")
+			case subscription.Location == "":
+				return errors.New("has no location")
+			case subscription.PeopleCount < 1 || subscription.PeopleCount > domain.MaxPeopleCount:
+				return fmt.Errorf("has %d people", subscription.PeopleCount)
+			}
+			return nil
+		},
+	},
+	storeOf[domain.Broadcast]{
+		key:     "broadcasts",
+		records: func(snapshot *Snapshot) *[]domain.Broadcast { return &snapshot.Broadcasts },
+		all:     func(storage *Storage) ([]domain.Broadcast, error) { return storage.Broadcasts.All() },
+		add: func(storage *Storage, broadcast domain.Broadcast) error {
+			if _, err := storage.Broadcasts.Add(broadcast); err != nil {
+				return err
+			}
+			if broadcast.Sent == 0 && broadcast.Failed == 0 && !broadcast.Finished() {
+				return nil
+			}
+			return storage.Broadcasts.UpdateProgress(broadcast.ID, broadcast.Sent, broadcast.Failed, broadcast.FinishedAt)
+		},
+		id: func(broadcast domain.Broadcast) string { return string(broadcast.ID) },
+		check: func(broadcast domain.Broadcast) error {
+			switch {
+			case broadcast.ID == "":
+				return errors.New("has no ID")
+			case broadcast.Sent > len(broadcast.Recipients):
+				return fmt.Errorf("was sent to %d of %d recipients", broadcast.Sent, len(broadcast.Recipients))
+			}
+			return nil
+		},
+		same: func(original, restored domain.Broadcast) bool {
+			return restored.Sent == original.Sent && restored.Failed == original.Failed
+		},
+	},
+	storeOf[domain.OutgoingMessage]{
+		key:     "outbox",
+		records: func(snapshot *Snapshot) *[]domain.OutgoingMessage { return &snapshot.Outbox },
+		all:     func(storage *Storage) ([]domain.OutgoingMessage, error) { return storage.Outbox.All() },
+		add: func(storage *Storage, message domain.OutgoingMessage) error {
+			_, err := storage.Outbox.Add(message)
+			return err
+		},
+		id: func(message domain.OutgoingMessage) string { return string(message.ID) },
+		check: func(message domain.OutgoingMessage) error {
+			switch {
+			case message.ID == "":
+				return errors.New("has no ID")
+			case message.ChatID == 0:
+				return errors.New("has no chat")
+			}
+			return nil
+		},
+	},
+	storeOf[domain.Conversation]{
+		key:     "conversations",
+		records: func(snapshot *Snapshot) *[]domain.Conversation { return &snapshot.Conversations },
+		all:     func(storage *Storage) ([]domain.Conversation, error) { return storage.Conversations.All() },
+		add: func(storage *Storage, conversation domain.Conversation) error {
+			return storage.Conversations.Save(conversation)
+		},
+		id: func(conversation domain.Conversation) string {
+			return strconv.FormatInt(int64(conversation.ChatID), 10)
+		},
+		check: func(conversation domain.Conversation) error {
+			switch {
+			case conversation.ChatID == 0:
+				return errors.New("has no chat")
+			case conversation.State == "":
+				return errors.New("has no state")
+			}
+			return nil
+		},
+		same: func(original, restored domain.Conversation) bool { return restored.State == original.State },
+	},
+	storeOf[domain.User]{
+		key:     "users",
+		records: func(snapshot *Snapshot) *[]domain.User { return &snapshot.Users },
+		all:     func(storage *Storage) ([]domain.User, error) { return storage.Users.All() },
+		add:     func(storage *Storage, user domain.User) error { return storage.Users.Save(user) },
+		id:      func(user domain.User) string { return strconv.FormatInt(int64(user.ChatID), 10) },
+		check: func(user domain.User) error {
+			if user.ChatID == 0 {
+				return errors.New("has no chat")
+			}
+			if user.Email != "" {
+				if _, err := mail.ParseAddress(user.Email); err != nil {
+					return fmt.Errorf("has invalid email: %w", err)
+				}
+			}
+			return nil
+		},
+		same: func(original, restored domain.User) bool {
+			return restored.Blocked == original.Blocked && restored.Email == original.Email
+		},
+	},
+	storeOf[domain.ChannelPost]{
+		key:     "channelPosts",
+		records: func(snapshot *Snapshot) *[]domain.ChannelPost { return &snapshot.ChannelPosts },
+		all:     func(storage *Storage) ([]domain.ChannelPost, error) { return storage.ChannelPosts.All() },
+		add:     func(storage *Storage, post domain.ChannelPost) error { return storage.ChannelPosts.Save(post) },
+		id:      func(post domain.ChannelPost) string { return string(post.ID) },
+		check: func(post domain.ChannelPost) error {
+			switch {
+			case post.ID == "":
+				return errors.New("has no ID")
+			case post.ChannelID == 0:
+				return errors.New("has no channel")
+			}
+			return nil
+		},
+		same: func(original, restored domain.ChannelPost) bool { return restored.MessageID == original.MessageID },
+	},
+	storeOf[domain.EventWebhook]{
+		key:     "eventWebhooks",
+		records: func(snapshot *Snapshot) *[]domain.EventWebhook { return &snapshot.EventWebhooks },
+		all:     func(storage *Storage) ([]domain.EventWebhook, error) { return storage.EventWebhooks.All() },
+		add: func(storage *Storage, webhook domain.EventWebhook) error {
+			return storage.EventWebhooks.Save(webhook)
+		},
+		id: func(webhook domain.EventWebhook) string { return strconv.FormatInt(int64(webhook.ChatID), 10) },
+		check: func(webhook domain.EventWebhook) error {
+			switch {
+			case webhook.ChatID == 0:
+				return errors.New("has no chat")
+			case webhook.URL == "" || webhook.Secret == "":
+				return errors.New("has no URL or secret")
+			}
+			return nil
+		},
+		same: func(original, restored domain.EventWebhook) bool {
+			return restored.Secret == original.Secret && restored.Disabled == original.Disabled
+		},
+	},
+	storeOf[domain.APIToken]{
+		key:     "apiTokens",
+		records: func(snapshot *Snapshot) *[]domain.APIToken { return &snapshot.APITokens },
+		all:     func(storage *Storage) ([]domain.APIToken, error) { return storage.APITokens.All() },
+		add:     func(storage *Storage, token domain.APIToken) error { return storage.APITokens.Save(token) },
+		id:      func(token domain.APIToken) string { return token.Hash },
+		check: func(token domain.APIToken) error {
+			switch {
+			case token.Hash == "":
+				return errors.New("has no hash")
+			case token.ChatID == 0:
+				return errors.New("has no chat")
+			}
+			return nil
+		},
+		same: func(original, restored domain.APIToken) bool { return restored.ChatID == original.ChatID },
+	},
+	storeOf[domain.EarliestDate]{
+		key:     "availabilityHistory",
+		records: func(snapshot *Snapshot) *[]domain.EarliestDate { return &snapshot.AvailabilityHistory },
+		all: func(storage *Storage) ([]domain.EarliestDate, error) {
+			return storage.AvailabilityHistory.Since(time.Time{})
+		},
+		add: func(storage *Storage, earliest domain.EarliestDate) error {
+			return storage.AvailabilityHistory.Save(earliest)
+		},
+		id: func(earliest domain.EarliestDate) string { return string(earliestDateKey(earliest)) },
+		check: func(earliest domain.EarliestDate) error {
+			switch {
+			case earliest.Location == "" || earliest.Action == "":
+				return errors.New("has no location or action")
+			case earliest.Hour.IsZero():
+				return errors.New("has no hour")
+			}
+			return nil
+		},
+		same: func(original, restored domain.EarliestDate) bool {
+			return time.Time(restored.Date).Equal(time.Time(original.Date))
+		},
+	},
+	storeOf[domain.SlotAppearance]{
+		key:     "slotAppearances",
+		records: func(snapshot *Snapshot) *[]domain.SlotAppearance { return &snapshot.SlotAppearances },
+		all:     func(storage *Storage) ([]domain.SlotAppearance, error) { return storage.SlotAppearances.All() },
+		add: func(storage *Storage, appearance domain.SlotAppearance) error {
+			return storage.SlotAppearances.Add(appearance)
+		},
+		id: func(appearance domain.SlotAppearance) string { return string(slotAppearanceKey(appearance)) },
+		check: func(appearance domain.SlotAppearance) error {
+			switch {
+			case appearance.Location == "" || appearance.Action == "":
+				return errors.New("has no location or action")
+			case appearance.Kind != domain.EarliestDateAppeared && appearance.Kind != domain.WindowsAppeared:
+				return fmt.Errorf("has unknown kind %q", appearance.Kind)
+			case appearance.FoundAt.IsZero():
+				return errors.New("has no time")
+			}
+			return nil
+		},
+	},
+}
+
+// WriteSnapshot writes gzipped JSON of the snapshot.
+func WriteSnapshot(w io.Writer, snapshot Snapshot) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(&snapshot); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot and verifies it.
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer gz.Close()
+	var snapshot Snapshot
+	if err := json.NewDecoder(gz).Decode(&snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, snapshot.Verify()
+}
+
+// RestoreSnapshot replaces data of the storage described by cfg with the snapshot. The snapshot is first written to
+// a new storage next to the current one and read back. Only if everything matches, the current data is moved aside
+// and the new storage takes its place. Returns the path where the previous data was moved to, if there was any.
+// The storage must not be in use.
+func RestoreSnapshot(cfg Config, snapshot Snapshot) (string, error) {
+	cfg = withDefaults(cfg)
+	if cfg.Backend == BackendMemory {
+		return "", errors.New("in-memory storage can't be restored")
+	}
+	if err := snapshot.Verify(); err != nil {
+		return "", err
+	}
+	restoreCfg := cfg
+	restoreCfg.Path = cfg.Path + ".restore"
+	if err := os.RemoveAll(restoreCfg.Path); err != nil {
+		return "", err
+	}
+	if err := fillStorage(restoreCfg, snapshot); err != nil {
+		os.RemoveAll(restoreCfg.Path)
+		return "", fmt.Errorf("restored data doesn't match the snapshot: %w", err)
+	}
+	var previous string
+	if _, err := os.Stat(cfg.Path); err == nil {
+		previous = fmt.Sprintf("%s.before-restore-%s", cfg.Path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(cfg.Path, previous); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(restoreCfg.Path, cfg.Path); err != nil {
+		return previous, err
+	}
+	return previous, nil
+}
+
+// fillStorage writes the snapshot into a new storage and checks that it reads back the same.
+func fillStorage(cfg Config, snapshot Snapshot) error {
+	storage, err := OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	for _, store := range snapshotStores {
+		if err := store.fill(storage, &snapshot); err != nil {
+			return err
+		}
+	}
+	restored, err := readSnapshot(storage)
+	if err != nil {
+		return err
+	}
+	for name, count := range snapshot.Counts {
+		if restored.Counts[name] != count {
+			return fmt.Errorf("expected %d %s, got %d", count, name, restored.Counts[name])
+		}
+	}
+	for _, store := range snapshotStores {
+		if err := store.compare(&snapshot, &restored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"bytes"
+	"github.com/silh/trakind/pkg/domain"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleSnapshot returns a snapshot with a record in every store.
+func sampleSnapshot(t *testing.T) Snapshot {
+	t.Helper()
+	storage := openMemory()
+	now := time.Now().UTC().Truncate(time.Second)
+	date := domain.Date(time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC))
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("failed to fill storage: %v", err)
+		}
+	}
+	_, err := storage.Subscriptions.Add(domain.Subscription{ChatID: 1, Location: "AM", Action: "BIO", PeopleCount: 2})
+	must(err)
+	broadcast, err := storage.Broadcasts.Add(domain.Broadcast{
+		CreatedBy: 1, Text: "Hello", Recipients: []domain.ChatID{1, 2},
+	})
+	must(err)
+	must(storage.Broadcasts.UpdateProgress(broadcast.ID, 1, 0, time.Time{}))
+	_, err = storage.Outbox.Add(domain.OutgoingMessage{ChatID: 1, Text: "New slot", CreatedAt: now})
+	must(err)
+	must(storage.Conversations.Save(domain.Conversation{ChatID: 2, State: "location", UpdatedAt: now}))
+	must(storage.Users.Save(domain.User{ChatID: 1, FirstSeen: now, LastActive: now, Email: "user@example.com"}))
+	must(storage.ChannelPosts.Save(domain.ChannelPost{
+		ID: "post", ChannelID: -100, Location: "AM", Action: "BIO", PeopleCount: 1, Date: date, MessageID: 7,
+		PostedAt: now,
+	}))
+	must(storage.EventWebhooks.Save(domain.EventWebhook{
+		ChatID: 1, URL: "https://example.com/hook", Secret: "secret", CreatedAt: now,
+	}))
+	must(storage.APITokens.Save(domain.APIToken{Hash: "hash", ChatID: 1, CreatedAt: now}))
+	must(storage.AvailabilityHistory.Save(domain.EarliestDate{
+		Location: "AM", Action: "BIO", PeopleCount: 1, Hour: now.Truncate(time.Hour), Date: date,
+	}))
+	must(storage.SlotAppearances.Add(domain.SlotAppearance{
+		Location: "AM", Action: "BIO", PeopleCount: 1, Kind: domain.WindowsAppeared, Date: date, Windows: 2,
+		FoundAt: now,
+	}))
+	snapshot, err := TakeSnapshot(storage)
+	must(err)
+	for name, count := range snapshot.Counts {
+		if count != 1 {
+			t.Fatalf("expected 1 record in %s, got %d", name, count)
+		}
+	}
+	return snapshot
+}
+
+func TestSnapshotVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(snapshot *Snapshot)
+		wantErr string
+	}{
+		{"complete", func(snapshot *Snapshot) {}, ""},
+		{"other version", func(snapshot *Snapshot) { snapshot.FormatVersion-- }, "unsupported snapshot format"},
+		{
+			"missing count",
+			func(snapshot *Snapshot) { delete(snapshot.Counts, "subscriptions") },
+			"no count of subscriptions",
+		},
+		{"cut", func(snapshot *Snapshot) { snapshot.Subscriptions = nil }, "expected 1 subscriptions, got 0"},
+		{"unknown store", func(snapshot *Snapshot) { snapshot.Counts["groups"] = 0 }, "unknown groups"},
+		{
+			"subscription without chat",
+			func(snapshot *Snapshot) { snapshot.Subscriptions[0].ChatID = 0 },
+			"subscriptions record 0 has no chat",
+		},
+		{
+			"too many people",
+			func(snapshot *Snapshot) { snapshot.Subscriptions[0].PeopleCount = domain.MaxPeopleCount + 1 },
+			"has 7 people",
+		},
+		{
+			"duplicated subscription",
+			func(snapshot *Snapshot) {
+				snapshot.Subscriptions = append(snapshot.Subscriptions, snapshot.Subscriptions[0])
+				snapshot.Counts["subscriptions"]++
+			},
+			"subscriptions record 1 is duplicated",
+		},
+		{"invalid email", func(snapshot *Snapshot) { snapshot.Users[0].Email = "user" }, "has invalid email"},
+		{
+			"unknown appearance",
+			func(snapshot *Snapshot) { snapshot.SlotAppearances[0].Kind = "gone" },
+			`has unknown kind "gone"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := sampleSnapshot(t)
+			test.change(&snapshot)
+			err := snapshot.Verify()
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("expected no error, got %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("expected error with %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	for _, backend := range []string{BackendNuts, BackendSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			original := sampleSnapshot(t)
+			var buf bytes.Buffer
+			if err := WriteSnapshot(&buf, original); err != nil {
+				t.Fatalf("failed to write snapshot: %v", err)
+			}
+			snapshot, err := ReadSnapshot(&buf)
+			if err != nil {
+				t.Fatalf("failed to read snapshot: %v", err)
+			}
+			dir := t.TempDir()
+			cfg := Config{Backend: backend, Path: filepath.Join(dir, "data"), BackupDir: filepath.Join(dir, "backups")}
+			previous, err := RestoreSnapshot(cfg, snapshot)
+			if err != nil {
+				t.Fatalf("failed to restore snapshot: %v", err)
+			}
+			if previous != "" {
+				t.Errorf("expected nothing to be moved aside, got %s", previous)
+			}
+
+			storage, err := OpenStorage(cfg)
+			if err != nil {
+				t.Fatalf("failed to open restored storage: %v", err)
+			}
+			defer storage.Close()
+			restored, err := TakeSnapshot(storage)
+			if err != nil {
+				t.Fatalf("failed to take snapshot of restored storage: %v", err)
+			}
+			for _, store := range snapshotStores {
+				if err := store.compare(&original, &restored); err != nil {
+					t.Error(err)
+				}
+			}
+			if restored.Users[0].Email != "user@example.com" {
+				t.Errorf("expected email to be restored, got %q", restored.Users[0].Email)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotMovesPreviousData(t *testing.T) {
+	snapshot := sampleSnapshot(t)
+	dir := t.TempDir()
+	cfg := Config{Backend: BackendSQLite, Path: filepath.Join(dir, "data"), BackupDir: filepath.Join(dir, "backups")}
+	if _, err := RestoreSnapshot(cfg, snapshot); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+	previous, err := RestoreSnapshot(cfg, snapshot)
+	if err != nil {
+		t.Fatalf("failed to restore snapshot again: %v", err)
+	}
+	if !strings.HasPrefix(previous, cfg.Path+".before-restore-") {
+		t.Errorf("expected previous data to be moved next to the storage, got %q", previous)
+	}
+}
+
+func TestRestoreSnapshotRefusesIncomplete(t *testing.T) {
+	snapshot := sampleSnapshot(t)
+	snapshot.Subscriptions = nil
+	dir := t.TempDir()
+	cfg := Config{Backend: BackendSQLite, Path: filepath.Join(dir, "data")}
+	if _, err := RestoreSnapshot(cfg, snapshot); err == nil {
+		t.Fatal("expected incomplete snapshot to be refused")
+	}
+	if _, err := RestoreSnapshot(Config{Backend: BackendMemory}, sampleSnapshot(t)); err == nil {
+		t.Error("expected in-memory storage to be refused")
+	}
+}
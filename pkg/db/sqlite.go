@@ -0,0 +1,1265 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/domain"
+	_ "modernc.org/sqlite" // registers "sqlite" driver
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sqliteTables creates tables of the latest schema version. It runs after migrations, so it creates everything in a
+// fresh database and only tables added since in an existing one. Migrations must not use it, every migration has DDL
+// of its own version.
+const sqliteTables = `
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id               TEXT    PRIMARY KEY,
+	location         TEXT    NOT NULL,
+	chat_id          INTEGER NOT NULL,
+	action           TEXT    NOT NULL DEFAULT '',
+	people_count     INTEGER NOT NULL,
+	track_before     TEXT    NOT NULL DEFAULT '',
+	created_at       TEXT    NOT NULL DEFAULT '',
+	updated_at       TEXT    NOT NULL DEFAULT '',
+	last_notified_at TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS subscriptions_location ON subscriptions (location);
+CREATE INDEX IF NOT EXISTS subscriptions_chat ON subscriptions (chat_id);
+CREATE TABLE IF NOT EXISTS users (
+	chat_id       INTEGER PRIMARY KEY,
+	first_seen    TEXT    NOT NULL,
+	last_active   TEXT    NOT NULL,
+	language      TEXT    NOT NULL DEFAULT '',
+	blocked       INTEGER NOT NULL DEFAULT 0,
+	subscriptions INTEGER NOT NULL DEFAULT 0,
+	email         TEXT    NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS broadcasts (
+	id          TEXT    PRIMARY KEY,
+	created_by  INTEGER NOT NULL,
+	created_at  TEXT    NOT NULL,
+	location    TEXT    NOT NULL DEFAULT '',
+	action      TEXT    NOT NULL DEFAULT '',
+	text        TEXT    NOT NULL,
+	recipients  TEXT    NOT NULL,
+	sent        INTEGER NOT NULL DEFAULT 0,
+	failed      INTEGER NOT NULL DEFAULT 0,
+	finished_at TEXT    NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	id              TEXT    PRIMARY KEY,
+	chat_id         INTEGER NOT NULL,
+	text            TEXT    NOT NULL,
+	subscription_id TEXT    NOT NULL DEFAULT '',
+	created_at      TEXT    NOT NULL
+);
+CREATE TABLE IF NOT EXISTS conversations (
+	chat_id      INTEGER PRIMARY KEY,
+	user_id      INTEGER NOT NULL DEFAULT 0,
+	state        TEXT    NOT NULL,
+	action       TEXT    NOT NULL DEFAULT '',
+	location     TEXT    NOT NULL DEFAULT '',
+	people_count INTEGER NOT NULL DEFAULT 0,
+	updated_at   TEXT    NOT NULL
+);
+CREATE TABLE IF NOT EXISTS channel_posts (
+	id           TEXT    PRIMARY KEY,
+	channel_id   INTEGER NOT NULL,
+	location     TEXT    NOT NULL,
+	action       TEXT    NOT NULL,
+	people_count INTEGER NOT NULL,
+	date         TEXT    NOT NULL,
+	start_time   TEXT    NOT NULL,
+	message_id   INTEGER NOT NULL,
+	posted_at    TEXT    NOT NULL
+);
+CREATE TABLE IF NOT EXISTS event_webhooks (
+	chat_id    INTEGER PRIMARY KEY,
+	url        TEXT    NOT NULL,
+	secret     TEXT    NOT NULL,
+	failures   INTEGER NOT NULL DEFAULT 0,
+	disabled   INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT    NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_tokens (
+	hash       TEXT    PRIMARY KEY,
+	chat_id    INTEGER NOT NULL,
+	created_at TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS api_tokens_chat_id ON api_tokens (chat_id);
+CREATE TABLE IF NOT EXISTS availability_history (
+	hour         TEXT    NOT NULL,
+	location     TEXT    NOT NULL,
+	action       TEXT    NOT NULL,
+	people_count INTEGER NOT NULL,
+	date         TEXT    NOT NULL DEFAULT '',
+	PRIMARY KEY (hour, location, action, people_count)
+);
+CREATE TABLE IF NOT EXISTS slot_appearances (
+	found_at      TEXT    NOT NULL,
+	location      TEXT    NOT NULL,
+	action        TEXT    NOT NULL,
+	people_count  INTEGER NOT NULL,
+	kind          TEXT    NOT NULL,
+	date          TEXT    NOT NULL,
+	windows       INTEGER NOT NULL DEFAULT 0,
+	previous_date TEXT    NOT NULL DEFAULT '',
+	PRIMARY KEY (found_at, location, action, people_count, kind)
+);
+CREATE INDEX IF NOT EXISTS slot_appearances_location ON slot_appearances (location, action, found_at);
+`
+
+func openSQLite(path, backupDir string) (*Storage, error) {
+	storage, err := openSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = runMigrations(&sqliteSchema{storage: storage}, sqliteMigrations(storage), backupDir, false); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if _, err = storage.Exec(sqliteTables); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &Storage{
+		Subscriptions:       &SQLiteSubscriptionsDB{storage: storage},
+		Users:               &SQLiteUsersDB{storage: storage},
+		Broadcasts:          &SQLiteBroadcastsDB{storage: storage},
+		Outbox:              &SQLiteOutboxDB{storage: storage},
+		Conversations:       &SQLiteConversationsDB{storage: storage},
+		ChannelPosts:        &SQLiteChannelPostsDB{storage: storage},
+		EventWebhooks:       &SQLiteEventWebhooksDB{storage: storage},
+		APITokens:           &SQLiteAPITokensDB{storage: storage},
+		AvailabilityHistory: &SQLiteAvailabilityHistoryDB{storage: storage},
+		SlotAppearances:     &SQLiteSlotAppearancesDB{storage: storage},
+		closer:              storage,
+		backend:             BackendSQLite,
+		backup:              (&sqliteSchema{storage: storage}).Backup,
+	}, nil
+}
+
+func openSQLiteDB(path string) (*sql.DB, error) {
+	storage, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer, there is no point in having more connections
+	storage.SetMaxOpenConns(1)
+	return storage, nil
+}
+
+// planSQLiteMigrations reports pending migrations without applying them.
+func planSQLiteMigrations(path string) ([]MigrationReport, error) {
+	storage, err := openSQLiteDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	return runMigrations(&sqliteSchema{storage: storage}, sqliteMigrations(storage), "", true)
+}
+
+// sqliteMigrations returns all migrations of SQLite data. They run before sqliteTables are created, so a migration
+// must expect that tables it changes don't exist yet. Never change or remove existing migrations, add new ones with
+// the next version instead.
+func sqliteMigrations(storage *sql.DB) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "add ID and timestamps to subscriptions",
+			Apply: func(dryRun bool) (int, error) {
+				return migrateSQLiteSubscriptionIDs(storage, dryRun)
+			},
+		},
+		{
+			Version:     2,
+			Description: "replace users counter with user records of chats with subscriptions",
+			Apply: func(dryRun bool) (int, error) {
+				return migrateSQLiteUsersCounter(storage, dryRun)
+			},
+		},
+		{
+			Version:     3,
+			Description: "remember who started a conversation",
+			Apply: func(dryRun bool) (int, error) {
+				return addSQLiteConversationUser(storage, dryRun)
+			},
+		},
+	}
+}
+
+// sqliteSchema keeps schema version in user_version pragma.
+type sqliteSchema struct {
+	storage *sql.DB
+}
+
+func (s *sqliteSchema) SchemaVersion() (int, error) {
+	var version int
+	err := s.storage.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+func (s *sqliteSchema) SetSchemaVersion(version int) error {
+	// pragma doesn't accept parameters
+	_, err := s.storage.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	return err
+}
+
+func (s *sqliteSchema) Backup(dir string) (string, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupName(BackendSQLite, version)+".sqlite")
+	_, err = s.storage.Exec(`VACUUM INTO ?`, path)
+	return path, err
+}
+
+// sqliteSubscriptionsV1 is subscriptions table as of schema version 1.
+const sqliteSubscriptionsV1 = `
+CREATE TABLE subscriptions (
+	id               TEXT    PRIMARY KEY,
+	location         TEXT    NOT NULL,
+	chat_id          INTEGER NOT NULL,
+	action           TEXT    NOT NULL DEFAULT '',
+	people_count     INTEGER NOT NULL,
+	track_before     TEXT    NOT NULL DEFAULT '',
+	created_at       TEXT    NOT NULL DEFAULT '',
+	updated_at       TEXT    NOT NULL DEFAULT '',
+	last_notified_at TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS subscriptions_location ON subscriptions (location);
+`
+
+// migrateSQLiteSubscriptionIDs rebuilds subscriptions table that was created without IDs, giving every row a random
+// ID. Returns the number of migrated rows.
+func migrateSQLiteSubscriptionIDs(storage *sql.DB, dryRun bool) (int, error) {
+	var columns int
+	err := storage.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('subscriptions')`).Scan(&columns)
+	if err != nil {
+		return 0, err
+	}
+	var idColumns int
+	err = storage.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('subscriptions') WHERE name = 'id'`).
+		Scan(&idColumns)
+	if err != nil {
+		return 0, err
+	}
+	if columns == 0 || idColumns > 0 { // nothing to migrate
+		return 0, nil
+	}
+	var rows int
+	if err := storage.QueryRow(`SELECT COUNT(*) FROM subscriptions`).Scan(&rows); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return rows, nil
+	}
+	tx, err := storage.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`ALTER TABLE subscriptions RENAME TO subscriptions_legacy`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(sqliteSubscriptionsV1); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO subscriptions (id, location, chat_id, action, people_count, track_before, created_at, updated_at)
+		SELECT lower(hex(randomblob(8))), location, chat_id, action, people_count, track_before, ?1, ?1
+		FROM subscriptions_legacy`,
+		formatTime(time.Now()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DROP TABLE subscriptions_legacy`); err != nil {
+		return 0, err
+	}
+	return rows, tx.Commit()
+}
+
+// sqliteUsersV2 is users table as of schema version 2.
+const sqliteUsersV2 = `
+CREATE TABLE IF NOT EXISTS users (
+	chat_id       INTEGER PRIMARY KEY,
+	first_seen    TEXT    NOT NULL,
+	last_active   TEXT    NOT NULL,
+	language      TEXT    NOT NULL DEFAULT '',
+	blocked       INTEGER NOT NULL DEFAULT 0,
+	subscriptions INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// migrateSQLiteUsersCounter drops the users counter and creates records of users that have subscriptions.
+func migrateSQLiteUsersCounter(storage *sql.DB, dryRun bool) (int, error) {
+	var counters, subscriptionsTable int
+	err := storage.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'counters'`).
+		Scan(&counters)
+	if err != nil {
+		return 0, err
+	}
+	err = storage.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'subscriptions'`).
+		Scan(&subscriptionsTable)
+	if err != nil {
+		return 0, err
+	}
+	var chats int
+	if subscriptionsTable > 0 {
+		// works with the schema before migration 1 too, dry-run sees the data as it is
+		if err := storage.QueryRow(`SELECT COUNT(DISTINCT chat_id) FROM subscriptions`).Scan(&chats); err != nil {
+			return 0, err
+		}
+	}
+	changes := chats + counters
+	if dryRun || changes == 0 {
+		return changes, nil
+	}
+	subscriptions, err := querySubscriptions(storage, "")
+	if err != nil {
+		return 0, err
+	}
+	users := usersFromSubscriptions(subscriptions, time.Now())
+	tx, err := storage.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(sqliteUsersV2); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS counters`); err != nil {
+		return 0, err
+	}
+	for _, user := range users {
+		_, err := tx.Exec(
+			`INSERT OR IGNORE INTO users (chat_id, first_seen, last_active, subscriptions) VALUES (?, ?, ?, ?)`,
+			int64(user.ChatID), formatTime(user.FirstSeen), formatTime(user.LastActive), user.Subscriptions,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return changes, tx.Commit()
+}
+
+// addSQLiteConversationUser adds user_id column to conversations table if the table exists without it.
+func addSQLiteConversationUser(storage *sql.DB, dryRun bool) (int, error) {
+	var columns, userColumns int
+	err := storage.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('conversations')`).Scan(&columns)
+	if err != nil {
+		return 0, err
+	}
+	err = storage.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('conversations') WHERE name = 'user_id'`).
+		Scan(&userColumns)
+	if err != nil {
+		return 0, err
+	}
+	if columns == 0 || userColumns > 0 { // nothing to migrate
+		return 0, nil
+	}
+	var rows int
+	if err := storage.QueryRow(`SELECT COUNT(*) FROM conversations`).Scan(&rows); err != nil {
+		return 0, err
+	}
+	changes := rows + 1 // the table changes even without rows
+	if dryRun {
+		return changes, nil
+	}
+	_, err = storage.Exec(`ALTER TABLE conversations ADD COLUMN user_id INTEGER NOT NULL DEFAULT 0`)
+	return changes, err
+}
+
+// SQLiteSubscriptionsDB keeps subscriptions in a SQLite table, one row per subscription.
+type SQLiteSubscriptionsDB struct {
+	storage *sql.DB
+}
+
+const sqliteSubscriptionColumns = `id, location, chat_id, action, people_count, track_before, created_at, updated_at,
+	last_notified_at`
+
+func (db *SQLiteSubscriptionsDB) Add(subscription domain.Subscription) (domain.Subscription, error) {
+	prepareForAdd(&subscription, time.Now())
+	_, err := db.storage.Exec(
+		`INSERT OR REPLACE INTO subscriptions (`+sqliteSubscriptionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sqliteSubscriptionValues(subscription)...,
+	)
+	return subscription, err
+}
+
+func (db *SQLiteSubscriptionsDB) Get(id domain.SubscriptionID) (domain.Subscription, error) {
+	row := db.storage.QueryRow(`SELECT `+sqliteSubscriptionColumns+` FROM subscriptions WHERE id = ?`, id)
+	subscription, err := scanSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Subscription{}, ErrNotFound
+	}
+	return subscription, err
+}
+
+func (db *SQLiteSubscriptionsDB) Update(subscription domain.Subscription) error {
+	subscription.UpdatedAt = time.Now()
+	result, err := db.storage.Exec(
+		`UPDATE subscriptions SET location = ?, chat_id = ?, action = ?, people_count = ?, track_before = ?,
+		created_at = ?, updated_at = ?, last_notified_at = ? WHERE id = ?`,
+		append(sqliteSubscriptionValues(subscription)[1:], subscription.ID)...,
+	)
+	return checkAffected(result, err)
+}
+
+func (db *SQLiteSubscriptionsDB) MarkNotified(id domain.SubscriptionID, at time.Time) error {
+	result, err := db.storage.Exec(`UPDATE subscriptions SET last_notified_at = ? WHERE id = ?`, formatTime(at), id)
+	return checkAffected(result, err)
+}
+
+func (db *SQLiteSubscriptionsDB) Remove(id domain.SubscriptionID) error {
+	_, err := db.storage.Exec(`DELETE FROM subscriptions WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLiteSubscriptionsDB) RemoveForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	tx, err := db.storage.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	removed, err := querySubscriptions(tx, `WHERE chat_id = ?`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM subscriptions WHERE chat_id = ?`, chatID); err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+func (db *SQLiteSubscriptionsDB) GetForLocation(locationCode string) ([]domain.Subscription, error) {
+	return querySubscriptions(db.storage, `WHERE location = ?`, locationCode)
+}
+
+func (db *SQLiteSubscriptionsDB) GetForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	return querySubscriptions(db.storage, `WHERE chat_id = ?`, chatID)
+}
+
+func (db *SQLiteSubscriptionsDB) CountForLocation(locationCode string) (int, error) {
+	var result int
+	err := db.storage.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE location = ?`, locationCode).Scan(&result)
+	return result, err
+}
+
+func (db *SQLiteSubscriptionsDB) LocationCodes() ([]string, error) {
+	rows, err := db.storage.Query(`SELECT DISTINCT location FROM subscriptions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		result = append(result, code)
+	}
+	return result, rows.Err()
+}
+
+// querySubscriptions returns all subscriptions matching the condition.
+func querySubscriptions(
+	querier interface {
+		Query(query string, args ...any) (*sql.Rows, error)
+	},
+	condition string,
+	args ...any,
+) ([]domain.Subscription, error) {
+	rows, err := querier.Query(`SELECT `+sqliteSubscriptionColumns+` FROM subscriptions `+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.Subscription
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, subscription)
+	}
+	return result, rows.Err()
+}
+
+// sqliteSubscriptionValues returns values in the order of sqliteSubscriptionColumns.
+func sqliteSubscriptionValues(subscription domain.Subscription) []any {
+	return []any{
+		subscription.ID,
+		subscription.Location,
+		subscription.ChatID,
+		subscription.Action,
+		subscription.PeopleCount,
+		formatTrackBefore(subscription.TrackBefore),
+		formatTime(subscription.CreatedAt),
+		formatTime(subscription.UpdatedAt),
+		formatTime(subscription.LastNotifiedAt),
+	}
+}
+
+// scanSubscription reads a row with sqliteSubscriptionColumns.
+func scanSubscription(row interface{ Scan(...any) error }) (domain.Subscription, error) {
+	var subscription domain.Subscription
+	var trackBefore, createdAt, updatedAt, lastNotifiedAt string
+	err := row.Scan(
+		&subscription.ID,
+		&subscription.Location,
+		&subscription.ChatID,
+		&subscription.Action,
+		&subscription.PeopleCount,
+		&trackBefore,
+		&createdAt,
+		&updatedAt,
+		&lastNotifiedAt,
+	)
+	if err != nil {
+		return domain.Subscription{}, err
+	}
+	if subscription.TrackBefore, err = parseTrackBefore(trackBefore); err != nil {
+		return domain.Subscription{}, err
+	}
+	if subscription.CreatedAt, err = parseTime(createdAt); err != nil {
+		return domain.Subscription{}, err
+	}
+	if subscription.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return domain.Subscription{}, err
+	}
+	if subscription.LastNotifiedAt, err = parseTime(lastNotifiedAt); err != nil {
+		return domain.Subscription{}, err
+	}
+	return subscription, nil
+}
+
+// checkAffected turns an update of zero rows into ErrNotFound.
+func checkAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// formatTime converts time to the column value, empty string means zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// formatTrackBefore converts the date to the column value, empty string means no limit.
+func formatTrackBefore(date domain.Date) string {
+	if (date == domain.Date{}) {
+		return ""
+	}
+	return date.String()
+}
+
+func parseTrackBefore(value string) (domain.Date, error) {
+	if value == "" {
+		return domain.Date{}, nil
+	}
+	return domain.ParseWindowDate(value)
+}
+
+// SQLiteUsersDB keeps users in users table, one row per chat.
+type SQLiteUsersDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteUsersDB) Seen(chatID domain.ChatID, language string, at time.Time) (domain.User, error) {
+	return db.change(chatID, func(user *domain.User) {
+		seen(user, language, at)
+	})
+}
+
+func (db *SQLiteUsersDB) SetBlocked(chatID domain.ChatID, blocked bool) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Blocked = blocked
+	})
+	return err
+}
+
+func (db *SQLiteUsersDB) SetSubscriptions(chatID domain.ChatID, count int) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Subscriptions = count
+	})
+	return err
+}
+
+func (db *SQLiteUsersDB) SetEmail(chatID domain.ChatID, email string) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Email = email
+	})
+	return err
+}
+
+func (db *SQLiteUsersDB) Save(user domain.User) error {
+	_, err := db.change(user.ChatID, func(stored *domain.User) {
+		*stored = user
+	})
+	return err
+}
+
+// change applies the function to the user of the chat, creating the user if it's missing, and stores the result.
+func (db *SQLiteUsersDB) change(chatID domain.ChatID, apply func(user *domain.User)) (domain.User, error) {
+	tx, err := db.storage.Begin()
+	if err != nil {
+		return domain.User{}, err
+	}
+	defer tx.Rollback()
+	users, err := queryUsers(tx, `WHERE chat_id = ?`, int64(chatID))
+	if err != nil {
+		return domain.User{}, err
+	}
+	user := newUser(chatID, time.Now())
+	if len(users) > 0 {
+		user = users[0]
+	}
+	apply(&user)
+	_, err = tx.Exec(
+		`INSERT INTO users (chat_id, first_seen, last_active, language, blocked, subscriptions, email)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET first_seen = excluded.first_seen, last_active = excluded.last_active,
+			language = excluded.language, blocked = excluded.blocked, subscriptions = excluded.subscriptions,
+			email = excluded.email`,
+		int64(user.ChatID),
+		formatTime(user.FirstSeen),
+		formatTime(user.LastActive),
+		user.Language,
+		user.Blocked,
+		user.Subscriptions,
+		user.Email,
+	)
+	if err != nil {
+		return domain.User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func (db *SQLiteUsersDB) Get(chatID domain.ChatID) (domain.User, error) {
+	users, err := queryUsers(db.storage, `WHERE chat_id = ?`, int64(chatID))
+	if err != nil {
+		return domain.User{}, err
+	}
+	if len(users) == 0 {
+		return domain.User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (db *SQLiteUsersDB) All() ([]domain.User, error) {
+	return queryUsers(db.storage, "")
+}
+
+func queryUsers(
+	querier interface {
+		Query(query string, args ...any) (*sql.Rows, error)
+	},
+	condition string,
+	args ...any,
+) ([]domain.User, error) {
+	rows, err := querier.Query(
+		`SELECT chat_id, first_seen, last_active, language, blocked, subscriptions, email FROM users `+condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.User
+	for rows.Next() {
+		var user domain.User
+		var chatID int64
+		var firstSeen, lastActive string
+		err := rows.Scan(
+			&chatID, &firstSeen, &lastActive, &user.Language, &user.Blocked, &user.Subscriptions, &user.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+		user.ChatID = domain.ChatID(chatID)
+		if user.FirstSeen, err = parseTime(firstSeen); err != nil {
+			return nil, err
+		}
+		if user.LastActive, err = parseTime(lastActive); err != nil {
+			return nil, err
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteBroadcastsDB keeps broadcasts in broadcasts table, recipients are stored as a JSON array.
+type SQLiteBroadcastsDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteBroadcastsDB) Add(broadcast domain.Broadcast) (domain.Broadcast, error) {
+	prepareBroadcastForAdd(&broadcast, time.Now())
+	recipients, err := json.Marshal(broadcast.Recipients)
+	if err != nil {
+		return broadcast, err
+	}
+	_, err = db.storage.Exec(
+		`INSERT INTO broadcasts (id, created_by, created_at, location, action, text, recipients)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		string(broadcast.ID),
+		int64(broadcast.CreatedBy),
+		formatTime(broadcast.CreatedAt),
+		broadcast.Location,
+		broadcast.Action,
+		broadcast.Text,
+		string(recipients),
+	)
+	return broadcast, err
+}
+
+func (db *SQLiteBroadcastsDB) UpdateProgress(
+	id domain.BroadcastID,
+	sent, failed int,
+	finishedAt time.Time,
+) error {
+	return checkAffected(db.storage.Exec(
+		"UPDATE broadcasts SET sent = ?, failed = ?, finished_at = ? WHERE id = ?",
+		sent, failed, formatTime(finishedAt), string(id),
+	))
+}
+
+func (db *SQLiteBroadcastsDB) SetRecipients(id domain.BroadcastID, recipients []domain.ChatID) error {
+	value, err := json.Marshal(recipients)
+	if err != nil {
+		return err
+	}
+	return checkAffected(db.storage.Exec("UPDATE broadcasts SET recipients = ? WHERE id = ?", string(value), string(id)))
+}
+
+func (db *SQLiteBroadcastsDB) All() ([]domain.Broadcast, error) {
+	rows, err := db.storage.Query(
+		`SELECT id, created_by, created_at, location, action, text, recipients, sent, failed, finished_at
+		FROM broadcasts ORDER BY created_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.Broadcast
+	for rows.Next() {
+		var broadcast domain.Broadcast
+		var id, createdAt, recipients, finishedAt string
+		var createdBy int64
+		err := rows.Scan(
+			&id, &createdBy, &createdAt, &broadcast.Location, &broadcast.Action, &broadcast.Text, &recipients,
+			&broadcast.Sent, &broadcast.Failed, &finishedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		broadcast.ID = domain.BroadcastID(id)
+		broadcast.CreatedBy = domain.ChatID(createdBy)
+		if broadcast.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		if broadcast.FinishedAt, err = parseTime(finishedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(recipients), &broadcast.Recipients); err != nil {
+			return nil, err
+		}
+		result = append(result, broadcast)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteOutboxDB keeps undelivered messages in outbox table.
+type SQLiteOutboxDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteOutboxDB) Add(message domain.OutgoingMessage) (domain.OutgoingMessage, error) {
+	prepareOutgoingMessageForAdd(&message, time.Now())
+	_, err := db.storage.Exec(
+		"INSERT INTO outbox (id, chat_id, text, subscription_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		string(message.ID),
+		int64(message.ChatID),
+		message.Text,
+		string(message.SubscriptionID),
+		formatTime(message.CreatedAt),
+	)
+	return message, err
+}
+
+func (db *SQLiteOutboxDB) Remove(id domain.OutgoingMessageID) error {
+	_, err := db.storage.Exec("DELETE FROM outbox WHERE id = ?", string(id))
+	return err
+}
+
+func (db *SQLiteOutboxDB) All() ([]domain.OutgoingMessage, error) {
+	rows, err := db.storage.Query("SELECT id, chat_id, text, subscription_id, created_at FROM outbox ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.OutgoingMessage
+	for rows.Next() {
+		var message domain.OutgoingMessage
+		var id, subscriptionID, createdAt string
+		var chatID int64
+		if err := rows.Scan(&id, &chatID, &message.Text, &subscriptionID, &createdAt); err != nil {
+			return nil, err
+		}
+		message.ID = domain.OutgoingMessageID(id)
+		message.ChatID = domain.ChatID(chatID)
+		message.SubscriptionID = domain.SubscriptionID(subscriptionID)
+		if message.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteConversationsDB keeps conversations in conversations table, one row per chat.
+type SQLiteConversationsDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteConversationsDB) Save(conversation domain.Conversation) error {
+	_, err := db.storage.Exec(
+		`INSERT INTO conversations (chat_id, user_id, state, action, location, people_count, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET user_id = excluded.user_id, state = excluded.state,
+			action = excluded.action, location = excluded.location, people_count = excluded.people_count,
+			updated_at = excluded.updated_at`,
+		int64(conversation.ChatID),
+		conversation.UserID,
+		conversation.State,
+		conversation.Action,
+		conversation.Location,
+		conversation.PeopleCount,
+		formatTime(conversation.UpdatedAt),
+	)
+	return err
+}
+
+func (db *SQLiteConversationsDB) Remove(chatID domain.ChatID) error {
+	_, err := db.storage.Exec("DELETE FROM conversations WHERE chat_id = ?", int64(chatID))
+	return err
+}
+
+func (db *SQLiteConversationsDB) All() ([]domain.Conversation, error) {
+	rows, err := db.storage.Query(
+		"SELECT chat_id, user_id, state, action, location, people_count, updated_at FROM conversations",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.Conversation
+	for rows.Next() {
+		var conversation domain.Conversation
+		var chatID int64
+		var updatedAt string
+		err := rows.Scan(
+			&chatID, &conversation.UserID, &conversation.State, &conversation.Action, &conversation.Location,
+			&conversation.PeopleCount, &updatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		conversation.ChatID = domain.ChatID(chatID)
+		if conversation.UpdatedAt, err = parseTime(updatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, conversation)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteChannelPostsDB keeps channel posts in channel_posts table.
+type SQLiteChannelPostsDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteChannelPostsDB) Save(post domain.ChannelPost) error {
+	_, err := db.storage.Exec(
+		`INSERT OR REPLACE INTO channel_posts
+		(id, channel_id, location, action, people_count, date, start_time, message_id, posted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		string(post.ID),
+		int64(post.ChannelID),
+		post.Location,
+		post.Action,
+		post.PeopleCount,
+		post.Date.String(),
+		post.StartTime.String(),
+		post.MessageID,
+		formatTime(post.PostedAt),
+	)
+	return err
+}
+
+func (db *SQLiteChannelPostsDB) Remove(id domain.ChannelPostID) error {
+	_, err := db.storage.Exec("DELETE FROM channel_posts WHERE id = ?", string(id))
+	return err
+}
+
+func (db *SQLiteChannelPostsDB) All() ([]domain.ChannelPost, error) {
+	rows, err := db.storage.Query(
+		`SELECT id, channel_id, location, action, people_count, date, start_time, message_id, posted_at
+		FROM channel_posts`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.ChannelPost
+	for rows.Next() {
+		var post domain.ChannelPost
+		var id, date, startTime, postedAt string
+		var channelID int64
+		err := rows.Scan(
+			&id, &channelID, &post.Location, &post.Action, &post.PeopleCount, &date, &startTime, &post.MessageID,
+			&postedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		post.ID = domain.ChannelPostID(id)
+		post.ChannelID = domain.ChatID(channelID)
+		if post.Date, err = domain.ParseWindowDate(date); err != nil {
+			return nil, err
+		}
+		start, err := time.Parse(domain.TimeFormat, startTime)
+		if err != nil {
+			return nil, err
+		}
+		post.StartTime = domain.TimeOfDay(start)
+		if post.PostedAt, err = parseTime(postedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, post)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteEventWebhooksDB keeps webhooks of chats in event_webhooks table.
+type SQLiteEventWebhooksDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteEventWebhooksDB) Save(webhook domain.EventWebhook) error {
+	_, err := db.storage.Exec(
+		`INSERT OR REPLACE INTO event_webhooks (chat_id, url, secret, failures, disabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		int64(webhook.ChatID),
+		webhook.URL,
+		webhook.Secret,
+		webhook.Failures,
+		webhook.Disabled,
+		formatTime(webhook.CreatedAt),
+	)
+	return err
+}
+
+func (db *SQLiteEventWebhooksDB) Remove(chatID domain.ChatID) error {
+	_, err := db.storage.Exec("DELETE FROM event_webhooks WHERE chat_id = ?", int64(chatID))
+	return err
+}
+
+func (db *SQLiteEventWebhooksDB) Get(chatID domain.ChatID) (domain.EventWebhook, error) {
+	webhooks, err := db.query("WHERE chat_id = ?", int64(chatID))
+	if err != nil {
+		return domain.EventWebhook{}, err
+	}
+	if len(webhooks) == 0 {
+		return domain.EventWebhook{}, ErrNotFound
+	}
+	return webhooks[0], nil
+}
+
+func (db *SQLiteEventWebhooksDB) All() ([]domain.EventWebhook, error) {
+	return db.query("")
+}
+
+func (db *SQLiteEventWebhooksDB) query(condition string, args ...any) ([]domain.EventWebhook, error) {
+	rows, err := db.storage.Query(
+		"SELECT chat_id, url, secret, failures, disabled, created_at FROM event_webhooks "+condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.EventWebhook
+	for rows.Next() {
+		var webhook domain.EventWebhook
+		var chatID int64
+		var createdAt string
+		err := rows.Scan(&chatID, &webhook.URL, &webhook.Secret, &webhook.Failures, &webhook.Disabled, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		webhook.ChatID = domain.ChatID(chatID)
+		if webhook.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		result = append(result, webhook)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteAPITokensDB keeps hashes of API tokens in api_tokens table.
+type SQLiteAPITokensDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteAPITokensDB) Save(token domain.APIToken) error {
+	_, err := db.storage.Exec(
+		"INSERT OR REPLACE INTO api_tokens (hash, chat_id, created_at) VALUES (?, ?, ?)",
+		token.Hash,
+		int64(token.ChatID),
+		formatTime(token.CreatedAt),
+	)
+	return err
+}
+
+func (db *SQLiteAPITokensDB) Get(hash string) (domain.APIToken, error) {
+	tokens, err := queryAPITokens(db.storage, "WHERE hash = ?", hash)
+	if err != nil {
+		return domain.APIToken{}, err
+	}
+	if len(tokens) == 0 {
+		return domain.APIToken{}, ErrNotFound
+	}
+	return tokens[0], nil
+}
+
+func (db *SQLiteAPITokensDB) RemoveForChat(chatID domain.ChatID) ([]domain.APIToken, error) {
+	tx, err := db.storage.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	removed, err := queryAPITokens(tx, "WHERE chat_id = ?", int64(chatID))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE chat_id = ?", int64(chatID)); err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+func (db *SQLiteAPITokensDB) All() ([]domain.APIToken, error) {
+	return queryAPITokens(db.storage, "")
+}
+
+func queryAPITokens(
+	querier interface {
+		Query(query string, args ...any) (*sql.Rows, error)
+	},
+	condition string,
+	args ...any,
+) ([]domain.APIToken, error) {
+	rows, err := querier.Query("SELECT hash, chat_id, created_at FROM api_tokens "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.APIToken
+	for rows.Next() {
+		var token domain.APIToken
+		var chatID int64
+		var createdAt string
+		if err := rows.Scan(&token.Hash, &chatID, &createdAt); err != nil {
+			return nil, err
+		}
+		token.ChatID = domain.ChatID(chatID)
+		if token.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		result = append(result, token)
+	}
+	return result, rows.Err()
+}
+
+// SQLiteAvailabilityHistoryDB keeps earliest dates in availability_history table. Hours are stored in RFC 3339 UTC,
+// so they compare as text. An empty date means nothing was available.
+type SQLiteAvailabilityHistoryDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteAvailabilityHistoryDB) Save(earliest domain.EarliestDate) error {
+	var date string
+	if (earliest.Date != domain.Date{}) {
+		date = earliest.Date.String()
+	}
+	_, err := db.storage.Exec(
+		`INSERT OR REPLACE INTO availability_history (hour, location, action, people_count, date)
+		VALUES (?, ?, ?, ?, ?)`,
+		earliest.Hour.UTC().Format(time.RFC3339),
+		earliest.Location,
+		earliest.Action,
+		earliest.PeopleCount,
+		date,
+	)
+	return err
+}
+
+func (db *SQLiteAvailabilityHistoryDB) Since(from time.Time) ([]domain.EarliestDate, error) {
+	rows, err := db.storage.Query(
+		`SELECT hour, location, action, people_count, date FROM availability_history WHERE hour >= ?
+		ORDER BY hour, location, action, people_count`,
+		from.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.EarliestDate
+	for rows.Next() {
+		var earliest domain.EarliestDate
+		var hour, date string
+		if err := rows.Scan(&hour, &earliest.Location, &earliest.Action, &earliest.PeopleCount, &date); err != nil {
+			return nil, err
+		}
+		if earliest.Hour, err = time.Parse(time.RFC3339, hour); err != nil {
+			return nil, err
+		}
+		if date != "" {
+			if earliest.Date, err = domain.ParseWindowDate(date); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, earliest)
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteAvailabilityHistoryDB) RemoveBefore(before time.Time) (int, error) {
+	result, err := db.storage.Exec(
+		"DELETE FROM availability_history WHERE hour < ?", before.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// slotAppearanceTimeFormat has fixed width, unlike RFC 3339 with nanoseconds, so times of appearances compare as text.
+const slotAppearanceTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// SQLiteSlotAppearancesDB keeps appearances in slot_appearances table. An empty previous date means no windows were
+// open before.
+type SQLiteSlotAppearancesDB struct {
+	storage *sql.DB
+}
+
+func (db *SQLiteSlotAppearancesDB) Add(appearance domain.SlotAppearance) error {
+	var previousDate string
+	if (appearance.PreviousDate != domain.Date{}) {
+		previousDate = appearance.PreviousDate.String()
+	}
+	_, err := db.storage.Exec(
+		`INSERT OR REPLACE INTO slot_appearances
+		(found_at, location, action, people_count, kind, date, windows, previous_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		appearance.FoundAt.UTC().Format(slotAppearanceTimeFormat),
+		appearance.Location,
+		appearance.Action,
+		appearance.PeopleCount,
+		string(appearance.Kind),
+		appearance.Date.String(),
+		appearance.Windows,
+		previousDate,
+	)
+	return err
+}
+
+func (db *SQLiteSlotAppearancesDB) Latest(location, action string, limit int) ([]domain.SlotAppearance, error) {
+	return db.query(
+		"WHERE location = ? AND action = ? ORDER BY found_at DESC, people_count, kind LIMIT ?", location, action, limit,
+	)
+}
+
+func (db *SQLiteSlotAppearancesDB) All() ([]domain.SlotAppearance, error) {
+	return db.query("ORDER BY found_at, location, action, people_count, kind")
+}
+
+func (db *SQLiteSlotAppearancesDB) query(condition string, args ...any) ([]domain.SlotAppearance, error) {
+	rows, err := db.storage.Query(
+		"SELECT found_at, location, action, people_count, kind, date, windows, previous_date FROM slot_appearances "+
+			condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []domain.SlotAppearance
+	for rows.Next() {
+		var appearance domain.SlotAppearance
+		var foundAt, kind, date, previousDate string
+		err := rows.Scan(
+			&foundAt, &appearance.Location, &appearance.Action, &appearance.PeopleCount, &kind, &date,
+			&appearance.Windows, &previousDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		appearance.Kind = domain.SlotAppearanceKind(kind)
+		if appearance.FoundAt, err = time.Parse(slotAppearanceTimeFormat, foundAt); err != nil {
+			return nil, err
+		}
+		if appearance.Date, err = domain.ParseWindowDate(date); err != nil {
+			return nil, err
+		}
+		if previousDate != "" {
+			if appearance.PreviousDate, err = domain.ParseWindowDate(previousDate); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, appearance)
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteSlotAppearancesDB) RemoveBefore(before time.Time) (int, error) {
+	result, err := db.storage.Exec(
+		"DELETE FROM slot_appearances WHERE found_at < ?", before.UTC().Format(slotAppearanceTimeFormat),
+	)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
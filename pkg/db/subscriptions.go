@@ -1,72 +1,169 @@
 package db
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/silh/trakind/pkg/domain"
 	"github.com/xujiajun/nutsdb"
+	"strconv"
+	"time"
 )
 
-var Subscriptions *SubscriptionsDB
+const subscriptionsBucket = "subscriptions"
+const chatsBucket = "chats"
 
-func init() {
-	Subscriptions = &SubscriptionsDB{storage: db}
+// Subscriptions is the in-memory index over the store of the storage opened with Open.
+var Subscriptions *IndexedSubscriptionsDB
+
+// SubscriptionStore keeps subscriptions by their ID and groups them by location code.
+type SubscriptionStore interface {
+	// Add stores a new subscription. ID and creation time are assigned unless they are already set.
+	// Returns the subscription as it was stored.
+	Add(subscription domain.Subscription) (domain.Subscription, error)
+	// Get returns subscription by its ID or ErrNotFound.
+	Get(id domain.SubscriptionID) (domain.Subscription, error)
+	// Update replaces stored subscription with the same ID, moving it to another location if it was changed.
+	Update(subscription domain.Subscription) error
+	// MarkNotified remembers when the subscriber was last notified.
+	MarkNotified(id domain.SubscriptionID, at time.Time) error
+	// Remove deletes subscription by its ID. Removing a missing subscription is not an error.
+	Remove(id domain.SubscriptionID) error
+	// RemoveForChat deletes all subscriptions of a chat and returns them.
+	RemoveForChat(chatID domain.ChatID) ([]domain.Subscription, error)
+	// GetForLocation returns a list of subscriptions for given location.
+	GetForLocation(locationCode string) ([]domain.Subscription, error)
+	// GetForChat returns a list of subscriptions of a chat.
+	GetForChat(chatID domain.ChatID) ([]domain.Subscription, error)
+	// CountForLocation returns number of subscribers for a location.
+	CountForLocation(locationCode string) (int, error)
+	// LocationCodes returns codes of all locations that have at least one subscription.
+	LocationCodes() ([]string, error)
+}
+
+// newSubscriptionID generates a random ID for a subscription.
+func newSubscriptionID() domain.SubscriptionID {
+	return domain.SubscriptionID(newRandomID())
+}
+
+// newRandomID generates a random hex string that is unique enough to be used as a key.
+func newRandomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return hex.EncodeToString(b)
 }
 
-type SubscriptionsDB struct {
+// prepareForAdd fills in fields that a new subscription must have.
+func prepareForAdd(subscription *domain.Subscription, now time.Time) {
+	if subscription.ID == "" {
+		subscription.ID = newSubscriptionID()
+	}
+	if subscription.CreatedAt.IsZero() {
+		subscription.CreatedAt = now
+	}
+	if subscription.UpdatedAt.IsZero() {
+		subscription.UpdatedAt = subscription.CreatedAt
+	}
+}
+
+// NutsSubscriptionsDB keeps subscriptions as JSON values keyed by ID. Locations and chats are nutsdb sets of IDs keyed by
+// location code and chat ID respectively.
+type NutsSubscriptionsDB struct {
 	storage *nutsdb.DB
 }
 
-func (db *SubscriptionsDB) AddToLocation(locationCode string, subscription domain.Subscription) error {
+func (db *NutsSubscriptionsDB) Add(subscription domain.Subscription) (domain.Subscription, error) {
+	prepareForAdd(&subscription, time.Now())
+	return subscription, db.storage.Update(func(tx *nutsdb.Tx) error {
+		return nutsPutSubscription(tx, subscription)
+	})
+}
+
+func (db *NutsSubscriptionsDB) Get(id domain.SubscriptionID) (domain.Subscription, error) {
+	var result domain.Subscription
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsGetSubscription(tx, id)
+		return err
+	})
+}
+
+func (db *NutsSubscriptionsDB) Update(subscription domain.Subscription) error {
 	return db.storage.Update(func(tx *nutsdb.Tx) error {
-		data, err := json.Marshal(&subscription)
-		if err != nil {
+		if _, err := nutsGetSubscription(tx, subscription.ID); err != nil {
 			return err
 		}
-		return tx.SAdd(locationsBucket, []byte(locationCode), data)
+		subscription.UpdatedAt = time.Now()
+		return nutsPutSubscription(tx, subscription)
 	})
 }
 
-func (db *SubscriptionsDB) RemoveFromLocation(locationCode string, subscription domain.Subscription) error {
+func (db *NutsSubscriptionsDB) MarkNotified(id domain.SubscriptionID, at time.Time) error {
 	return db.storage.Update(func(tx *nutsdb.Tx) error {
-		value, err := json.Marshal(&subscription)
+		subscription, err := nutsGetSubscription(tx, id)
 		if err != nil {
 			return err
 		}
-		return tx.SRem(locationsBucket, []byte(locationCode), value)
+		subscription.LastNotifiedAt = at
+		return nutsPutSubscription(tx, subscription)
 	})
 }
 
-// GetForLocation returns a list of subscriptions for given location.
-// We don't expect that many of them, should be fine keeping all in-memory.
-func (db *SubscriptionsDB) GetForLocation(locationCode string) ([]domain.Subscription, error) {
-	var result []domain.Subscription
-	return result, db.storage.View(func(tx *nutsdb.Tx) error {
-		locationKey := []byte(locationCode)
-		ok, err := tx.SHasKey(locationsBucket, locationKey)
-		if !ok || err == nutsdb.ErrBucketNotFound {
+func (db *NutsSubscriptionsDB) Remove(id domain.SubscriptionID) error {
+	return db.storage.Update(func(tx *nutsdb.Tx) error {
+		subscription, err := nutsGetSubscription(tx, id)
+		if errors.Is(err, ErrNotFound) {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
-		list, err := tx.SMembers(locationsBucket, locationKey)
+		return nutsDeleteSubscription(tx, subscription)
+	})
+}
+
+func (db *NutsSubscriptionsDB) RemoveForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	var removed []domain.Subscription
+	return removed, db.storage.Update(func(tx *nutsdb.Tx) error {
+		subscriptions, err := nutsGetSubscriptionsByKey(tx, chatsBucket, nutsChatKey(chatID))
 		if err != nil {
 			return err
 		}
-		result = make([]domain.Subscription, len(list))
-		for i, item := range list {
-			var subscription domain.Subscription
-			if err := json.Unmarshal(item, &subscription); err != nil {
+		for _, subscription := range subscriptions {
+			if err := nutsDeleteSubscription(tx, subscription); err != nil {
 				return err
 			}
-			result[i] = subscription
 		}
+		removed = subscriptions
 		return nil
 	})
 }
 
+// GetForLocation returns a list of subscriptions for given location.
+// We don't expect that many of them, should be fine keeping all in-memory.
+func (db *NutsSubscriptionsDB) GetForLocation(locationCode string) ([]domain.Subscription, error) {
+	var result []domain.Subscription
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsGetSubscriptionsByKey(tx, locationsBucket, []byte(locationCode))
+		return err
+	})
+}
+
+func (db *NutsSubscriptionsDB) GetForChat(chatID domain.ChatID) ([]domain.Subscription, error) {
+	var result []domain.Subscription
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		result, err = nutsGetSubscriptionsByKey(tx, chatsBucket, nutsChatKey(chatID))
+		return err
+	})
+}
+
 // CountForLocation returns number of subscribers for a location.
-func (db *SubscriptionsDB) CountForLocation(locationCode string) (int, error) {
+func (db *NutsSubscriptionsDB) CountForLocation(locationCode string) (int, error) {
 	var result int
 	return result, db.storage.View(func(tx *nutsdb.Tx) error {
 		locationKey := []byte(locationCode)
@@ -81,3 +178,111 @@ func (db *SubscriptionsDB) CountForLocation(locationCode string) (int, error) {
 		return err
 	})
 }
+
+// LocationCodes returns codes of all locations that have at least one subscription.
+func (db *NutsSubscriptionsDB) LocationCodes() ([]string, error) {
+	var result []string
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		err := tx.SKeys(locationsBucket, "*", func(key string) bool {
+			result = append(result, key)
+			return true
+		})
+		if err == nutsdb.ErrBucket {
+			return nil
+		}
+		return err
+	})
+}
+
+func nutsGetSubscription(tx *nutsdb.Tx, id domain.SubscriptionID) (domain.Subscription, error) {
+	entry, err := tx.Get(subscriptionsBucket, []byte(id))
+	if isNutsNotFound(err) {
+		return domain.Subscription{}, ErrNotFound
+	}
+	if err != nil {
+		return domain.Subscription{}, err
+	}
+	var subscription domain.Subscription
+	err = json.Unmarshal(entry.Value, &subscription)
+	return subscription, err
+}
+
+// nutsGetSubscriptionsByKey returns subscriptions which IDs are members of a set in one of the index buckets.
+func nutsGetSubscriptionsByKey(tx *nutsdb.Tx, bucket string, key []byte) ([]domain.Subscription, error) {
+	ok, err := tx.SHasKey(bucket, key)
+	if !ok || err == nutsdb.ErrBucketNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids, err := tx.SMembers(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]domain.Subscription, 0, len(ids))
+	for _, id := range ids {
+		subscription, err := nutsGetSubscription(tx, domain.SubscriptionID(id))
+		if errors.Is(err, ErrNotFound) {
+			log.Warnw("Index refers to a missing subscription", "bucket", bucket, "key", string(key), "id", string(id))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, subscription)
+	}
+	return result, nil
+}
+
+// nutsPutSubscription stores the subscription and makes sure that only its current location and chat refer to it.
+func nutsPutSubscription(tx *nutsdb.Tx, subscription domain.Subscription) error {
+	id := []byte(subscription.ID)
+	previous, err := nutsGetSubscription(tx, subscription.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil && previous.Location != subscription.Location {
+		if err := tx.SRem(locationsBucket, []byte(previous.Location), id); err != nil {
+			return err
+		}
+	}
+	if err == nil && previous.ChatID != subscription.ChatID {
+		if err := tx.SRem(chatsBucket, nutsChatKey(previous.ChatID), id); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(&subscription)
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(subscriptionsBucket, id, data, TTLInfinite); err != nil {
+		return err
+	}
+	if err := tx.SAdd(locationsBucket, []byte(subscription.Location), id); err != nil {
+		return err
+	}
+	return tx.SAdd(chatsBucket, nutsChatKey(subscription.ChatID), id)
+}
+
+// nutsDeleteSubscription deletes the subscription together with references to it.
+func nutsDeleteSubscription(tx *nutsdb.Tx, subscription domain.Subscription) error {
+	id := []byte(subscription.ID)
+	if err := tx.SRem(locationsBucket, []byte(subscription.Location), id); err != nil {
+		return err
+	}
+	if err := tx.SRem(chatsBucket, nutsChatKey(subscription.ChatID), id); err != nil {
+		return err
+	}
+	return tx.Delete(subscriptionsBucket, id)
+}
+
+func nutsChatKey(chatID domain.ChatID) []byte {
+	return []byte(strconv.FormatInt(int64(chatID), 10))
+}
+
+func isNutsNotFound(err error) bool {
+	return errors.Is(err, nutsdb.ErrKeyNotFound) ||
+		errors.Is(err, nutsdb.ErrNotFoundKey) ||
+		errors.Is(err, nutsdb.ErrBucketNotFound)
+}
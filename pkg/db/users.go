@@ -1,59 +1,242 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
+	"github.com/silh/trakind/pkg/domain"
 	"github.com/xujiajun/nutsdb"
-	"strconv"
+	"time"
 )
 
 const TTLInfinite = 0
 const usersBucket = "users"
 
+// usersCounterKey is where the number of users was kept before there were user records.
 var usersCounterKey = []byte("usersCounter")
 
-var Users *UsersCounterDB
+// Users is the user registry of the storage opened with Open.
+var Users UserStore
 
-func init() {
-	Users = &UsersCounterDB{storage: db}
+// UserStore keeps a record of every chat that talked to the bot. Every change creates the record if it's missing.
+type UserStore interface {
+	// Seen records activity of the chat at the time. A blocked user who writes again is unblocked, the language is
+	// updated if it's not empty.
+	Seen(chatID domain.ChatID, language string, at time.Time) (domain.User, error)
+	// SetBlocked marks whether the bot can't write to the chat.
+	SetBlocked(chatID domain.ChatID, blocked bool) error
+	// SetSubscriptions stores the number of subscriptions of the chat.
+	SetSubscriptions(chatID domain.ChatID, count int) error
+	// SetEmail stores the verified email address of the chat, an empty one removes it.
+	SetEmail(chatID domain.ChatID, email string) error
+	// Save stores the user, replacing the record of the chat.
+	Save(user domain.User) error
+	// Get returns the user of the chat or ErrNotFound.
+	Get(chatID domain.ChatID) (domain.User, error)
+	// All returns all users.
+	All() ([]domain.User, error)
 }
 
-type UsersCounterDB struct {
+// UserCounts summarizes the user registry.
+type UserCounts struct {
+	Total      int
+	Blocked    int
+	Subscribed int
+	// ActiveDay, ActiveWeek and ActiveMonth count users that aren't blocked and were active within the period.
+	ActiveDay   int
+	ActiveWeek  int
+	ActiveMonth int
+}
+
+// CountUsers derives counts of users at the time.
+func CountUsers(users []domain.User, now time.Time) UserCounts {
+	counts := UserCounts{Total: len(users)}
+	for _, user := range users {
+		if user.Blocked {
+			counts.Blocked++
+			continue
+		}
+		if user.Subscriptions > 0 {
+			counts.Subscribed++
+		}
+		idle := now.Sub(user.LastActive)
+		if idle <= 24*time.Hour {
+			counts.ActiveDay++
+		}
+		if idle <= 7*24*time.Hour {
+			counts.ActiveWeek++
+		}
+		if idle <= 30*24*time.Hour {
+			counts.ActiveMonth++
+		}
+	}
+	return counts
+}
+
+// UpdateSubscriptionCount stores the current number of subscriptions of the chat in its user record of the storage
+// opened with Open. Failures are only logged, the count is fixed by the next change of subscriptions.
+func UpdateSubscriptionCount(chatID domain.ChatID) {
+	if err := CountSubscriptions(Subscriptions, Users, chatID); err != nil {
+		log.Warnw("Failed to update subscription count", "chat", chatID, "err", err)
+	}
+}
+
+// CountSubscriptions stores the current number of subscriptions of the chat in its user record.
+func CountSubscriptions(subscriptions SubscriptionStore, users UserStore, chatID domain.ChatID) error {
+	found, err := subscriptions.GetForChat(chatID)
+	if err != nil {
+		return err
+	}
+	return users.SetSubscriptions(chatID, len(found))
+}
+
+// newUser returns the record of a chat seen for the first time.
+func newUser(chatID domain.ChatID, now time.Time) domain.User {
+	return domain.User{ChatID: chatID, FirstSeen: now, LastActive: now}
+}
+
+// seen applies activity at the time to the user.
+func seen(user *domain.User, language string, at time.Time) {
+	if at.After(user.LastActive) {
+		user.LastActive = at
+	}
+	if language != "" {
+		user.Language = language
+	}
+	user.Blocked = false
+}
+
+// NutsUsersDB keeps users as JSON in a nutsdb bucket by chat ID.
+type NutsUsersDB struct {
 	storage *nutsdb.DB
 }
 
-func (db *UsersCounterDB) Increment() {
-	db.add(1)
+func (db *NutsUsersDB) Seen(chatID domain.ChatID, language string, at time.Time) (domain.User, error) {
+	return db.change(chatID, func(user *domain.User) {
+		seen(user, language, at)
+	})
 }
 
-func (db *UsersCounterDB) Decrement() {
-	db.add(-1)
+func (db *NutsUsersDB) SetBlocked(chatID domain.ChatID, blocked bool) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Blocked = blocked
+	})
+	return err
 }
 
-func (db *UsersCounterDB) add(value int64) {
-	err := db.storage.Update(func(tx *nutsdb.Tx) error {
-		entry, err := tx.Get(usersBucket, usersCounterKey)
-		if err != nil &&
-			(!errors.Is(err, nutsdb.ErrBucketNotFound) &&
-				!errors.Is(err, nutsdb.ErrKeyNotFound)) {
-			log.Errorw("Users counter checked", "err", err)
-			return nil
+func (db *NutsUsersDB) SetSubscriptions(chatID domain.ChatID, count int) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Subscriptions = count
+	})
+	return err
+}
+
+func (db *NutsUsersDB) SetEmail(chatID domain.ChatID, email string) error {
+	_, err := db.change(chatID, func(user *domain.User) {
+		user.Email = email
+	})
+	return err
+}
+
+func (db *NutsUsersDB) Save(user domain.User) error {
+	_, err := db.change(user.ChatID, func(stored *domain.User) {
+		*stored = user
+	})
+	return err
+}
+
+// change applies the function to the user of the chat, creating the user if it's missing, and stores the result.
+func (db *NutsUsersDB) change(chatID domain.ChatID, apply func(user *domain.User)) (domain.User, error) {
+	var user domain.User
+	return user, db.storage.Update(func(tx *nutsdb.Tx) error {
+		var err error
+		user, err = getNutsUser(tx, chatID)
+		if errors.Is(err, ErrNotFound) {
+			user = newUser(chatID, time.Now())
+		} else if err != nil {
+			return err
 		}
-		counter, err := strconv.ParseInt(string(entry.Value), 10, 0)
-		if err != nil {
-			log.Errorw("Users counter cannot be parsed", "err", err)
+		apply(&user)
+		return putNutsUser(tx, user)
+	})
+}
+
+func (db *NutsUsersDB) Get(chatID domain.ChatID) (domain.User, error) {
+	var user domain.User
+	return user, db.storage.View(func(tx *nutsdb.Tx) error {
+		var err error
+		user, err = getNutsUser(tx, chatID)
+		return err
+	})
+}
+
+func (db *NutsUsersDB) All() ([]domain.User, error) {
+	var result []domain.User
+	return result, db.storage.View(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(usersBucket)
+		if isNutsNotFound(err) || errors.Is(err, nutsdb.ErrBucketEmpty) {
 			return nil
 		}
-		if counter > 0 && value < 0 { // we have
-			counter += value
+		if err != nil {
+			return err
 		}
-		if err = tx.Put(usersBucket, usersCounterKey, []byte(strconv.FormatInt(counter, 10)), TTLInfinite); err != nil {
-			log.Errorw("Users counter be updated", "err", err)
-			return nil
+		for _, entry := range entries {
+			if string(entry.Key) == string(usersCounterKey) {
+				continue // left by the previous version until the migration removes it
+			}
+			var user domain.User
+			if err := json.Unmarshal(entry.Value, &user); err != nil {
+				return err
+			}
+			result = append(result, user)
 		}
-		log.Info("New user", "count", counter) // TODO this should be moved to bot? or command?
 		return nil
 	})
+}
+
+func getNutsUser(tx *nutsdb.Tx, chatID domain.ChatID) (domain.User, error) {
+	var user domain.User
+	entry, err := tx.Get(usersBucket, nutsChatKey(chatID))
+	if isNutsNotFound(err) {
+		return user, ErrNotFound
+	}
 	if err != nil {
-		log.Errorw("Error adjusting users counter", "value", value, "err", err)
+		return user, err
+	}
+	return user, json.Unmarshal(entry.Value, &user)
+}
+
+func putNutsUser(tx *nutsdb.Tx, user domain.User) error {
+	value, err := json.Marshal(&user)
+	if err != nil {
+		return err
+	}
+	return tx.Put(usersBucket, nutsChatKey(user.ChatID), value, TTLInfinite)
+}
+
+// usersFromSubscriptions returns a user record for every chat with subscriptions: first seen when its first
+// subscription was created and last active when a subscription was last changed. Unknown times are set to now.
+func usersFromSubscriptions(subscriptions []domain.Subscription, now time.Time) map[domain.ChatID]domain.User {
+	users := map[domain.ChatID]domain.User{}
+	for _, subscription := range subscriptions {
+		user := users[subscription.ChatID]
+		user.ChatID = subscription.ChatID
+		if created := subscription.CreatedAt; user.FirstSeen.IsZero() || created.Before(user.FirstSeen) {
+			user.FirstSeen = created
+		}
+		if subscription.UpdatedAt.After(user.LastActive) {
+			user.LastActive = subscription.UpdatedAt
+		}
+		user.Subscriptions++
+		users[subscription.ChatID] = user
+	}
+	for chatID, user := range users {
+		if user.FirstSeen.IsZero() {
+			user.FirstSeen = now
+		}
+		if user.LastActive.Before(user.FirstSeen) {
+			user.LastActive = user.FirstSeen
+		}
+		users[chatID] = user
 	}
+	return users
 }
@@ -0,0 +1,12 @@
+package domain
+
+import "time"
+
+// APIToken lets a client manage subscriptions of the chat that issued it over the HTTP API. Only the hash of the
+// token is stored, the token itself is shown to the chat once.
+type APIToken struct {
+	// Hash is the hex encoded SHA-256 of the token.
+	Hash      string    `json:"hash"`
+	ChatID    ChatID    `json:"chatID"`
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -0,0 +1,28 @@
+package domain
+
+import "time"
+
+// BroadcastID uniquely identifies a Broadcast.
+type BroadcastID string
+
+// Broadcast is an announcement sent by operators to many chats.
+type Broadcast struct {
+	ID        BroadcastID `json:"id"`
+	CreatedBy ChatID      `json:"createdBy"`
+	CreatedAt time.Time   `json:"createdAt"`
+	// Location and Action limit recipients to chats subscribed to them, empty values match any.
+	Location   string   `json:"location,omitempty"`
+	Action     string   `json:"action,omitempty"`
+	Text       string   `json:"text"`
+	Recipients []ChatID `json:"recipients"`
+
+	// Sent is the number of recipients already processed, sending continues from Recipients[Sent].
+	Sent       int       `json:"sent"`
+	Failed     int       `json:"failed"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Finished returns true if all recipients were processed.
+func (b *Broadcast) Finished() bool {
+	return !b.FinishedAt.IsZero()
+}
@@ -0,0 +1,20 @@
+package domain
+
+import "time"
+
+// ChannelPostID identifies a time window published in a channel.
+type ChannelPostID string
+
+// ChannelPost is a message about an open time window in a channel. It's kept until the window is gone and the message
+// is edited to say so.
+type ChannelPost struct {
+	ID          ChannelPostID `json:"id"`
+	ChannelID   ChatID        `json:"channelID"`
+	Location    string        `json:"location"`
+	Action      string        `json:"action"`
+	PeopleCount int           `json:"peopleCount"`
+	Date        Date          `json:"date"`
+	StartTime   TimeOfDay     `json:"startTime"`
+	MessageID   int           `json:"messageID"`
+	PostedAt    time.Time     `json:"postedAt"`
+}
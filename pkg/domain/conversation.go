@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// Conversation is an unfinished dialog with a chat: the step it's at and the answers collected so far.
+type Conversation struct {
+	ChatID ChatID `json:"chatID"`
+	// UserID is the user who started the conversation, in groups only their answers are accepted.
+	UserID      int64     `json:"userID,omitempty"`
+	State       string    `json:"state"`
+	Action      string    `json:"action,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	PeopleCount int       `json:"peopleCount,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
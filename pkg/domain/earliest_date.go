@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// EarliestDate is the earliest open window of a location, action and number of people during an hour. Together they
+// show how availability moves over days.
+type EarliestDate struct {
+	Location    string `json:"location"`
+	Action      string `json:"action"`
+	PeopleCount int    `json:"peopleCount"`
+	// Hour is the start of the hour in UTC.
+	Hour time.Time `json:"hour"`
+	// Date is zero if nothing was available.
+	Date Date `json:"date"`
+}
@@ -0,0 +1,17 @@
+package domain
+
+import "time"
+
+// EventWebhook is an HTTP endpoint of a chat that receives an event for every new time window matching the chat's
+// subscriptions.
+type EventWebhook struct {
+	ChatID ChatID `json:"chatID"`
+	URL    string `json:"url"`
+	// Secret signs the requests, so the endpoint can check they come from the bot.
+	Secret string `json:"secret"`
+	// Failures is the number of deliveries that failed in a row.
+	Failures int `json:"failures"`
+	// Disabled is set after too many failed deliveries, no events are sent until the webhook is set again.
+	Disabled  bool      `json:"disabled,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// OutgoingMessageID uniquely identifies an OutgoingMessage.
+type OutgoingMessageID string
+
+// OutgoingMessage is a text message waiting to be delivered to a chat.
+type OutgoingMessage struct {
+	ID     OutgoingMessageID `json:"id"`
+	ChatID ChatID            `json:"chatID"`
+	Text   string            `json:"text"`
+	// SubscriptionID is set for notifications about slots, delivery results are applied to the subscription.
+	SubscriptionID SubscriptionID `json:"subscriptionID,omitempty"`
+	CreatedAt      time.Time      `json:"createdAt"`
+}
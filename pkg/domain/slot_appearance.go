@@ -0,0 +1,28 @@
+package domain
+
+import "time"
+
+// SlotAppearanceKind tells what a poll found.
+type SlotAppearanceKind string
+
+const (
+	// EarliestDateAppeared means the earliest open window moved to an earlier date or appeared after none were open.
+	EarliestDateAppeared SlotAppearanceKind = "earliest"
+	// WindowsAppeared means windows that weren't there after the previous poll were found.
+	WindowsAppeared SlotAppearanceKind = "windows"
+)
+
+// SlotAppearance is something new that a poll of a location, action and number of people found.
+type SlotAppearance struct {
+	Location    string             `json:"location"`
+	Action      string             `json:"action"`
+	PeopleCount int                `json:"peopleCount"`
+	Kind        SlotAppearanceKind `json:"kind"`
+	// Date is the new earliest date or the earliest date of the new windows.
+	Date Date `json:"date"`
+	// Windows is the number of new windows, it's 0 for EarliestDateAppeared.
+	Windows int `json:"windows"`
+	// PreviousDate is the earliest date before EarliestDateAppeared, zero if no windows were open.
+	PreviousDate Date      `json:"previousDate"`
+	FoundAt      time.Time `json:"foundAt"`
+}
@@ -1,16 +1,26 @@
 package domain
 
+import "time"
+
 const MaxPeopleCount = 6
 
 type ChatID int64
 
+// SubscriptionID uniquely identifies a Subscription.
+type SubscriptionID string
+
 // Subscription to new available TimeWindows.
 type Subscription struct {
-	ChatID ChatID `json:"chatID"`
-	// This is a workaround for us to use Subscription as comparable.
-	TrackBefore Date   `json:"trackBefore"`
-	PeopleCount int    `json:"peopleCount"`
-	Action      string `json:"action,omitempty"`
+	ID          SubscriptionID `json:"id"`
+	ChatID      ChatID         `json:"chatID"`
+	Location    string         `json:"location"`
+	TrackBefore Date           `json:"trackBefore"`
+	PeopleCount int            `json:"peopleCount"`
+	Action      string         `json:"action,omitempty"`
+
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	LastNotifiedAt time.Time `json:"lastNotifiedAt"`
 }
 
 // Matches returns true if Subscription matches given TimeWindow.
@@ -0,0 +1,17 @@
+package domain
+
+import "time"
+
+// User is a chat that talked to the bot.
+type User struct {
+	ChatID     ChatID    `json:"chatID"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastActive time.Time `json:"lastActive"`
+	// Language is the IETF language tag of the user's Telegram client, empty if unknown.
+	Language string `json:"language,omitempty"`
+	// Blocked is set when the bot can't write to the chat anymore, e.g. it was blocked or removed from a group.
+	Blocked       bool `json:"blocked,omitempty"`
+	Subscriptions int  `json:"subscriptions"`
+	// Email is the verified address where notifications are sent too, empty if there is none.
+	Email string `json:"email,omitempty"`
+}
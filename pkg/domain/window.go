@@ -79,7 +79,7 @@ func (t *TimeOfDay) MarshalJSON() ([]byte, error) {
 
 // TimeWindow describes one time open window in IND schedule.
 type TimeWindow struct {
-	//Key       string    `json:"key"`
+	Key       string    `json:"key"`
 	Date      Date      `json:"date"`
 	StartTime TimeOfDay `json:"startTime"`
 	EndTime   TimeOfDay `json:"endTime"`
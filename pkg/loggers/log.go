@@ -1,13 +1,19 @@
 package loggers
 
-import "go.uber.org/zap"
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
 
 var log *zap.SugaredLogger
 
+// level is shared by all loggers and can be changed at runtime.
+var level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
 func init() {
 	config := zap.NewDevelopmentConfig()
 	config.Encoding = "console"
-	config.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	config.Level = level
 	logger, err := config.Build()
 	if err != nil {
 		zap.S().Fatalw("Failed to create logger", "err", err)
@@ -19,3 +25,18 @@ func init() {
 func Logger() *zap.SugaredLogger {
 	return log
 }
+
+// Level returns the current log level.
+func Level() zapcore.Level {
+	return level.Level()
+}
+
+// SetLevel changes the log level of all loggers, text is one of debug, info, warn or error.
+func SetLevel(text string) error {
+	var newLevel zapcore.Level
+	if err := newLevel.UnmarshalText([]byte(text)); err != nil {
+		return err
+	}
+	level.SetLevel(newLevel)
+	return nil
+}
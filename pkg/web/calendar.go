@@ -0,0 +1,167 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // the image has no zoneinfo
+	"unicode/utf8"
+)
+
+const (
+	// calendarRefresh is how often calendar apps are asked to reload a feed, most of them check less often anyway.
+	calendarRefresh = "PT15M"
+	// maxICSLine is the limit of a line in octets before it has to be folded.
+	maxICSLine = 75
+	// defaultWindowLength is used when a window has no end time.
+	defaultWindowLength = 15 * time.Minute
+)
+
+// indTimeZone is the time zone of dates and times IND returns.
+var indTimeZone = mustLoadLocation("Europe/Amsterdam")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// Calendar returns the handler of iCalendar feeds of subscriptions, it should be mounted at bots.CalendarPath. A feed
+// lists windows of the latest poll that match the subscription as tentative events. Its URL is
+// CalendarPath/<subscription ID>/<token>.ics where the token is signed with the secret.
+func Calendar(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rawID, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, bots.CalendarPath), "/")
+		id := domain.SubscriptionID(rawID)
+		if !ok || !strings.HasSuffix(file, ".ics") ||
+			!bots.ValidCalendarToken(secret, id, strings.TrimSuffix(file, ".ics")) {
+			http.NotFound(w, r)
+			return
+		}
+		subscription, err := db.Subscriptions.Get(id)
+		if errors.Is(err, db.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorw("Failed to get subscription", "subscription", id, "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		if _, err := w.Write([]byte(subscriptionCalendar(subscription, time.Now()))); err != nil {
+			log.Debugw("Failed to write calendar", "subscription", id, "err", err)
+		}
+	})
+}
+
+// subscriptionCalendar returns the feed of the subscription built from the latest poll of its group.
+func subscriptionCalendar(subscription domain.Subscription, now time.Time) string {
+	group := db.GroupOf(subscription)
+	location, _ := db.LocationForCode(group.Location)
+	action, _ := db.ActionForCode(group.Action)
+	var ics icsWriter
+	ics.line("BEGIN:VCALENDAR")
+	ics.line("VERSION:2.0")
+	ics.line("PRODID:-//trakind//IND appointment slots//EN")
+	ics.line("CALSCALE:GREGORIAN")
+	ics.line("METHOD:PUBLISH")
+	ics.line("X-WR-CALNAME:" + escapeICSText("IND slots: "+action.Name+" at "+location.Name))
+	ics.line("REFRESH-INTERVAL;VALUE=DURATION:" + calendarRefresh)
+	ics.line("X-PUBLISHED-TTL:" + calendarRefresh)
+	for _, availability := range bots.LatestAvailability() {
+		if availability.Group != group {
+			continue
+		}
+		for _, window := range availability.Windows {
+			if !subscription.Matches(window) {
+				continue
+			}
+			start, end := windowTimes(window)
+			description := fmt.Sprintf(
+				"Open window for %d people found at %s. It may be gone already. Book at %s",
+				group.PeopleCount, availability.CheckedAt.In(indTimeZone).Format("2006-01-02 15:04 MST"),
+				bots.BookingURL(group.Action),
+			)
+			ics.line("BEGIN:VEVENT")
+			ics.line("UID:" + calendarUID(subscription.ID, window))
+			ics.line("DTSTAMP:" + icsTime(now))
+			ics.line("LAST-MODIFIED:" + icsTime(availability.CheckedAt))
+			ics.line("DTSTART:" + icsTime(start))
+			ics.line("DTEND:" + icsTime(end))
+			ics.line("SUMMARY:" + escapeICSText("Open IND slot: "+action.Name+" at "+location.Name))
+			ics.line("DESCRIPTION:" + escapeICSText(description))
+			ics.line("URL:" + bots.BookingURL(group.Action))
+			ics.line("STATUS:TENTATIVE")
+			ics.line("TRANSP:TRANSPARENT")
+			ics.line("END:VEVENT")
+		}
+	}
+	ics.line("END:VCALENDAR")
+	return ics.String()
+}
+
+// calendarUID identifies the event of the window in the feed of the subscription. It stays the same while the window
+// is open, so calendar apps update the event instead of duplicating it.
+func calendarUID(id domain.SubscriptionID, window domain.TimeWindow) string {
+	hash := sha256.Sum256([]byte(string(id) + "/" + bots.WindowKey(window)))
+	return hex.EncodeToString(hash[:16]) + "@trakind"
+}
+
+// windowTimes returns the start and the end of the window, IND gives them in local time of the Netherlands.
+func windowTimes(window domain.TimeWindow) (time.Time, time.Time) {
+	date := time.Time(window.Date)
+	at := func(timeOfDay domain.TimeOfDay) time.Time {
+		clock := time.Time(timeOfDay)
+		return time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), 0, 0, indTimeZone)
+	}
+	start := at(window.StartTime)
+	end := at(window.EndTime)
+	if !end.After(start) {
+		end = start.Add(defaultWindowLength)
+	}
+	return start, end
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escapeICSText escapes a TEXT value as RFC 5545 requires.
+func escapeICSText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// icsWriter writes content lines ending with CRLF and folds the ones longer than maxICSLine octets.
+type icsWriter struct {
+	strings.Builder
+}
+
+func (w *icsWriter) line(content string) {
+	limit := maxICSLine
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		w.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		limit = maxICSLine - 1 // continuation lines start with a space
+	}
+	w.WriteString(content + "\r\n")
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"github.com/silh/trakind/pkg/domain"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSWriterFolding(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"short", "SUMMARY:Open slot", []string{"SUMMARY:Open slot"}},
+		{"exactly the limit", strings.Repeat("a", 75), []string{strings.Repeat("a", 75)}},
+		{"one over the limit", strings.Repeat("a", 76), []string{strings.Repeat("a", 75), " a"}},
+		{
+			"several continuations",
+			strings.Repeat("a", 75+74+10),
+			[]string{strings.Repeat("a", 75), " " + strings.Repeat("a", 74), " " + strings.Repeat("a", 10)},
+		},
+		{
+			// "é" takes two octets and must not be split between lines
+			"multibyte at the limit",
+			strings.Repeat("a", 74) + "éb",
+			[]string{strings.Repeat("a", 74), " éb"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ics icsWriter
+			ics.line(test.content)
+			got := ics.String()
+			if !strings.HasSuffix(got, "\r\n") {
+				t.Fatalf("expected the line to end with CRLF, got %q", got)
+			}
+			lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+			if strings.Join(lines, "|") != strings.Join(test.want, "|") {
+				t.Errorf("expected lines %q, got %q", test.want, lines)
+			}
+			for _, line := range lines {
+				if len(line) > maxICSLine {
+					t.Errorf("line of %d octets is longer than %d", len(line), maxICSLine)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line %q splits a character", line)
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeICSText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"IND slots: Biometrics at IND Amsterdam", "IND slots: Biometrics at IND Amsterdam"},
+		{"Den Haag, Rijswijk", `Den Haag\, Rijswijk`},
+		{"a;b", `a\;b`},
+		{`C:\path`, `C:\\path`},
+		{"first\nsecond", `first\nsecond`},
+		{`\,`, `\\\,`},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			if got := escapeICSText(test.text); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestWindowTimes(t *testing.T) {
+	clock := func(hour, minute int) domain.TimeOfDay {
+		return domain.TimeOfDay(time.Date(0, 1, 1, hour, minute, 0, 0, time.UTC))
+	}
+	winter := domain.Date(time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC))
+	summer := domain.Date(time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name      string
+		window    domain.TimeWindow
+		wantStart string
+		wantEnd   string
+	}{
+		{
+			"winter", domain.TimeWindow{Date: winter, StartTime: clock(9, 0), EndTime: clock(9, 15)},
+			"20260115T080000Z", "20260115T081500Z",
+		},
+		{
+			"summer", domain.TimeWindow{Date: summer, StartTime: clock(9, 0), EndTime: clock(9, 30)},
+			"20260715T070000Z", "20260715T073000Z",
+		},
+		{"no end", domain.TimeWindow{Date: summer, StartTime: clock(13, 0)}, "20260715T110000Z", "20260715T111500Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end := windowTimes(test.window)
+			if icsTime(start) != test.wantStart || icsTime(end) != test.wantEnd {
+				t.Errorf("expected %s-%s, got %s-%s", test.wantStart, test.wantEnd, icsTime(start), icsTime(end))
+			}
+		})
+	}
+}
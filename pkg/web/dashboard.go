@@ -0,0 +1,186 @@
+// Package web serves the public availability dashboard and metrics. Both only show what fetchers learned, nothing
+// about chats.
+package web
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"github.com/silh/trakind/pkg/loggers"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var log = loggers.Logger()
+
+const (
+	// sparklinePeriod is the time a sparkline covers.
+	sparklinePeriod = 7 * 24 * time.Hour
+	sparklineWidth  = 168 // a point per hour
+	sparklineHeight = 24
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+type dashboardPage struct {
+	GeneratedAt  string
+	Actions      []domain.Action
+	PeopleCounts []int
+	Desks        []deskRow
+	Width        int
+	Height       int
+	Days         int
+}
+
+type deskRow struct {
+	Name      string
+	LastCheck string
+	Cells     []cell
+	Sparkline sparkline
+}
+
+type cell struct {
+	Text  string
+	Title string
+	Class string
+}
+
+type sparkline struct {
+	Points string
+	Title  string
+}
+
+// Dashboard returns the handler of the page with the earliest window per location, action and number of people.
+func Dashboard() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page, err := buildDashboard(time.Now())
+		if err != nil {
+			log.Errorw("Failed to build dashboard", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, page); err != nil {
+			log.Warnw("Failed to render dashboard", "err", err)
+		}
+	})
+}
+
+func buildDashboard(now time.Time) (dashboardPage, error) {
+	history, err := db.AvailabilityHistory.Since(now.Add(-sparklinePeriod))
+	if err != nil {
+		return dashboardPage{}, err
+	}
+	latest := map[db.SubscriptionGroup]bots.Availability{}
+	for _, availability := range bots.LatestAvailability() {
+		latest[availability.Group] = availability
+	}
+	page := dashboardPage{
+		GeneratedAt: now.UTC().Format("2006-01-02 15:04 MST"),
+		Actions:     db.SortedActions(),
+		Width:       sparklineWidth,
+		Height:      sparklineHeight,
+		Days:        int(sparklinePeriod / (24 * time.Hour)),
+	}
+	for persons := 1; persons <= domain.MaxPeopleCount; persons++ {
+		page.PeopleCounts = append(page.PeopleCounts, persons)
+	}
+	for _, location := range db.Locations {
+		row := deskRow{Name: location.Name, LastCheck: "never"}
+		if lastSuccess := bots.FetchHealth(location.Code).LastSuccess; !lastSuccess.IsZero() {
+			row.LastCheck = lastSuccess.UTC().Format("2006-01-02 15:04 MST")
+		}
+		for _, action := range page.Actions {
+			_, offered := location.AvailableActions[action]
+			for _, persons := range page.PeopleCounts {
+				if !offered {
+					row.Cells = append(row.Cells, cell{Text: "", Title: "not offered", Class: "na"})
+					continue
+				}
+				group := db.SubscriptionGroup{Location: location.Code, Action: action.Code, PeopleCount: persons}
+				row.Cells = append(row.Cells, groupCell(latest, group))
+			}
+		}
+		row.Sparkline = deskSparkline(history, location.Code, now)
+		page.Desks = append(page.Desks, row)
+	}
+	return page, nil
+}
+
+func groupCell(latest map[db.SubscriptionGroup]bots.Availability, group db.SubscriptionGroup) cell {
+	availability, ok := latest[group]
+	if !ok {
+		return cell{Text: "·", Title: "not polled: nobody tracks it or polling is paused", Class: "unknown"}
+	}
+	checked := "checked " + availability.CheckedAt.UTC().Format("2006-01-02 15:04 MST")
+	if len(availability.Windows) == 0 {
+		return cell{Text: "none", Title: checked, Class: "none"}
+	}
+	first := availability.Windows[0]
+	return cell{
+		Text:  first.Date.String(),
+		Title: fmt.Sprintf("%s at %s, %d windows, %s", &first.Date, &first.StartTime, len(availability.Windows), checked),
+		Class: "open",
+	}
+}
+
+// deskSparkline plots the earliest date of the location over all its actions and numbers of people per hour.
+func deskSparkline(history []domain.EarliestDate, locationCode string, now time.Time) sparkline {
+	start := now.Add(-sparklinePeriod)
+	earliest := map[time.Time]time.Time{}
+	var hours []time.Time
+	for _, entry := range history {
+		if entry.Location != locationCode || (entry.Date == domain.Date{}) {
+			continue
+		}
+		date := time.Time(entry.Date)
+		current, ok := earliest[entry.Hour]
+		if !ok {
+			hours = append(hours, entry.Hour) // history is ordered by hour
+		}
+		if !ok || date.Before(current) {
+			earliest[entry.Hour] = date
+		}
+	}
+	if len(hours) == 0 {
+		return sparkline{Title: "no windows in the last days"}
+	}
+	low, high := earliest[hours[0]], earliest[hours[0]]
+	for _, hour := range hours {
+		if date := earliest[hour]; date.Before(low) {
+			low = date
+		} else if date.After(high) {
+			high = date
+		}
+	}
+	span := high.Sub(low)
+	points := make([]string, 0, len(hours))
+	for _, hour := range hours {
+		x := float64(hour.Sub(start)) / float64(sparklinePeriod) * sparklineWidth
+		y := float64(sparklineHeight) / 2
+		if span > 0 {
+			// later dates are higher
+			y = sparklineHeight - float64(earliest[hour].Sub(low))/float64(span)*sparklineHeight
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	last := earliest[hours[len(hours)-1]]
+	return sparkline{
+		Points: strings.Join(points, " "),
+		Title: fmt.Sprintf(
+			"earliest date between %s and %s, now %s",
+			low.Format(domain.DateFormat), high.Format(domain.DateFormat), last.Format(domain.DateFormat),
+		),
+	}
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"github.com/silh/trakind/pkg/domain"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// FeedsPath is the path Atom feeds of locations are served under.
+	FeedsPath = "/feeds/"
+	// feedEntries limits entries of a feed, readers only need the recent ones.
+	feedEntries = 50
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string   `xml:"id"`
+	Title     string   `xml:"title"`
+	Updated   string   `xml:"updated"`
+	Published string   `xml:"published"`
+	Link      atomLink `xml:"link"`
+	Content   atomText `xml:"content"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Feeds returns the handler of Atom feeds of slot appearances, it should be mounted at FeedsPath. A feed covers a
+// location and an action for all numbers of people, its URL is FeedsPath<location code>/<action code>.atom. Feeds of
+// a location and an action that aren't polled are not found, there is nothing to add to them. baseURL is the public URL
+// of the server, feeds link to themselves only if it is set.
+func Feeds(baseURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		locationCode, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, FeedsPath), "/")
+		if !ok || !strings.HasSuffix(file, ".atom") {
+			http.NotFound(w, r)
+			return
+		}
+		location, knownLocation := db.LocationForCode(locationCode)
+		action, knownAction := db.ActionForCode(strings.TrimSuffix(file, ".atom"))
+		if !knownLocation || !knownAction {
+			http.NotFound(w, r)
+			return
+		}
+		if _, offered := location.AvailableActions[action]; !offered {
+			http.NotFound(w, r)
+			return
+		}
+		if !bots.IsPolled(location.Code, action.Code) {
+			http.NotFound(w, r)
+			return
+		}
+		found, err := db.SlotAppearances.Latest(location.Code, action.Code, feedEntries)
+		if err != nil {
+			log.Errorw("Failed to get slot appearances", "location", location.Code, "action", action.Code, "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		feed := appearancesFeed(location, action, found, baseURL, time.Now())
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if _, err := w.Write([]byte(xml.Header)); err != nil {
+			log.Debugw("Failed to write feed", "err", err)
+			return
+		}
+		if err := xml.NewEncoder(w).Encode(feed); err != nil {
+			log.Debugw("Failed to write feed", "err", err)
+		}
+	})
+}
+
+// appearancesFeed builds the feed of appearances ordered from the newest.
+func appearancesFeed(
+	location domain.Location,
+	action domain.Action,
+	appearances []domain.SlotAppearance,
+	baseURL string,
+	now time.Time,
+) atomFeed {
+	bookingURL := bots.BookingURL(action.Code)
+	feed := atomFeed{
+		ID:      fmt.Sprintf("urn:trakind:feed:%s:%s", location.Code, action.Code),
+		Title:   fmt.Sprintf("IND slots: %s at %s", action.Name, location.Name),
+		Updated: now.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: bookingURL}},
+		Author:  atomAuthor{Name: "trakind"},
+	}
+	if baseURL != "" {
+		self := strings.TrimSuffix(baseURL, "/") + FeedsPath + location.Code + "/" + action.Code + ".atom"
+		feed.Links = append(feed.Links, atomLink{Rel: "self", Type: "application/atom+xml", Href: self})
+	}
+	if len(appearances) > 0 {
+		feed.Updated = appearances[0].FoundAt.UTC().Format(time.RFC3339)
+	}
+	for _, appearance := range appearances {
+		foundAt := appearance.FoundAt.UTC().Format(time.RFC3339)
+		title, content := describeAppearance(appearance)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID: fmt.Sprintf(
+				"urn:trakind:appearance:%s:%s:%d:%s:%d", appearance.Location, appearance.Action,
+				appearance.PeopleCount, appearance.Kind, appearance.FoundAt.UnixNano(),
+			),
+			Title:     title,
+			Updated:   foundAt,
+			Published: foundAt,
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: bookingURL},
+			Content: atomText{
+				Type: "text",
+				Text: content + fmt.Sprintf(" Found at %s. Book at %s", foundAt, bookingURL),
+			},
+		})
+	}
+	return feed
+}
+
+// describeAppearance returns the title and the text of the entry of the appearance.
+func describeAppearance(appearance domain.SlotAppearance) (string, string) {
+	switch appearance.Kind {
+	case domain.EarliestDateAppeared:
+		title := fmt.Sprintf("New earliest date %s for %d people", &appearance.Date, appearance.PeopleCount)
+		if (appearance.PreviousDate == domain.Date{}) {
+			return title, fmt.Sprintf("Windows for %d people opened, the earliest is on %s, none were open before.",
+				appearance.PeopleCount, &appearance.Date)
+		}
+		return title, fmt.Sprintf("The earliest window for %d people moved from %s to %s.",
+			appearance.PeopleCount, &appearance.PreviousDate, &appearance.Date)
+	default:
+		windows := fmt.Sprintf("%d new windows", appearance.Windows)
+		if appearance.Windows == 1 {
+			windows = "A new window"
+		}
+		title := fmt.Sprintf("%s for %d people from %s", windows, appearance.PeopleCount, &appearance.Date)
+		return title, fmt.Sprintf("%s for %d people appeared since the previous check, the earliest is on %s.",
+			windows, appearance.PeopleCount, &appearance.Date)
+	}
+}
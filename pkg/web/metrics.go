@@ -0,0 +1,107 @@
+package web
+
+import (
+	"fmt"
+	"github.com/silh/trakind/pkg/bots"
+	"github.com/silh/trakind/pkg/db"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics returns the handler of metrics in Prometheus text format.
+func Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, time.Now())
+	})
+}
+
+func writeMetrics(w io.Writer, now time.Time) {
+	subscriptions := map[string]int{}
+	for _, subscription := range db.Subscriptions.All() {
+		subscriptions[subscription.Location]++
+	}
+	writeHeader(w, "trakind_subscriptions", "Number of subscriptions per location.")
+	for _, location := range db.Locations {
+		writeSample(w, "trakind_subscriptions", float64(subscriptions[location.Code]), "location", location.Code)
+	}
+
+	users, err := db.Users.All()
+	if err != nil {
+		log.Warnw("Failed to get users for metrics", "err", err)
+	} else {
+		counts := db.CountUsers(users, now)
+		writeHeader(w, "trakind_users", "Number of users, active ones weren't blocked and were active in the period.")
+		writeSample(w, "trakind_users", float64(counts.Total), "state", "total")
+		writeSample(w, "trakind_users", float64(counts.Blocked), "state", "blocked")
+		writeSample(w, "trakind_users", float64(counts.Subscribed), "state", "subscribed")
+		writeSample(w, "trakind_users", float64(counts.ActiveDay), "state", "active_day")
+		writeSample(w, "trakind_users", float64(counts.ActiveWeek), "state", "active_week")
+		writeSample(w, "trakind_users", float64(counts.ActiveMonth), "state", "active_month")
+	}
+
+	writeHeader(w, "trakind_fetch_last_success_timestamp_seconds", "Time of the last successful fetch of a location.")
+	for _, location := range db.Locations {
+		if health := bots.FetchHealth(location.Code); !health.LastSuccess.IsZero() {
+			value := float64(health.LastSuccess.Unix())
+			writeSample(w, "trakind_fetch_last_success_timestamp_seconds", value, "location", location.Code)
+		}
+	}
+	writeHeader(w, "trakind_fetch_consecutive_failures", "Number of failed fetches of a location in a row.")
+	for _, location := range db.Locations {
+		failures := float64(bots.FetchHealth(location.Code).ConsecutiveFailures)
+		writeSample(w, "trakind_fetch_consecutive_failures", failures, "location", location.Code)
+	}
+	writeHeader(w, "trakind_location_paused", "1 if polling of a location is paused by an operator.")
+	for _, location := range db.Locations {
+		var paused float64
+		if bots.FetchHealth(location.Code).Paused {
+			paused = 1
+		}
+		writeSample(w, "trakind_location_paused", paused, "location", location.Code)
+	}
+
+	availability := bots.LatestAvailability()
+	writeHeader(w, "trakind_windows", "Number of open windows found by the latest fetch.")
+	for _, group := range availability {
+		writeSample(w, "trakind_windows", float64(len(group.Windows)), groupLabels(group)...)
+	}
+	writeHeader(w, "trakind_earliest_window_timestamp_seconds", "Date of the earliest open window, if there is one.")
+	for _, group := range availability {
+		if len(group.Windows) > 0 {
+			value := float64(time.Time(group.Windows[0].Date).Unix())
+			writeSample(w, "trakind_earliest_window_timestamp_seconds", value, groupLabels(group)...)
+		}
+	}
+}
+
+func groupLabels(availability bots.Availability) []string {
+	return []string{
+		"location", availability.Group.Location,
+		"action", availability.Group.Action,
+		"persons", strconv.Itoa(availability.Group.PeopleCount),
+	}
+}
+
+func writeHeader(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// writeSample writes one sample, labels are name and value pairs.
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+escapeLabel(labels[i+1]))
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}